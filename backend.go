@@ -0,0 +1,337 @@
+package lanhttp
+
+import (
+	"bytes"
+	"encoding/json"
+	"net"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+)
+
+// Backend is a single live IP for a host along with optional attributes. When
+// decoding routes, a backend may be given either as a plain IP string or as an
+// object, e.g. {"ip":"10.0.0.1","weight":3,"metadata":{"zone":"us-east-1a"}}.
+type Backend struct {
+	IP string `json:"ip"`
+
+	// Weight of the backend relative to other backends of the same host.
+	// A backend with weight 3 receives three times the traffic of a
+	// backend with weight 1. Weights less than 1 are treated as 1, and
+	// weights greater than MaxWeight as MaxWeight.
+	Weight int `json:"weight,omitempty"`
+
+	// Metadata about the backend from the registry, such as its "zone" or
+	// "version". See ZoneAware.
+	Metadata map[string]string `json:"metadata,omitempty"`
+}
+
+func (b *Backend) UnmarshalJSON(byt []byte) error {
+	if len(byt) > 0 && byt[0] == '"' {
+		var ip string
+		if err := json.Unmarshal(byt, &ip); err != nil {
+			return err
+		}
+		*b = Backend{IP: ip}
+		return nil
+	}
+
+	// Use an alias type to avoid recursing back into UnmarshalJSON
+	type backend Backend
+	var tmp backend
+	dec := json.NewDecoder(bytes.NewReader(byt))
+	if err := dec.Decode(&tmp); err != nil {
+		return err
+	}
+	*b = Backend(tmp)
+	return nil
+}
+
+// MaxWeight is the greatest weight of a backend. Selection among weighted
+// backends expands each IP in proportion to its weight, so this bounds the
+// cost of building the table for weights from an untrusted route feed.
+const MaxWeight = 100
+
+func (b Backend) weight() int {
+	switch {
+	case b.Weight < 1:
+		return 1
+	case b.Weight > MaxWeight:
+		return MaxWeight
+	}
+	return b.Weight
+}
+
+// toBackends converts routes into backends with default attributes.
+func toBackends(routes Routes) map[string][]Backend {
+	bs := make(map[string][]Backend, len(routes))
+	for host, ips := range routes {
+		hostBackends := make([]Backend, 0, len(ips))
+		for _, ip := range ips {
+			hostBackends = append(hostBackends, Backend{IP: ip})
+		}
+		bs[host] = hostBackends
+	}
+	return bs
+}
+
+// splitBackends into the IPs for each host and the attributes of any
+// backends which differ from the defaults. Both are copied from bs, including
+// metadata, so they don't share any memory with it.
+func splitBackends(
+	bs map[string][]Backend,
+) (Routes, map[string]map[string]Backend) {
+	routes := make(Routes, len(bs))
+	var attrs map[string]map[string]Backend
+	for host, hostBackends := range bs {
+		ips := make([]string, 0, len(hostBackends))
+		for _, b := range hostBackends {
+			ips = append(ips, b.IP)
+			if b.weight() == 1 && len(b.Metadata) == 0 {
+				continue
+			}
+			if attrs == nil {
+				attrs = map[string]map[string]Backend{}
+			}
+			if attrs[host] == nil {
+				attrs[host] = map[string]Backend{}
+			}
+			b.Metadata = copyMetadata(b.Metadata)
+			attrs[host][b.IP] = b
+		}
+		routes[host] = ips
+	}
+	return routes, attrs
+}
+
+// routeStore holds the live backends of a client and its clones.
+type routeStore struct {
+	// backends holds the *table of backends that are currently live.
+	// It's replaced wholesale on each change, so requests can read it
+	// without contending with updates.
+	backends atomic.Value
+
+	// changed is closed and replaced each time the backends change
+	changed chan struct{}
+
+	// mu serializes changes to backends and protects changed
+	mu sync.Mutex
+}
+
+func newRouteStore() *routeStore {
+	s := &routeStore{changed: make(chan struct{})}
+	s.backends.Store(newTable(Routes{}, nil))
+	return s
+}
+
+// table of live backends.
+type table struct {
+	// routes are the IPs of each host
+	routes Routes
+
+	// attrs of backends which differ from the defaults, keyed by host and
+	// then IP
+	attrs map[string]map[string]Backend
+
+	// weighted IPs of hosts having backends with differing weights,
+	// expanded so that each IP appears in proportion to its weight
+	weighted map[string][]string
+
+	// version of routes, computed when first requested
+	versionOnce sync.Once
+	version     uint64
+}
+
+func newTable(routes Routes, attrs map[string]map[string]Backend) *table {
+	t := &table{routes: routes, attrs: attrs}
+	for host, hostAttrs := range attrs {
+		ips := expandWeights(routes[host], hostAttrs)
+		if ips == nil {
+			continue
+		}
+		if t.weighted == nil {
+			t.weighted = map[string][]string{}
+		}
+		t.weighted[host] = ips
+	}
+	return t
+}
+
+// routesVersion of the table, computing it once.
+func (t *table) routesVersion() uint64 {
+	t.versionOnce.Do(func() { t.version = t.routes.version() })
+	return t.version
+}
+
+// candidates for selection for a host, repeated in proportion to their
+// weights.
+func (t *table) candidates(host string) []string {
+	if ips, ok := t.weighted[host]; ok {
+		return ips
+	}
+	return t.routes[host]
+}
+
+// backends returns a copy of the table's backends including their attributes.
+func (t *table) backends() map[string][]Backend {
+	bs := make(map[string][]Backend, len(t.routes))
+	for host, ips := range t.routes {
+		hostBackends := make([]Backend, 0, len(ips))
+		for _, ip := range ips {
+			b, ok := t.attrs[host][ip]
+			if !ok {
+				b = Backend{IP: ip}
+			}
+			b.Weight = b.weight()
+			b.Metadata = copyMetadata(b.Metadata)
+			hostBackends = append(hostBackends, b)
+		}
+		bs[host] = hostBackends
+	}
+	return bs
+}
+
+// metadata of a backend, or nil if it has none. The result must not be
+// modified.
+func (t *table) metadata(host, ip string) map[string]string {
+	return t.attrs[host][ip].Metadata
+}
+
+func copyMetadata(md map[string]string) map[string]string {
+	if md == nil {
+		return nil
+	}
+	cp := make(map[string]string, len(md))
+	for k, v := range md {
+		cp[k] = v
+	}
+	return cp
+}
+
+// expandWeights returns the IPs of a host repeated in proportion to their
+// weights, interleaved using smooth weighted round-robin so that heavy
+// backends aren't selected in long runs. If all weights are equal this
+// returns nil, indicating that the IPs should be used as-is.
+func expandWeights(ips []string, attrs map[string]Backend) []string {
+	if len(attrs) == 0 {
+		return nil
+	}
+	weights := make([]int, len(ips))
+	var g, total int
+	for i, ip := range ips {
+		weights[i] = 1
+		if b, ok := attrs[ip]; ok {
+			weights[i] = b.weight()
+		}
+		g = gcd(g, weights[i])
+	}
+	for i := range weights {
+		weights[i] /= g
+		total += weights[i]
+	}
+	if total == len(ips) {
+		return nil
+	}
+	current := make([]int, len(ips))
+	out := make([]string, 0, total)
+	for len(out) < total {
+		best := 0
+		for i := range current {
+			current[i] += weights[i]
+			if current[i] > current[best] {
+				best = i
+			}
+		}
+		current[best] -= total
+		out = append(out, ips[best])
+	}
+	return out
+}
+
+func gcd(a, b int) int {
+	for b != 0 {
+		a, b = b, a%b
+	}
+	return a
+}
+
+// dedupeBackends keeps only the first backend listed for each IP of a host, so
+// registries listing an IP twice don't bias selection toward it. Order is
+// otherwise preserved. routes is modified in place and returned.
+func dedupeBackends(routes map[string][]Backend) map[string][]Backend {
+	for host, bs := range routes {
+		seen := make(map[string]struct{}, len(bs))
+		unique := bs[:0]
+		for _, b := range bs {
+			if _, ok := seen[b.IP]; ok {
+				continue
+			}
+			seen[b.IP] = struct{}{}
+			unique = append(unique, b)
+		}
+		routes[host] = unique
+	}
+	return routes
+}
+
+// dropInvalid backends from routes fetched from uri, logging each. This
+// prevents typos in a route feed from becoming backends which always fail.
+func (c *Client) dropInvalid(uri string, routes map[string][]Backend) {
+	c.mu.RLock()
+	unixSockets := c.unixSockets
+	c.mu.RUnlock()
+	for host, bs := range routes {
+		valid := bs[:0]
+		for _, b := range bs {
+			if _, ok := socketPath(b.IP); ok && unixSockets {
+				valid = append(valid, b)
+				continue
+			}
+			if !isValidBackend(b.IP) {
+				c.log.Printf("%s: %s: dropping invalid backend %q",
+					uri, host, b.IP)
+				continue
+			}
+			valid = append(valid, b)
+		}
+		routes[host] = valid
+	}
+}
+
+// filterHosts removes the hosts rejected by the client's host filter from
+// routes, if it has one. routes is modified in place.
+func (c *Client) filterHosts(routes map[string][]Backend) {
+	c.mu.RLock()
+	keep := c.hostFilter
+	c.mu.RUnlock()
+	if keep == nil {
+		return
+	}
+	for host := range routes {
+		if !keep(host) {
+			delete(routes, host)
+		}
+	}
+}
+
+// isValidBackend reports whether s is an IP, optionally with a port.
+func isValidBackend(s string) bool {
+	if isIP(s) {
+		return true
+	}
+	host, port, err := net.SplitHostPort(s)
+	if err != nil || !isIP(host) {
+		return false
+	}
+	n, err := strconv.Atoi(port)
+	return err == nil && n > 0 && n <= 65535
+}
+
+// isIP reports whether s is an IPv4 or IPv6 address, allowing an IPv6 zone.
+func isIP(s string) bool {
+	if i := strings.LastIndexByte(s, '%'); i >= 0 {
+		s = s[:i]
+	}
+	return net.ParseIP(s) != nil
+}
@@ -0,0 +1,192 @@
+package lanhttp
+
+import (
+	"context"
+	"encoding/json"
+	"net/url"
+	"reflect"
+	"sync"
+	"testing"
+	"time"
+)
+
+func TestBackendUnmarshalJSON(t *testing.T) {
+	t.Parallel()
+
+	const data = `{
+		"a.internal": [
+			"10.0.0.1",
+			{"ip": "10.0.0.2", "weight": 3},
+			{"ip": "10.0.0.3", "metadata": {"zone": "b"}}
+		]
+	}`
+	var got map[string][]Backend
+	if err := json.Unmarshal([]byte(data), &got); err != nil {
+		t.Fatal(err)
+	}
+	want := map[string][]Backend{"a.internal": {
+		{IP: "10.0.0.1"},
+		{IP: "10.0.0.2", Weight: 3},
+		{IP: "10.0.0.3", Metadata: map[string]string{"zone": "b"}},
+	}}
+	if !reflect.DeepEqual(got, want) {
+		t.Fatalf("expected %v, got %v", want, got)
+	}
+}
+
+func TestWeightedGetIP(t *testing.T) {
+	t.Parallel()
+
+	c := NewClient(nil).WithBalancer(&RoundRobin{})
+	c.changeRoutes(map[string][]Backend{"a.internal": {
+		{IP: "1", Weight: 1},
+		{IP: "2", Weight: 3},
+	}})
+	counts := map[string]int{}
+	for i := 0; i < 8; i++ {
+		counts[c.getIP("a.internal")]++
+	}
+	if counts["1"] != 2 || counts["2"] != 6 {
+		t.Fatalf("unexpected distribution: %v", counts)
+	}
+	bs := c.Backends()["a.internal"]
+	if len(bs) != 2 || bs[1].Weight != 3 {
+		t.Fatalf("unexpected backends: %v", bs)
+	}
+
+	// Huge weights are clamped rather than expanded in full
+	c.changeRoutes(map[string][]Backend{"a.internal": {
+		{IP: "1", Weight: 1},
+		{IP: "2", Weight: 1e9},
+	}})
+	if n := len(c.live().candidates("a.internal")); n != 1+MaxWeight {
+		t.Fatalf("expected %d candidates, got %d", 1+MaxWeight, n)
+	}
+	if w := c.Backends()["a.internal"][1].Weight; w != MaxWeight {
+		t.Fatalf("expected weight %d, got %d", MaxWeight, w)
+	}
+}
+
+func TestDropInvalid(t *testing.T) {
+	t.Parallel()
+
+	body := `{"a.internal": [
+		"10.0.0.1", "10.0.0.1;", "", "10.0.0.2:8080", "10.0.0.3:0",
+		"fe80::1", "[fe80::2]:8080", "example.com", "300.0.0.1"
+	]}`
+	c := NewClient(routesClient{body: body})
+	routes, _, err := c.firstURL(context.Background(), []string{"http://a"},
+		time.Second)
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := map[string][]Backend{"a.internal": {
+		{IP: "10.0.0.1"},
+		{IP: "10.0.0.2:8080"},
+		{IP: "fe80::1"},
+		{IP: "[fe80::2]:8080"},
+	}}
+	if !reflect.DeepEqual(routes, want) {
+		t.Fatalf("expected %v, got %v", want, routes)
+	}
+}
+
+func TestDedupeBackends(t *testing.T) {
+	t.Parallel()
+
+	body := `{"a.internal": [
+		"10.0.0.2", "10.0.0.1", {"ip": "10.0.0.2", "weight": 3},
+		"10.0.0.3", "10.0.0.1"
+	]}`
+	c := NewClient(routesClient{body: body})
+	routes, _, err := c.firstURL(context.Background(), []string{"http://a"},
+		time.Second)
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := map[string][]Backend{"a.internal": {
+		{IP: "10.0.0.2"},
+		{IP: "10.0.0.1"},
+		{IP: "10.0.0.3"},
+	}}
+	if !reflect.DeepEqual(routes, want) {
+		t.Fatalf("expected %v, got %v", want, routes)
+	}
+}
+
+func TestBackendPorts(t *testing.T) {
+	t.Parallel()
+
+	c := NewClient(nil).WithRoutes(Routes{
+		"a.internal": []string{"10.0.0.1:8080"},
+		"b.internal": []string{"[fe80::1]:8081"},
+		"c.internal": []string{"10.0.0.3"},
+	})
+	if got := c.getIP("a.internal"); got != "10.0.0.1:8080" {
+		t.Fatalf("expected 10.0.0.1:8080, got %s", got)
+	}
+	tcs := map[string]string{
+		"http://a.internal/x":      "http://10.0.0.1:8080/x",
+		"http://a.internal:9000/x": "http://10.0.0.1:8080/x",
+		"http://b.internal/x":      "http://[fe80::1]:8081/x",
+		"http://c.internal:9000/x": "http://10.0.0.3:9000/x",
+	}
+	for have, want := range tcs {
+		uri, err := url.Parse(have)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if got := c.ResolveHost(uri).String(); got != want {
+			t.Fatalf("expected %s, got %s", want, got)
+		}
+	}
+}
+
+func TestChangeRoutesCopies(t *testing.T) {
+	t.Parallel()
+
+	src := map[string][]Backend{"a.internal": {
+		{IP: "10.0.0.1", Metadata: map[string]string{"zone": "a"}},
+		{IP: "10.0.0.2", Weight: 2},
+	}}
+	routes := Routes{"b.internal": []string{"10.0.0.3"}}
+	c := NewClient(nil)
+	c.changeRoutes(src)
+	withRoutes := NewClient(nil).WithRoutes(routes)
+
+	// Mutate the sources while reading concurrently, which fails under
+	// the race detector if any memory is shared
+	var wg sync.WaitGroup
+	wg.Add(1)
+	go func() {
+		defer wg.Done()
+		for i := 0; i < 100; i++ {
+			src["a.internal"][0].IP = "10.0.0.9"
+			src["a.internal"][0].Metadata["zone"] = "b"
+			src["a.internal"][1].Weight = 5
+			routes["b.internal"][0] = "10.0.0.9"
+		}
+		src["c.internal"] = []Backend{{IP: "10.0.0.4"}}
+		routes["c.internal"] = []string{"10.0.0.4"}
+	}()
+	for i := 0; i < 100; i++ {
+		_ = c.getIP("a.internal")
+		_ = c.Metadata("a.internal", "10.0.0.1")
+		_ = withRoutes.getIP("b.internal")
+	}
+	wg.Wait()
+
+	want := map[string][]Backend{"a.internal": {
+		{IP: "10.0.0.1", Weight: 1, Metadata: map[string]string{
+			"zone": "a",
+		}},
+		{IP: "10.0.0.2", Weight: 2},
+	}}
+	if got := c.Backends(); !reflect.DeepEqual(got, want) {
+		t.Fatalf("expected %v, got %v", want, got)
+	}
+	wantRoutes := Routes{"b.internal": []string{"10.0.0.3"}}
+	if got := withRoutes.Routes(); !got.Equal(wantRoutes) {
+		t.Fatalf("expected %v, got %v", wantRoutes, got)
+	}
+}
@@ -0,0 +1,628 @@
+package lanhttp
+
+import (
+	"hash/fnv"
+	"math"
+	"math/rand"
+	"net/http"
+	"sort"
+	"strconv"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// Balancer selects a single backend IP for a host from its live IPs. ips is
+// guaranteed to be non-empty. Implementations must be safe for concurrent
+// use.
+type Balancer interface {
+	Pick(host string, ips []string) string
+}
+
+// Tracker is optionally implemented by a Balancer to be notified as requests
+// are sent to the backends it picks. Completed is called once a request fails
+// or its response body is closed, so callers must close response bodies for
+// counts to remain accurate.
+type Tracker interface {
+	Dispatched(host, ip string)
+	Completed(host, ip string)
+}
+
+// LatencyRecorder is optionally implemented by a Balancer to be told how long
+// the backends it picks take to respond. latency runs from sending a request
+// until its response headers arrive or it fails, measured with the Client's
+// clock. Canceled requests aren't recorded.
+type LatencyRecorder interface {
+	RecordLatency(host, ip string, latency time.Duration, err error)
+}
+
+// MetadataBalancer is optionally implemented by a Balancer which selects IPs
+// using the metadata of their backends. When implemented, the Client calls
+// PickWithMetadata instead of Pick. metadata returns the metadata of one of
+// ips, or nil if it has none, and its result must not be modified.
+type MetadataBalancer interface {
+	Balancer
+	PickWithMetadata(
+		host string,
+		ips []string,
+		metadata func(ip string) map[string]string,
+	) string
+}
+
+// RequestBalancer is optionally implemented by a Balancer which selects IPs
+// using the request being sent. When implemented, the Client calls
+// PickRequest instead of Pick for requests sent through Do and RoundTripper.
+// URLs resolved without a request, such as through ResolveHost, still use
+// Pick.
+type RequestBalancer interface {
+	Balancer
+	PickRequest(req *http.Request, host string, ips []string) string
+}
+
+// GlobalBalancer is optionally implemented by a Balancer which selects IPs
+// using the routes of every host, such as a proxy spreading many hosts over a
+// shared pool of IPs. When implemented, the Client calls PickGlobal instead of
+// Pick or PickWithMetadata. routes are the live routes of every host and must
+// not be modified. A GlobalBalancer which also implements Tracker is notified
+// of requests to every host, so it can track load across all of them.
+type GlobalBalancer interface {
+	Balancer
+	PickGlobal(host string, ips []string, routes Routes) string
+}
+
+// randomBalancer distributes traffic randomly among IPs. This is the default.
+type randomBalancer struct{ rnd *lockedRand }
+
+func (b randomBalancer) Pick(host string, ips []string) string {
+	return ips[b.rnd.Intn(len(ips))]
+}
+
+// lockedRand is a *rand.Rand which is safe for concurrent use.
+type lockedRand struct {
+	r  *rand.Rand
+	mu sync.Mutex
+}
+
+func (lr *lockedRand) Intn(n int) int {
+	lr.mu.Lock()
+	defer lr.mu.Unlock()
+
+	return lr.r.Intn(n)
+}
+
+func (lr *lockedRand) Float64() float64 {
+	lr.mu.Lock()
+	defer lr.mu.Unlock()
+
+	return lr.r.Float64()
+}
+
+// randUser is implemented by balancers which make random choices, so the
+// Client can give them its source of randomness.
+type randUser interface {
+	useRand(rnd *lockedRand)
+}
+
+// randSource is the source of randomness of a balancer. It uses the global
+// source until the balancer is given to a Client, which provides its own.
+type randSource struct {
+	// rnd holds the *lockedRand of the Client, if any
+	rnd atomic.Value
+}
+
+func (s *randSource) useRand(rnd *lockedRand) {
+	s.rnd.Store(rnd)
+}
+
+func (s *randSource) intn(n int) int {
+	if rnd, ok := s.rnd.Load().(*lockedRand); ok {
+		return rnd.Intn(n)
+	}
+	return rand.Intn(n)
+}
+
+func (s *randSource) float() float64 {
+	if rnd, ok := s.rnd.Load().(*lockedRand); ok {
+		return rnd.Float64()
+	}
+	return rand.Float64()
+}
+
+// pick one of ips at random.
+func (s *randSource) pick(ips []string) string {
+	return ips[s.intn(len(ips))]
+}
+
+// RoundRobin cycles through each host's IPs in order. Counters are tracked per
+// host and reset whenever the number of IPs for that host changes. The zero
+// value is ready to use.
+type RoundRobin struct {
+	// hosts maps a host to its *rrCounter
+	hosts sync.Map
+}
+
+type rrCounter struct {
+	// next must be first in the struct to guarantee 64-bit alignment for
+	// atomic operations on 32-bit platforms
+	next uint64
+	size int64
+}
+
+func (r *RoundRobin) Pick(host string, ips []string) string {
+	v, ok := r.hosts.Load(host)
+	if !ok {
+		v, _ = r.hosts.LoadOrStore(host, &rrCounter{})
+	}
+	ctr := v.(*rrCounter)
+
+	// If the IP set changed size, start again from the beginning rather
+	// than skipping around the new set
+	size := int64(len(ips))
+	if old := atomic.LoadInt64(&ctr.size); old != size {
+		if atomic.CompareAndSwapInt64(&ctr.size, old, size) {
+			atomic.StoreUint64(&ctr.next, 0)
+		}
+	}
+	n := atomic.AddUint64(&ctr.next, 1) - 1
+	return ips[n%uint64(len(ips))]
+}
+
+// P2C implements "power of two choices" load balancing. Each pick samples two
+// random IPs and selects the one with fewer requests in flight, which avoids
+// piling requests onto a single slow backend. In-flight requests are only
+// counted when sent through the Client. The zero value is ready to use.
+type P2C struct {
+	randSource
+
+	// inflight maps a hostIP to its *int64 count of requests in flight
+	inflight sync.Map
+}
+
+func (p *P2C) Pick(host string, ips []string) string {
+	if len(ips) == 1 {
+		return ips[0]
+	}
+	i := p.intn(len(ips))
+	j := p.intn(len(ips) - 1)
+	if j >= i {
+		j++
+	}
+	if p.load(host, ips[j]) < p.load(host, ips[i]) {
+		return ips[j]
+	}
+	return ips[i]
+}
+
+func (p *P2C) Dispatched(host, ip string) {
+	atomic.AddInt64(p.counter(host, ip), 1)
+}
+
+func (p *P2C) Completed(host, ip string) {
+	atomic.AddInt64(p.counter(host, ip), -1)
+}
+
+func (p *P2C) load(host, ip string) int64 {
+	v, ok := p.inflight.Load(hostIP{host: host, ip: ip})
+	if !ok {
+		return 0
+	}
+	return atomic.LoadInt64(v.(*int64))
+}
+
+func (p *P2C) counter(host, ip string) *int64 {
+	key := hostIP{host: host, ip: ip}
+	v, ok := p.inflight.Load(key)
+	if !ok {
+		v, _ = p.inflight.LoadOrStore(key, new(int64))
+	}
+	return v.(*int64)
+}
+
+// LeastRequest selects the IP with the fewest requests in flight relative to
+// its weight, breaking ties randomly. Unlike P2C it compares every IP. If
+// HalfLife is set, in-flight counts decay by half each HalfLife, so a backend
+// which hung on a request isn't avoided long after the fact. Requests are only
+// counted when sent through the Client. The zero value is ready to use.
+type LeastRequest struct {
+	HalfLife time.Duration
+
+	// Clock used to decay counts. Defaults to the real time.
+	Clock Clock
+
+	randSource
+
+	// loads maps a hostIP to its *decayCounter
+	loads sync.Map
+}
+
+// decayCounter is a count of requests in flight which decays over time.
+type decayCounter struct {
+	mu sync.Mutex
+	n  float64
+	at time.Time
+}
+
+func (l *LeastRequest) Pick(host string, ips []string) string {
+	// Weighted IPs are repeated in proportion to their weight
+	weights := make(map[string]int, len(ips))
+	for _, ip := range ips {
+		weights[ip]++
+	}
+	now := l.now()
+	var (
+		best  string
+		score float64
+		ties  int
+	)
+	for _, ip := range ips {
+		w, ok := weights[ip]
+		if !ok {
+			continue
+		}
+		delete(weights, ip)
+		load := l.load(host, ip, now) / float64(w)
+		switch {
+		case best == "" || load < score:
+			best, score, ties = ip, load, 1
+		case load == score:
+			// Reservoir sample among the tied IPs
+			ties++
+			if l.intn(ties) == 0 {
+				best = ip
+			}
+		}
+	}
+	return best
+}
+
+func (l *LeastRequest) Dispatched(host, ip string) {
+	l.add(host, ip, 1)
+}
+
+func (l *LeastRequest) Completed(host, ip string) {
+	l.add(host, ip, -1)
+}
+
+func (l *LeastRequest) add(host, ip string, delta float64) {
+	key := hostIP{host: host, ip: ip}
+	v, ok := l.loads.Load(key)
+	if !ok {
+		v, _ = l.loads.LoadOrStore(key, &decayCounter{})
+	}
+	ctr := v.(*decayCounter)
+	now := l.now()
+
+	ctr.mu.Lock()
+	defer ctr.mu.Unlock()
+
+	// A request completing after its count decayed mustn't leave a
+	// negative count, which would attract more traffic than an idle IP
+	ctr.n = math.Max(0, l.decay(ctr, now)+delta)
+	ctr.at = now
+}
+
+func (l *LeastRequest) load(host, ip string, now time.Time) float64 {
+	v, ok := l.loads.Load(hostIP{host: host, ip: ip})
+	if !ok {
+		return 0
+	}
+	ctr := v.(*decayCounter)
+
+	ctr.mu.Lock()
+	defer ctr.mu.Unlock()
+
+	return l.decay(ctr, now)
+}
+
+// decay the counter's value to now. The caller must hold ctr.mu.
+func (l *LeastRequest) decay(ctr *decayCounter, now time.Time) float64 {
+	if l.HalfLife <= 0 || ctr.n == 0 {
+		return ctr.n
+	}
+	elapsed := now.Sub(ctr.at)
+	if elapsed <= 0 {
+		return ctr.n
+	}
+	return ctr.n * math.Exp2(-float64(elapsed)/float64(l.HalfLife))
+}
+
+func (l *LeastRequest) now() time.Time {
+	if l.Clock == nil {
+		return time.Now()
+	}
+	return l.Clock.Now()
+}
+
+// AdaptiveLatency selects IPs at random, weighted toward those which have
+// responded fastest. It tracks an exponentially weighted moving average of the
+// latency of each IP, and picks each IP with probability inversely
+// proportional to its average. IPs without a measurement are treated as being
+// as fast as the fastest IP, so new backends are tried right away. Failed
+// requests count as twice the IP's average, so backends which fail fast
+// aren't favored. Latencies are only recorded when requests are sent through
+// the Client. The zero value is ready to use.
+type AdaptiveLatency struct {
+	// Alpha is the weight of each new measurement in the average, between
+	// 0 and 1. Higher values adapt faster but are noisier. Defaults to 0.3.
+	Alpha float64
+
+	// Floor is the share of traffic spread evenly among the IPs regardless
+	// of their latency, between 0 and 1, so that slow backends are still
+	// probed and can earn back traffic once they recover. Defaults to 0.1.
+	Floor float64
+
+	randSource
+
+	// latencies maps a hostIP to its *ewma
+	latencies sync.Map
+}
+
+// ewma is a moving average of latencies in seconds.
+type ewma struct {
+	mu  sync.Mutex
+	avg float64
+}
+
+func (a *AdaptiveLatency) Pick(host string, ips []string) string {
+	// Weighted IPs are repeated in proportion to their weight, so summing
+	// over ips weights each IP accordingly
+	avgs := make([]float64, len(ips))
+	var fastest float64
+	for i, ip := range ips {
+		avgs[i] = a.latency(host, ip)
+		if avgs[i] > 0 && (fastest == 0 || avgs[i] < fastest) {
+			fastest = avgs[i]
+		}
+	}
+	if fastest == 0 {
+		return a.pick(ips)
+	}
+	speeds := make([]float64, len(ips))
+	var total float64
+	for i, avg := range avgs {
+		if avg == 0 {
+			avg = fastest
+		}
+		speeds[i] = 1 / avg
+		total += speeds[i]
+	}
+	floor := a.floor()
+	even := floor / float64(len(ips))
+	r := a.float()
+	for i, speed := range speeds {
+		r -= even + (1-floor)*speed/total
+		if r < 0 {
+			return ips[i]
+		}
+	}
+	return ips[len(ips)-1]
+}
+
+func (a *AdaptiveLatency) RecordLatency(
+	host, ip string,
+	latency time.Duration,
+	err error,
+) {
+	key := hostIP{host: host, ip: ip}
+	v, ok := a.latencies.Load(key)
+	if !ok {
+		v, _ = a.latencies.LoadOrStore(key, &ewma{})
+	}
+	e := v.(*ewma)
+	sample := latency.Seconds()
+
+	e.mu.Lock()
+	defer e.mu.Unlock()
+
+	if err != nil {
+		sample = math.Max(sample, 2*e.avg)
+	}
+	if sample <= 0 {
+		// Keep a measured IP distinct from an unmeasured one
+		sample = float64(time.Microsecond) / float64(time.Second)
+	}
+	if e.avg == 0 {
+		e.avg = sample
+		return
+	}
+	alpha := a.alpha()
+	e.avg = alpha*sample + (1-alpha)*e.avg
+}
+
+// latency of an IP in seconds, or 0 if it hasn't been measured.
+func (a *AdaptiveLatency) latency(host, ip string) float64 {
+	v, ok := a.latencies.Load(hostIP{host: host, ip: ip})
+	if !ok {
+		return 0
+	}
+	e := v.(*ewma)
+
+	e.mu.Lock()
+	defer e.mu.Unlock()
+
+	return e.avg
+}
+
+func (a *AdaptiveLatency) alpha() float64 {
+	if a.Alpha <= 0 || a.Alpha > 1 {
+		return 0.3
+	}
+	return a.Alpha
+}
+
+func (a *AdaptiveLatency) floor() float64 {
+	if a.Floor <= 0 || a.Floor > 1 {
+		return 0.1
+	}
+	return a.Floor
+}
+
+// ZoneAware prefers IPs whose "zone" metadata matches Zone, falling back to
+// all IPs if none match. Next selects among the preferred IPs, and any IPs if
+// no metadata is available. If Next is nil, IPs are selected randomly.
+type ZoneAware struct {
+	Zone string
+	Next Balancer
+
+	randSource
+}
+
+func (z *ZoneAware) Pick(host string, ips []string) string {
+	if z.Next == nil {
+		return z.pick(ips)
+	}
+	return z.Next.Pick(host, ips)
+}
+
+func (z *ZoneAware) PickWithMetadata(
+	host string,
+	ips []string,
+	metadata func(ip string) map[string]string,
+) string {
+	return z.Pick(host, preferZone(ips, z.Zone, metadata))
+}
+
+// preferZone returns the IPs whose "zone" metadata matches zone, or all IPs if
+// none match.
+func preferZone(
+	ips []string,
+	zone string,
+	metadata func(ip string) map[string]string,
+) []string {
+	return filterIPs(ips, func(ip string) bool {
+		return metadata(ip)["zone"] == zone
+	})
+}
+
+// Dispatched passes the request to Next if it's a Tracker.
+func (z *ZoneAware) Dispatched(host, ip string) {
+	if t, ok := z.Next.(Tracker); ok {
+		t.Dispatched(host, ip)
+	}
+}
+
+// Completed passes the request to Next if it's a Tracker.
+func (z *ZoneAware) Completed(host, ip string) {
+	if t, ok := z.Next.(Tracker); ok {
+		t.Completed(host, ip)
+	}
+}
+
+// useRand passes the Client's source of randomness on to Next, too.
+func (z *ZoneAware) useRand(rnd *lockedRand) {
+	z.randSource.useRand(rnd)
+	if ru, ok := z.Next.(randUser); ok {
+		ru.useRand(rnd)
+	}
+}
+
+// ConsistentHash sends requests with the same key to the same IP, e.g. to keep
+// the caches of backends warm, using a hash ring. When a host's IPs change,
+// only the keys of the IPs added or removed move to another IP. Requests are
+// keyed by Key, and those with an empty key or resolved without a request are
+// distributed randomly. The zero value is not ready to use; Key must be set.
+type ConsistentHash struct {
+	Key func(*http.Request) string
+
+	// Replicas is the number of points on the ring for each IP. More
+	// points spread keys more evenly. Defaults to 100.
+	Replicas int
+
+	randSource
+
+	// rings maps a host to the *hashRing of its current IPs
+	rings sync.Map
+}
+
+// hashRing is an immutable ring for one set of IPs.
+type hashRing struct {
+	ips    []string
+	points []uint64
+	owners []string
+}
+
+func (h *ConsistentHash) Pick(host string, ips []string) string {
+	return h.pick(ips)
+}
+
+func (h *ConsistentHash) PickRequest(
+	req *http.Request,
+	host string,
+	ips []string,
+) string {
+	key := h.Key(req)
+	if key == "" {
+		return h.Pick(host, ips)
+	}
+	r := h.ring(host, ips)
+	sum := hashKey(key)
+	i := sort.Search(len(r.points), func(i int) bool {
+		return r.points[i] >= sum
+	})
+	if i == len(r.points) {
+		i = 0
+	}
+	return r.owners[i]
+}
+
+// ring for a host's IPs, rebuilding it if they've changed.
+func (h *ConsistentHash) ring(host string, ips []string) *hashRing {
+	if v, ok := h.rings.Load(host); ok {
+		r := v.(*hashRing)
+		if equalIPs(r.ips, ips) {
+			return r
+		}
+	}
+	replicas := h.Replicas
+	if replicas < 1 {
+		replicas = 100
+	}
+	r := &hashRing{ips: append([]string{}, ips...)}
+	type point struct {
+		sum uint64
+		ip  string
+	}
+	seen := make(map[string]struct{}, len(ips))
+	var points []point
+	for _, ip := range ips {
+		// Weighted IPs are repeated, but each gets the same points
+		if _, ok := seen[ip]; ok {
+			continue
+		}
+		seen[ip] = struct{}{}
+		for i := 0; i < replicas; i++ {
+			points = append(points, point{
+				sum: hashKey(ip + "#" + strconv.Itoa(i)),
+				ip:  ip,
+			})
+		}
+	}
+	sort.Slice(points, func(i, j int) bool {
+		if points[i].sum == points[j].sum {
+			return points[i].ip < points[j].ip
+		}
+		return points[i].sum < points[j].sum
+	})
+	r.points = make([]uint64, len(points))
+	r.owners = make([]string, len(points))
+	for i, p := range points {
+		r.points[i] = p.sum
+		r.owners[i] = p.ip
+	}
+	h.rings.Store(host, r)
+	return r
+}
+
+// hashKey using FNV-1a, mixing the result so that similar strings such as
+// sequential IDs spread evenly around the ring.
+func hashKey(s string) uint64 {
+	h := fnv.New64a()
+	_, _ = h.Write([]byte(s))
+	x := h.Sum64()
+	x ^= x >> 33
+	x *= 0xff51afd7ed558ccd
+	x ^= x >> 33
+	x *= 0xc4ceb9fe1a85ec53
+	x ^= x >> 33
+	return x
+}
@@ -0,0 +1,452 @@
+package lanhttp
+
+import (
+	"errors"
+	"math/rand"
+	"net"
+	"net/http"
+	"reflect"
+	"strconv"
+	"sync"
+	"testing"
+	"time"
+)
+
+func TestRoundRobin(t *testing.T) {
+	t.Parallel()
+
+	c := NewClient(nil).WithBalancer(&RoundRobin{}).WithRoutes(Routes{
+		"a.internal": []string{"1", "2", "3"},
+	})
+	for i, want := range []string{"1", "2", "3", "1", "2"} {
+		if got := c.getIP("a.internal"); got != want {
+			t.Fatalf("%d: expected %s, got %s", i, want, got)
+		}
+	}
+
+	// Changing the size of the IP set should start again from the first
+	// IP
+	c.WithRoutes(Routes{"a.internal": []string{"1", "2"}})
+	for i, want := range []string{"1", "2", "1"} {
+		if got := c.getIP("a.internal"); got != want {
+			t.Fatalf("%d: expected %s, got %s", i, want, got)
+		}
+	}
+}
+
+func TestP2C(t *testing.T) {
+	t.Parallel()
+
+	fc := &fakeClient{}
+	p2c := &P2C{}
+	c := NewClient(fc).WithBalancer(p2c).WithRoutes(Routes{
+		"a.internal": []string{"1", "2"},
+	})
+
+	// Hold a request open to 1, so every following pick prefers 2
+	p2c.Dispatched("a.internal", "1")
+	for i := 0; i < 10; i++ {
+		if got := c.getIP("a.internal"); got != "2" {
+			t.Fatalf("%d: expected 2, got %s", i, got)
+		}
+	}
+
+	// Requests through Do are counted until their body is closed
+	req, err := http.NewRequest("GET", "http://a.internal", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp, err := c.Do(req)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got := p2c.load("a.internal", "2"); got != 1 {
+		t.Fatalf("expected 1 in flight, got %d", got)
+	}
+	resp.Body.Close()
+	resp.Body.Close()
+	if got := p2c.load("a.internal", "2"); got != 0 {
+		t.Fatalf("expected 0 in flight, got %d", got)
+	}
+}
+
+func TestLeastRequest(t *testing.T) {
+	t.Parallel()
+
+	clk := newFakeClock()
+	lr := &LeastRequest{HalfLife: time.Minute, Clock: clk}
+	fc := &fakeClient{}
+	c := NewClient(fc).WithBalancer(lr).WithRoutes(Routes{
+		"a.internal": []string{"1", "2"},
+	})
+
+	// Hold two requests open to 1 and one to 2, so picks prefer 2
+	lr.Dispatched("a.internal", "1")
+	lr.Dispatched("a.internal", "1")
+	lr.Dispatched("a.internal", "2")
+	for i := 0; i < 10; i++ {
+		if got := c.getIP("a.internal"); got != "2" {
+			t.Fatalf("%d: expected 2, got %s", i, got)
+		}
+	}
+
+	// Weights are respected, so 1 with twice the weight and twice the
+	// requests ties with 2
+	lr.Completed("a.internal", "2")
+	lr.Dispatched("a.internal", "2")
+	seen := map[string]bool{}
+	for i := 0; i < 100; i++ {
+		seen[lr.Pick("a.internal", []string{"1", "1", "2"})] = true
+	}
+	if !seen["1"] || !seen["2"] {
+		t.Fatalf("expected ties to pick both, got %v", seen)
+	}
+
+	// Counts decay by half each half-life
+	clk.now = clk.now.Add(2 * time.Minute)
+	if got := lr.load("a.internal", "1", clk.Now()); got != 0.5 {
+		t.Fatalf("expected 0.5 in flight, got %f", got)
+	}
+
+	// Completing a decayed request doesn't go negative
+	lr.Completed("a.internal", "1")
+	lr.Completed("a.internal", "1")
+	if got := lr.load("a.internal", "1", clk.Now()); got != 0 {
+		t.Fatalf("expected 0 in flight, got %f", got)
+	}
+
+	// Requests through Do are counted until their body is closed
+	req, err := http.NewRequest("GET", "http://a.internal", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp, err := c.Do(req)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got := lr.load("a.internal", "1", clk.Now()); got != 1 {
+		t.Fatalf("expected 1 in flight, got %f", got)
+	}
+	resp.Body.Close()
+	if got := lr.load("a.internal", "1", clk.Now()); got != 0 {
+		t.Fatalf("expected 0 in flight, got %f", got)
+	}
+}
+
+// globalLeast picks the IP with the fewest requests in flight across every
+// host, recording the hosts it was given routes for.
+type globalLeast struct {
+	mu       sync.Mutex
+	inflight map[string]int
+	hosts    int
+}
+
+func (g *globalLeast) Pick(host string, ips []string) string {
+	return g.PickGlobal(host, ips, nil)
+}
+
+func (g *globalLeast) PickGlobal(_ string, ips []string, routes Routes) string {
+	g.mu.Lock()
+	defer g.mu.Unlock()
+
+	g.hosts = len(routes)
+	best := ips[0]
+	for _, ip := range ips[1:] {
+		if g.inflight[ip] < g.inflight[best] {
+			best = ip
+		}
+	}
+	return best
+}
+
+func (g *globalLeast) Dispatched(_, ip string) {
+	g.mu.Lock()
+	defer g.mu.Unlock()
+	g.inflight[ip]++
+}
+
+func (g *globalLeast) Completed(_, ip string) {
+	g.mu.Lock()
+	defer g.mu.Unlock()
+	g.inflight[ip]--
+}
+
+func TestGlobalBalancer(t *testing.T) {
+	t.Parallel()
+
+	b := &globalLeast{inflight: map[string]int{}}
+	c := NewClient(clientFunc(
+		func(req *http.Request) (*http.Response, error) {
+			resp, err := routesClient{}.Do(req)
+			resp.Request = req
+			return resp, err
+		})).
+		WithBalancer(b).
+		WithRoutes(Routes{
+			"a.internal": []string{"10.0.0.1", "10.0.0.2"},
+			"b.internal": []string{"10.0.0.1", "10.0.0.2"},
+		})
+	do := func(host string) *http.Response {
+		t.Helper()
+		req, err := http.NewRequest("GET", "http://"+host, nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+		resp, err := c.Do(req)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return resp
+	}
+
+	// A request in flight to one host steers the other host away from
+	// its IP
+	held := do("a.internal")
+	resp := do("b.internal")
+	resp.Body.Close()
+	if got := resp.Request.URL.Host; got != "10.0.0.2" {
+		t.Fatalf("expected 10.0.0.2, got %s", got)
+	}
+	if b.hosts != 2 {
+		t.Fatalf("expected routes of 2 hosts, got %d", b.hosts)
+	}
+	held.Body.Close()
+	resp = do("b.internal")
+	resp.Body.Close()
+	if got := resp.Request.URL.Host; got != "10.0.0.1" {
+		t.Fatalf("expected 10.0.0.1, got %s", got)
+	}
+}
+
+func TestAdaptiveLatency(t *testing.T) {
+	t.Parallel()
+
+	// Each round trip advances the clock by the latency of its IP
+	latencies := map[string]time.Duration{
+		"10.0.0.1": 100 * time.Millisecond,
+		"10.0.0.2": 10 * time.Millisecond,
+	}
+	clk := newFakeClock()
+	al := &AdaptiveLatency{}
+	c := NewClient(clientFunc(
+		func(req *http.Request) (*http.Response, error) {
+			clk.now = clk.now.Add(latencies[req.URL.Host])
+			return routesClient{}.Do(req)
+		})).
+		WithClock(clk).
+		WithBalancer(al).
+		WithRoutes(Routes{
+			"a.internal": []string{"10.0.0.1", "10.0.0.2"},
+		})
+	for i := 0; i < 1000; i++ {
+		req, err := http.NewRequest("GET", "http://a.internal", nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+		resp, err := c.Do(req)
+		if err != nil {
+			t.Fatal(err)
+		}
+		resp.Body.Close()
+	}
+	for ip, want := range latencies {
+		got := time.Duration(al.latency("a.internal", ip) *
+			float64(time.Second)).Round(time.Millisecond)
+		if got != want {
+			t.Fatalf("%s: expected latency %s, got %s", ip, want, got)
+		}
+	}
+
+	// The slow IP gets about 13%, less than an even split but more than
+	// its floor of 5%
+	counts := map[string]int{}
+	for i := 0; i < 1000; i++ {
+		counts[al.Pick("a.internal", []string{"10.0.0.1", "10.0.0.2"})]++
+	}
+	if n := counts["10.0.0.1"]; n < 50 || n > 250 {
+		t.Fatalf("expected slow IP picked 50-250 times, got %d", n)
+	}
+
+	// Failures count against an IP, and unmeasured IPs are tried as if
+	// they're as fast as the fastest, now 10.0.0.1
+	for i := 0; i < 20; i++ {
+		al.RecordLatency("a.internal", "10.0.0.2", 0, errors.New("failed"))
+	}
+	counts = map[string]int{}
+	for i := 0; i < 1000; i++ {
+		counts[al.Pick("a.internal", []string{"10.0.0.1", "10.0.0.2",
+			"10.0.0.3"})]++
+	}
+	if counts["10.0.0.2"] >= counts["10.0.0.1"] {
+		t.Fatalf("expected failing IP picked least, got %v", counts)
+	}
+	if n := counts["10.0.0.3"]; n < 350 {
+		t.Fatalf("expected new IP picked like 10.0.0.1, got %v", counts)
+	}
+}
+
+func TestZoneAware(t *testing.T) {
+	t.Parallel()
+
+	c := NewClient(nil).WithBalancer(&ZoneAware{
+		Zone: "a",
+		Next: &RoundRobin{},
+	})
+	c.changeRoutes(map[string][]Backend{
+		"a.internal": {
+			{IP: "1", Metadata: map[string]string{"zone": "a"}},
+			{IP: "2", Metadata: map[string]string{"zone": "b"}},
+			{IP: "3", Metadata: map[string]string{"zone": "a"}},
+		},
+		"b.internal": {
+			{IP: "4", Metadata: map[string]string{"zone": "b"}},
+			{IP: "5"},
+		},
+	})
+	for i, want := range []string{"1", "3", "1"} {
+		if got := c.getIP("a.internal"); got != want {
+			t.Fatalf("%d: expected %s, got %s", i, want, got)
+		}
+	}
+
+	// Without any local backends, every IP is used
+	for i, want := range []string{"4", "5", "4"} {
+		if got := c.getIP("b.internal"); got != want {
+			t.Fatalf("%d: expected %s, got %s", i, want, got)
+		}
+	}
+
+	md := c.Metadata("a.internal", "2")
+	if md["zone"] != "b" {
+		t.Fatalf("unexpected metadata: %v", md)
+	}
+	md["zone"] = "c"
+	if got := c.Metadata("a.internal", "2")["zone"]; got != "b" {
+		t.Fatalf("metadata was mutated: %s", got)
+	}
+	if got := c.Metadata("b.internal", "5"); got != nil {
+		t.Fatalf("expected no metadata, got %v", got)
+	}
+}
+
+func TestLocalZone(t *testing.T) {
+	t.Parallel()
+
+	c := NewClient(nil).
+		WithBalancer(&RoundRobin{}).
+		WithPassiveHealth(1, time.Minute).
+		WithLocalZone("a")
+	c.changeRoutes(map[string][]Backend{"a.internal": {
+		{IP: "1", Metadata: map[string]string{"zone": "a"}},
+		{IP: "2", Metadata: map[string]string{"zone": "b"}},
+		{IP: "3", Metadata: map[string]string{"zone": "c"}},
+	}})
+	for i := 0; i < 3; i++ {
+		if got := c.getIP("a.internal"); got != "1" {
+			t.Fatalf("%d: expected 1, got %s", i, got)
+		}
+	}
+
+	// Ejecting the only local backend spills over to the other zones
+	dialErr := &net.OpError{Op: "dial", Err: errors.New("refused")}
+	c.observe("a.internal", "1", nil, dialErr)
+	for i, want := range []string{"2", "3", "2"} {
+		if got := c.getIP("a.internal"); got != want {
+			t.Fatalf("%d: expected %s, got %s", i, want, got)
+		}
+	}
+}
+
+func TestBalancerRand(t *testing.T) {
+	t.Parallel()
+
+	balancers := map[string]func() Balancer{
+		"p2c":          func() Balancer { return &P2C{} },
+		"leastRequest": func() Balancer { return &LeastRequest{} },
+		"adaptive":     func() Balancer { return &AdaptiveLatency{} },
+		"zoneAware":    func() Balancer { return &ZoneAware{Next: &P2C{}} },
+		"consistentHash": func() Balancer {
+			return &ConsistentHash{
+				Key: func(*http.Request) string { return "" },
+			}
+		},
+	}
+	routes := Routes{"a.internal": []string{"1", "2", "3", "4", "5"}}
+	picks := func(c *Client) []string {
+		var ips []string
+		for i := 0; i < 20; i++ {
+			ips = append(ips, c.getIP("a.internal"))
+		}
+		return ips
+	}
+	for name, newBalancer := range balancers {
+		// The source is used whether it's given before or after the
+		// balancer
+		a := NewClient(nil).
+			WithRand(rand.New(rand.NewSource(1))).
+			WithBalancer(newBalancer()).
+			WithRoutes(routes)
+		b := NewClient(nil).
+			WithBalancer(newBalancer()).
+			WithRand(rand.New(rand.NewSource(1))).
+			WithRoutes(routes)
+		if got, want := picks(b), picks(a); !reflect.DeepEqual(got, want) {
+			t.Fatalf("%s: expected %v, got %v", name, want, got)
+		}
+	}
+}
+
+func TestConsistentHash(t *testing.T) {
+	t.Parallel()
+
+	ch := &ConsistentHash{Key: func(req *http.Request) string {
+		return req.Header.Get("X-Key")
+	}}
+	req := func(key string) *http.Request {
+		req, err := http.NewRequest("GET", "http://a.internal", nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+		req.Header.Set("X-Key", key)
+		return req
+	}
+	const keys = 1000
+	before := make([]string, keys)
+	counts := map[string]int{}
+	ips := []string{"1", "2", "3", "4"}
+	for i := range before {
+		before[i] = ch.PickRequest(req(strconv.Itoa(i)), "a.internal", ips)
+		counts[before[i]]++
+	}
+	for _, ip := range ips {
+		if counts[ip] < keys/10 {
+			t.Fatalf("uneven distribution: %v", counts)
+		}
+	}
+
+	// Removing an IP only moves the keys which it held
+	for i, prev := range before {
+		got := ch.PickRequest(req(strconv.Itoa(i)), "a.internal",
+			ips[:3])
+		if prev != "4" && got != prev {
+			t.Fatalf("key %d moved from %s to %s", i, prev, got)
+		}
+	}
+
+	// The client picks by request when sending through Do
+	fc := &fakeClient{}
+	c := NewClient(fc).WithBalancer(ch).WithRoutes(Routes{
+		"a.internal": ips,
+	})
+	for i := 0; i < 3; i++ {
+		resp, err := c.Do(req("7"))
+		if err != nil {
+			t.Fatal(err)
+		}
+		resp.Body.Close()
+		if fc.hosts[i] != before[7] {
+			t.Fatalf("%d: expected %s, got %s", i, before[7],
+				fc.hosts[i])
+		}
+	}
+}
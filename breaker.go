@@ -0,0 +1,171 @@
+package lanhttp
+
+import (
+	"fmt"
+	"sync"
+	"time"
+)
+
+// BreakerState is the state of a host's circuit breaker.
+type BreakerState int
+
+const (
+	// BreakerClosed lets requests through. This is the default.
+	BreakerClosed BreakerState = iota
+
+	// BreakerOpen fails requests immediately until the cooldown passes.
+	BreakerOpen
+
+	// BreakerHalfOpen lets a single trial request through, closing the
+	// breaker if it succeeds and opening it again otherwise.
+	BreakerHalfOpen
+)
+
+func (s BreakerState) String() string {
+	switch s {
+	case BreakerClosed:
+		return "closed"
+	case BreakerOpen:
+		return "open"
+	case BreakerHalfOpen:
+		return "half-open"
+	default:
+		return fmt.Sprintf("BreakerState(%d)", int(s))
+	}
+}
+
+// BreakerOpenError is returned by Do when the circuit breaker of an internal
+// host is open.
+type BreakerOpenError struct {
+	Host string
+}
+
+func (e *BreakerOpenError) Error() string {
+	return fmt.Sprintf("circuit breaker open for host: %s", e.Host)
+}
+
+// circuitBreaker tracks the consecutive failures of requests to each host.
+type circuitBreaker struct {
+	maxFailures int
+	cooldown    time.Duration
+
+	// mu protects hosts from concurrent access
+	mu    sync.Mutex
+	hosts map[string]*hostBreaker
+}
+
+type hostBreaker struct {
+	failures int
+
+	// openUntil is when an open breaker becomes half-open, or zero if
+	// the breaker is closed
+	openUntil time.Time
+
+	// trial is set while the trial request of a half-open breaker is in
+	// flight
+	trial bool
+}
+
+// WithCircuitBreaker fails requests made through Do to an internal host
+// immediately with a *BreakerOpenError once maxFailures consecutive requests
+// to it have failed, whichever of its IPs they were sent to. A request fails
+// if it returns an error or a 5xx status after any retries. After cooldown the
+// breaker is half-open, letting through a single trial request which closes
+// the breaker if it succeeds and reopens it for another cooldown otherwise.
+// Unlike passive health, which ejects single IPs, this stops sending any
+// requests to a host which is down entirely.
+func (c *Client) WithCircuitBreaker(
+	maxFailures int,
+	cooldown time.Duration,
+) *Client {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	c.breaker = newCircuitBreaker(maxFailures, cooldown)
+	return c
+}
+
+func newCircuitBreaker(
+	maxFailures int,
+	cooldown time.Duration,
+) *circuitBreaker {
+	if maxFailures < 1 {
+		maxFailures = 1
+	}
+	return &circuitBreaker{
+		maxFailures: maxFailures,
+		cooldown:    cooldown,
+		hosts:       map[string]*hostBreaker{},
+	}
+}
+
+// BreakerState of an internal host's circuit breaker. host may include a port.
+// Hosts are closed if WithCircuitBreaker isn't used.
+func (c *Client) BreakerState(host string) BreakerState {
+	host, _ = splitHostPort(host)
+
+	c.mu.RLock()
+	breaker := c.breaker
+	clk := c.clock
+	c.mu.RUnlock()
+	if breaker == nil {
+		return BreakerClosed
+	}
+	return breaker.state(host, clk.Now())
+}
+
+func (b *circuitBreaker) state(host string, now time.Time) BreakerState {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	hb, ok := b.hosts[host]
+	switch {
+	case !ok || hb.openUntil.IsZero():
+		return BreakerClosed
+	case now.Before(hb.openUntil):
+		return BreakerOpen
+	default:
+		return BreakerHalfOpen
+	}
+}
+
+// allow reports whether a request to host may be sent, claiming the trial of
+// a half-open breaker.
+func (b *circuitBreaker) allow(host string, now time.Time) bool {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	hb, ok := b.hosts[host]
+	if !ok || hb.openUntil.IsZero() {
+		return true
+	}
+	if now.Before(hb.openUntil) || hb.trial {
+		return false
+	}
+	hb.trial = true
+	return true
+}
+
+// record the result of a request to host.
+func (b *circuitBreaker) record(host string, failed bool, now time.Time) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	hb, ok := b.hosts[host]
+	if !failed {
+		// Forget healthy hosts, so the map only holds failing ones
+		if ok {
+			delete(b.hosts, host)
+		}
+		return
+	}
+	if !ok {
+		hb = &hostBreaker{}
+		b.hosts[host] = hb
+	}
+	hb.failures++
+	if hb.trial || hb.failures >= b.maxFailures {
+		hb.openUntil = now.Add(b.cooldown)
+		hb.trial = false
+	}
+}
@@ -0,0 +1,104 @@
+package lanhttp
+
+import (
+	"errors"
+	"net/http"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+func TestCircuitBreaker(t *testing.T) {
+	t.Parallel()
+
+	var fail, calls int32
+	clk := newFakeClock()
+	c := NewClient(clientFunc(
+		func(req *http.Request) (*http.Response, error) {
+			atomic.AddInt32(&calls, 1)
+			if atomic.LoadInt32(&fail) == 1 {
+				return nil, errors.New("failed")
+			}
+			return routesClient{}.Do(req)
+		})).
+		WithClock(clk).
+		WithCircuitBreaker(2, time.Minute).
+		WithRoutes(Routes{"a.internal": []string{"1", "2"}})
+	do := func() error {
+		req, err := http.NewRequest("GET", "http://a.internal", nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+		resp, err := c.Do(req)
+		if err == nil {
+			resp.Body.Close()
+		}
+		return err
+	}
+	state := func(want BreakerState) {
+		t.Helper()
+		if got := c.BreakerState("a.internal:80"); got != want {
+			t.Fatalf("expected %s, got %s", want, got)
+		}
+	}
+
+	// Opens after consecutive failures
+	atomic.StoreInt32(&fail, 1)
+	for i := 0; i < 2; i++ {
+		state(BreakerClosed)
+		if err := do(); err == nil {
+			t.Fatalf("%d: expected error", i)
+		}
+	}
+	state(BreakerOpen)
+	var open *BreakerOpenError
+	if err := do(); !errors.As(err, &open) || open.Host != "a.internal" {
+		t.Fatalf("expected breaker open error, got %v", err)
+	}
+	if got := atomic.LoadInt32(&calls); got != 2 {
+		t.Fatalf("expected 2 calls, got %d", got)
+	}
+
+	// A failed trial reopens it
+	clk.now = clk.now.Add(time.Minute)
+	state(BreakerHalfOpen)
+	if err := do(); errors.As(err, &open) {
+		t.Fatal("expected trial request")
+	}
+	state(BreakerOpen)
+
+	// A successful trial closes it
+	clk.now = clk.now.Add(time.Minute)
+	atomic.StoreInt32(&fail, 0)
+	if err := do(); err != nil {
+		t.Fatal(err)
+	}
+	state(BreakerClosed)
+
+	// External hosts are unaffected
+	if got := c.BreakerState("example.com"); got != BreakerClosed {
+		t.Fatalf("expected closed, got %s", got)
+	}
+}
+
+func TestBreakerHalfOpenSingleTrial(t *testing.T) {
+	t.Parallel()
+
+	b := newCircuitBreaker(1, time.Minute)
+	now := time.Now()
+	b.record("a.internal", true, now)
+	if b.allow("a.internal", now) {
+		t.Fatal("expected open breaker to deny")
+	}
+	now = now.Add(time.Minute)
+	if !b.allow("a.internal", now) {
+		t.Fatal("expected trial to be allowed")
+	}
+	if b.allow("a.internal", now) {
+		t.Fatal("expected a single trial")
+	}
+	b.record("a.internal", false, now)
+	if !b.allow("a.internal", now) {
+		t.Fatal("expected closed breaker to allow")
+	}
+}
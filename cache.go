@@ -0,0 +1,81 @@
+package lanhttp
+
+import (
+	"sync"
+	"time"
+)
+
+// resolveCache memoizes the IP selected for each host.
+type resolveCache struct {
+	ttl time.Duration
+	now func() time.Time
+
+	// entries maps a host to its *cachedIP
+	entries sync.Map
+}
+
+// cachedIP is the IP selected for a host from a table of backends.
+type cachedIP struct {
+	ip      string
+	table   *table
+	expires time.Time
+}
+
+// WithResolveCache makes the client reuse the IP selected for a host for up
+// to ttl, rather than selecting one for every request, which saves the
+// balancer's work when a few hosts receive very many requests. A new IP is
+// selected after ttl or as soon as the routes change. Retries, hedges, route
+// groups and requests with a resolved IP always select an IP as usual, as do
+// requests when a selector or RequestBalancer picks IPs by request.
+//
+// While cached, an IP receives all of its host's requests, so balancers and
+// health checks only take effect once it expires: keep ttl short. Requests
+// reusing a cached IP aren't traced or counted in SelectionCounts or metrics.
+// A ttl of 0 disables the cache.
+func (c *Client) WithResolveCache(ttl time.Duration) *Client {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	if ttl <= 0 {
+		c.cache.Store((*resolveCache)(nil))
+		return c
+	}
+	c.cache.Store(&resolveCache{ttl: ttl, now: c.clock.Now})
+	return c
+}
+
+// resolveCache returns the client's resolve cache, or nil if it has none.
+func (c *Client) resolveCache() *resolveCache {
+	rc, _ := c.cache.Load().(*resolveCache)
+	return rc
+}
+
+// get the IP cached for host, if it was selected from t and hasn't expired.
+func (rc *resolveCache) get(t *table, host string) (string, bool) {
+	v, ok := rc.entries.Load(host)
+	if !ok {
+		return "", false
+	}
+	entry := v.(*cachedIP)
+	if entry.table != t || !rc.now().Before(entry.expires) {
+		return "", false
+	}
+	return entry.ip, true
+}
+
+// set the IP selected for host from t.
+func (rc *resolveCache) set(t *table, host, ip string) {
+	rc.entries.Store(host, &cachedIP{
+		ip:      ip,
+		table:   t,
+		expires: rc.now().Add(rc.ttl),
+	})
+}
+
+// clear every cached IP.
+func (rc *resolveCache) clear() {
+	rc.entries.Range(func(k, _ interface{}) bool {
+		rc.entries.Delete(k)
+		return true
+	})
+}
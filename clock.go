@@ -0,0 +1,31 @@
+package lanhttp
+
+import "time"
+
+// Clock tells the time and waits between route updates and health checks.
+// Replacing it with WithClock lets tests advance time deterministically rather
+// than sleeping.
+type Clock interface {
+	Now() time.Time
+	After(time.Duration) <-chan time.Time
+}
+
+// realClock uses the time package. This is the default.
+type realClock struct{}
+
+func (realClock) Now() time.Time { return time.Now() }
+
+func (realClock) After(d time.Duration) <-chan time.Time {
+	return time.After(d)
+}
+
+// WithClock replaces the clock used to time route updates, health checks and
+// the latency of requests, and to record LastUpdate. It must be set before
+// StartUpdating.
+func (c *Client) WithClock(clk Clock) *Client {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	c.clock = clk
+	return c
+}
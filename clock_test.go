@@ -0,0 +1,399 @@
+package lanhttp
+
+import (
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"log"
+	"net/http"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+// fakeClock reports each wait on timers, which the test completes by sending
+// on the timer's channel.
+type fakeClock struct {
+	now    time.Time
+	timers chan fakeTimer
+}
+
+type fakeTimer struct {
+	d  time.Duration
+	ch chan time.Time
+}
+
+func newFakeClock() *fakeClock {
+	return &fakeClock{
+		now:    time.Date(2020, 1, 1, 0, 0, 0, 0, time.UTC),
+		timers: make(chan fakeTimer, 10),
+	}
+}
+
+func (f *fakeClock) Now() time.Time { return f.now }
+
+func (f *fakeClock) After(d time.Duration) <-chan time.Time {
+	ch := make(chan time.Time, 1)
+	f.timers <- fakeTimer{d: d, ch: ch}
+	return ch
+}
+
+// next timer the updater waits on, failing if it doesn't wait in time.
+func (f *fakeClock) next(t *testing.T) fakeTimer {
+	t.Helper()
+
+	select {
+	case timer := <-f.timers:
+		return timer
+	case <-time.After(time.Second):
+		t.Fatal("updater didn't wait")
+	}
+	return fakeTimer{}
+}
+
+// countingRoutesClient serves a new IP for a.internal on each request, or
+// fails every request if fail is set.
+type countingRoutesClient struct {
+	fail bool
+	n    int
+	mu   sync.Mutex
+}
+
+func (rc *countingRoutesClient) Do(*http.Request) (*http.Response, error) {
+	if rc.fail {
+		return nil, errors.New("failed")
+	}
+	rc.mu.Lock()
+	rc.n++
+	body := fmt.Sprintf(`{"a.internal":["10.0.0.%d"]}`, rc.n)
+	rc.mu.Unlock()
+	return &http.Response{
+		StatusCode: http.StatusOK,
+		Body:       ioutil.NopCloser(strings.NewReader(body)),
+	}, nil
+}
+
+func TestClockUpdates(t *testing.T) {
+	t.Parallel()
+
+	const every = time.Minute
+	clk := newFakeClock()
+	changed := make(chan Routes, 10)
+	c := NewClient(&countingRoutesClient{}).WithClock(clk)
+	c.OnChange(func(_, new Routes) { changed <- new })
+	if err := c.StartUpdating([]string{"http://a"}, every); err != nil {
+		t.Fatal(err)
+	}
+	defer c.StopUpdating()
+	<-changed
+
+	for i := 2; i <= 4; i++ {
+		timer := clk.next(t)
+		if timer.d != every {
+			t.Fatalf("%d: expected wait %s, got %s", i, every, timer.d)
+		}
+		timer.ch <- clk.now
+		routes := <-changed
+		want := fmt.Sprintf("10.0.0.%d", i)
+		if got := routes["a.internal"]; len(got) != 1 || got[0] != want {
+			t.Fatalf("%d: expected %s, got %v", i, want, got)
+		}
+	}
+	if got, _, _ := c.LastUpdate(); !got.Equal(clk.now) {
+		t.Fatalf("expected last update at %s, got %s", clk.now, got)
+	}
+}
+
+func TestClockBackoff(t *testing.T) {
+	t.Parallel()
+
+	const every = time.Minute
+	clk := newFakeClock()
+	c := NewClient(&countingRoutesClient{fail: true}).
+		WithClock(clk).
+		WithBackoff(4 * every)
+	if err := c.StartUpdating([]string{"http://a"}, every); err == nil {
+		t.Fatal("expected error")
+	}
+	defer c.StopUpdating()
+
+	for i, want := range []time.Duration{every, 2 * every, 4 * every,
+		4 * every} {
+		timer := clk.next(t)
+		if timer.d != want {
+			t.Fatalf("%d: expected wait %s, got %s", i, want, timer.d)
+		}
+		timer.ch <- clk.now
+	}
+}
+
+func TestClockRetryAfter(t *testing.T) {
+	t.Parallel()
+
+	const every = time.Minute
+	clk := newFakeClock()
+	headers := []string{
+		"120",
+		clk.now.Add(5 * time.Minute).Format(http.TimeFormat),
+		"999999999",
+		"",
+	}
+	var n int32
+	c := NewClient(clientFunc(
+		func(*http.Request) (*http.Response, error) {
+			i := atomic.AddInt32(&n, 1) - 1
+			header := http.Header{}
+			if int(i) < len(headers) && headers[i] != "" {
+				header.Set("Retry-After", headers[i])
+			}
+			return &http.Response{
+				StatusCode: http.StatusTooManyRequests,
+				Header:     header,
+				Body:       ioutil.NopCloser(strings.NewReader("")),
+			}, nil
+		})).
+		WithClock(clk).
+		WithLogger(log.New(ioutil.Discard, "", 0))
+	if err := c.StartUpdating([]string{"http://a"}, every); err == nil {
+		t.Fatal("expected error")
+	}
+	defer c.StopUpdating()
+
+	// Waits are capped at 10 intervals
+	for i, want := range []time.Duration{2 * time.Minute,
+		5 * time.Minute, 10 * every, every} {
+		timer := clk.next(t)
+		if timer.d != want {
+			t.Fatalf("%d: expected wait %s, got %s", i, want, timer.d)
+		}
+		timer.ch <- clk.now
+	}
+}
+
+func TestConsecutiveFailures(t *testing.T) {
+	t.Parallel()
+
+	var fail int32 = 1
+	clk := newFakeClock()
+	degraded := make(chan int, 10)
+	c := NewClient(clientFunc(
+		func(req *http.Request) (*http.Response, error) {
+			if atomic.LoadInt32(&fail) == 1 {
+				return nil, errors.New("failed")
+			}
+			return routesClient{body: `{}`}.Do(req)
+		})).
+		WithClock(clk).
+		WithLogger(log.New(ioutil.Discard, "", 0)).
+		OnDegraded(3, func(count int) { degraded <- count })
+	if err := c.StartUpdating([]string{"http://a"}, time.Minute); err == nil {
+		t.Fatal("expected error")
+	}
+	defer c.StopUpdating()
+
+	// Each update finishes before the updater waits on the next one
+	for _, want := range []int{1, 2, 3, 4} {
+		timer := clk.next(t)
+		if got := c.ConsecutiveFailures(); got != want {
+			t.Fatalf("expected %d failures, got %d", want, got)
+		}
+		if want < 4 {
+			timer.ch <- clk.now
+		}
+	}
+	if got := len(degraded); got != 1 {
+		t.Fatalf("expected 1 callback, got %d", got)
+	}
+	if got := <-degraded; got != 3 {
+		t.Fatalf("expected callback at 3, got %d", got)
+	}
+
+	// A success resets the count, so the callback fires again once
+	// failures build back up
+	atomic.StoreInt32(&fail, 0)
+	if err := c.RefreshNow(); err != nil {
+		t.Fatal(err)
+	}
+	if got := c.ConsecutiveFailures(); got != 0 {
+		t.Fatalf("expected 0 failures, got %d", got)
+	}
+	atomic.StoreInt32(&fail, 1)
+	for i := 0; i < 3; i++ {
+		_ = c.RefreshNow()
+	}
+	if got := <-degraded; got != 3 {
+		t.Fatalf("expected callback at 3, got %d", got)
+	}
+}
+
+func TestReady(t *testing.T) {
+	t.Parallel()
+
+	var fail int32 = 1
+	clk := newFakeClock()
+	c := NewClient(clientFunc(
+		func(req *http.Request) (*http.Response, error) {
+			if atomic.LoadInt32(&fail) == 1 {
+				return nil, errors.New("failed")
+			}
+			return routesClient{
+				body: `{"a.internal":["10.0.0.1"]}`,
+			}.Do(req)
+		})).
+		WithClock(clk).
+		WithLogger(log.New(ioutil.Discard, "", 0))
+	if c.Ready() {
+		t.Fatal("expected not ready without routes")
+	}
+	if err := c.StartUpdating([]string{"http://a"}, time.Minute); err == nil {
+		t.Fatal("expected error")
+	}
+	defer c.StopUpdating()
+	if c.Ready() {
+		t.Fatal("expected not ready after failed update")
+	}
+
+	// Routes arriving in the background make the client ready
+	atomic.StoreInt32(&fail, 0)
+	clk.next(t).ch <- clk.now
+	clk.next(t)
+	if !c.Ready() {
+		t.Fatal("expected ready")
+	}
+
+	// A table of hosts without IPs isn't ready
+	c = NewClient(nil).WithRoutes(Routes{"a.internal": nil})
+	if c.Ready() {
+		t.Fatal("expected not ready without IPs")
+	}
+}
+
+func TestRefreshNow(t *testing.T) {
+	t.Parallel()
+
+	rc := &countingRoutesClient{}
+	c := NewClient(rc).WithClock(newFakeClock())
+	if err := c.RefreshNow(); err == nil {
+		t.Fatal("expected error when not updating")
+	}
+	if err := c.StartUpdating([]string{"http://a"}, time.Minute); err != nil {
+		t.Fatal(err)
+	}
+	defer c.StopUpdating()
+
+	// Concurrent refreshes are applied in order, so the routes end up
+	// from the last fetch
+	var wg sync.WaitGroup
+	for i := 0; i < 10; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			if err := c.RefreshNow(); err != nil {
+				t.Error(err)
+			}
+		}()
+	}
+	wg.Wait()
+	rc.mu.Lock()
+	want := fmt.Sprintf("10.0.0.%d", rc.n)
+	rc.mu.Unlock()
+	if want != "10.0.0.11" {
+		t.Fatalf("expected 11 fetches, got %s", want)
+	}
+	if got := c.IPs("a.internal"); len(got) != 1 || got[0] != want {
+		t.Fatalf("expected %s, got %v", want, got)
+	}
+}
+
+func TestPauseUpdates(t *testing.T) {
+	t.Parallel()
+
+	const every = time.Minute
+	clk := newFakeClock()
+	rc := &countingRoutesClient{}
+	c := NewClient(rc).WithClock(clk)
+	if err := c.ResumeUpdates(false); err == nil {
+		t.Fatal("expected error when not updating")
+	}
+	if err := c.StartUpdating([]string{"http://a"}, every); err != nil {
+		t.Fatal(err)
+	}
+	defer c.StopUpdating()
+	fetches := func() int {
+		rc.mu.Lock()
+		defer rc.mu.Unlock()
+		return rc.n
+	}
+
+	// Paused ticks keep the routes without fetching
+	c.PauseUpdates()
+	for i := 0; i < 3; i++ {
+		timer := clk.next(t)
+		if timer.d != every {
+			t.Fatalf("%d: expected wait %s, got %s", i, every, timer.d)
+		}
+		timer.ch <- clk.now
+	}
+	clk.next(t)
+	if got := fetches(); got != 1 {
+		t.Fatalf("expected 1 fetch while paused, got %d", got)
+	}
+	if got := c.getIP("a.internal"); got != "10.0.0.1" {
+		t.Fatalf("expected 10.0.0.1, got %s", got)
+	}
+
+	// Resuming refreshes right away if asked
+	if err := c.ResumeUpdates(true); err != nil {
+		t.Fatal(err)
+	}
+	if got := c.getIP("a.internal"); got != "10.0.0.2" {
+		t.Fatalf("expected 10.0.0.2, got %s", got)
+	}
+}
+
+// clientFunc adapts a function to an HTTPClient.
+type clientFunc func(*http.Request) (*http.Response, error)
+
+func (f clientFunc) Do(req *http.Request) (*http.Response, error) {
+	return f(req)
+}
+
+func TestSetUpdateURLs(t *testing.T) {
+	t.Parallel()
+
+	var (
+		mu   sync.Mutex
+		hits []string
+	)
+	rc := routesClient{body: `{"a.internal":["10.0.0.1"]}`}
+	hc := clientFunc(func(req *http.Request) (*http.Response, error) {
+		mu.Lock()
+		hits = append(hits, req.URL.Host)
+		mu.Unlock()
+		return rc.Do(req)
+	})
+	clk := newFakeClock()
+	c := NewClient(hc).WithClock(clk)
+
+	// Setting URLs before updating is a no-op
+	c.SetUpdateURLs([]string{"http://c"})
+	if err := c.StartUpdating([]string{"http://a"}, time.Minute); err != nil {
+		t.Fatal(err)
+	}
+	defer c.StopUpdating()
+
+	c.SetUpdateURLs([]string{"http://b"})
+	clk.next(t).ch <- clk.now
+	clk.next(t)
+
+	mu.Lock()
+	defer mu.Unlock()
+	if len(hits) != 2 || hits[0] != "a" || hits[1] != "b" {
+		t.Fatalf("expected updates from a then b, got %v", hits)
+	}
+	if got := c.getIP("a.internal"); got != "10.0.0.1" {
+		t.Fatalf("expected 10.0.0.1, got %s", got)
+	}
+}
@@ -0,0 +1,125 @@
+package lanhttp
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"strings"
+)
+
+// decodeJSON decodes routes from r one token at a time, so that large route
+// documents are never buffered whole as json.Decoder.Decode would, and IPs
+// given as plain strings, by far the most common form, are read without the
+// overhead of Backend.UnmarshalJSON. hint holds the previous routes, if any,
+// which size the new table so it isn't grown repeatedly while decoding. The
+// result is the same as decoding into a map[string][]Backend, including nil
+// for a null document.
+func decodeJSON(r io.Reader, hint Routes) (map[string][]Backend, error) {
+	dec := json.NewDecoder(r)
+	tok, err := dec.Token()
+	if err != nil {
+		return nil, err
+	}
+	if tok == nil {
+		return nil, nil
+	}
+	if tok != json.Delim('{') {
+		return nil, fmt.Errorf("expected object, got %v", tok)
+	}
+	routes := make(map[string][]Backend, len(hint))
+	for dec.More() {
+		tok, err := dec.Token()
+		if err != nil {
+			return nil, err
+		}
+		host, ok := tok.(string)
+		if !ok {
+			return nil, fmt.Errorf("expected host, got %v", tok)
+		}
+		bs, err := decodeHostBackends(dec, len(hint[host]))
+		if err != nil {
+			return nil, fmt.Errorf("%s: %w", host, err)
+		}
+		routes[host] = bs
+	}
+	if _, err := dec.Token(); err != nil {
+		return nil, err
+	}
+	return routes, nil
+}
+
+// decodeHostBackends decodes the array of backends of a host, or null. size
+// is the expected number of backends.
+func decodeHostBackends(dec *json.Decoder, size int) ([]Backend, error) {
+	tok, err := dec.Token()
+	if err != nil {
+		return nil, err
+	}
+	if tok == nil {
+		return nil, nil
+	}
+	if tok != json.Delim('[') {
+		return nil, fmt.Errorf("expected array, got %v", tok)
+	}
+	bs := make([]Backend, 0, size)
+	for dec.More() {
+		tok, err := dec.Token()
+		if err != nil {
+			return nil, err
+		}
+		switch tok := tok.(type) {
+		case string:
+			bs = append(bs, Backend{IP: tok})
+		case nil:
+			bs = append(bs, Backend{})
+		case json.Delim:
+			if tok != '{' {
+				return nil, fmt.Errorf("expected backend, got %v",
+					tok)
+			}
+			b, err := decodeBackendObject(dec)
+			if err != nil {
+				return nil, err
+			}
+			bs = append(bs, b)
+		default:
+			return nil, fmt.Errorf("expected backend, got %v", tok)
+		}
+	}
+	if _, err := dec.Token(); err != nil {
+		return nil, err
+	}
+	return bs, nil
+}
+
+// decodeBackendObject decodes the fields of a backend object after its
+// opening brace. As with encoding/json, field names are matched without
+// regard to case and unknown fields are ignored.
+func decodeBackendObject(dec *json.Decoder) (Backend, error) {
+	var b Backend
+	for dec.More() {
+		tok, err := dec.Token()
+		if err != nil {
+			return b, err
+		}
+		key, _ := tok.(string)
+		switch {
+		case strings.EqualFold(key, "ip"):
+			err = dec.Decode(&b.IP)
+		case strings.EqualFold(key, "weight"):
+			err = dec.Decode(&b.Weight)
+		case strings.EqualFold(key, "metadata"):
+			err = dec.Decode(&b.Metadata)
+		default:
+			var skip json.RawMessage
+			err = dec.Decode(&skip)
+		}
+		if err != nil {
+			return b, fmt.Errorf("%s: %w", key, err)
+		}
+	}
+	if _, err := dec.Token(); err != nil {
+		return b, err
+	}
+	return b, nil
+}
@@ -0,0 +1,98 @@
+package lanhttp
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+func TestDecodeJSON(t *testing.T) {
+	t.Parallel()
+
+	// Streaming decodes the same as decoding the whole document
+	for _, data := range []string{
+		`{}`,
+		`null`,
+		`{"a.internal":["10.0.0.1","10.0.0.2"],"b.internal":[]}`,
+		`{"a.internal":null,"b.internal":["10.0.0.1",null]}`,
+		`{"a.internal":["10.0.0.1"],"a.internal":["10.0.0.2"]}`,
+		`{"a.internal":[{"IP":"10.0.0.1","Weight":3,"extra":{"x":[1]},
+			"metadata":{"zone":"a"}},"10.0.0.2",{}]} trailing`,
+		`{"a.internal":[{"ip":"10.0.0.1","weight":null}]}`,
+	} {
+		want := map[string][]Backend{}
+		err := json.NewDecoder(strings.NewReader(data)).Decode(&want)
+		if err != nil {
+			t.Fatal(err)
+		}
+		got, err := decodeJSON(strings.NewReader(data), nil)
+		if err != nil {
+			t.Fatalf("%s: %s", data, err)
+		}
+		if !reflect.DeepEqual(got, want) {
+			t.Fatalf("%s: expected %v, got %v", data, want, got)
+		}
+	}
+
+	for _, data := range []string{
+		``,
+		`[]`,
+		`{"a.internal":"10.0.0.1"}`,
+		`{"a.internal":[1]}`,
+		`{"a.internal":[["10.0.0.1"]]}`,
+		`{"a.internal":[{"ip":1}]}`,
+		`{"a.internal":[{"ip":"10.0.0.1","weight":1.5}]}`,
+		`{"a.internal":["10.0.0.1"]`,
+	} {
+		if _, err := decodeJSON(strings.NewReader(data), nil); err == nil {
+			t.Fatalf("%s: expected error", data)
+		}
+	}
+}
+
+// largeRoutes returns a synthetic route document of hosts each having ips.
+func largeRoutes(hosts, ips int) ([]byte, Routes) {
+	routes := make(Routes, hosts)
+	for i := 0; i < hosts; i++ {
+		host := fmt.Sprintf("service-%d.internal", i)
+		for j := 0; j < ips; j++ {
+			routes[host] = append(routes[host],
+				fmt.Sprintf("10.%d.%d.%d", i/256, i%256, j))
+		}
+	}
+	byt, err := json.Marshal(routes)
+	if err != nil {
+		panic(err)
+	}
+	return byt, routes
+}
+
+func BenchmarkDecodeRoutes(b *testing.B) {
+	byt, routes := largeRoutes(10000, 10)
+	b.Run("stream", func(b *testing.B) {
+		b.ReportAllocs()
+		b.SetBytes(int64(len(byt)))
+		for i := 0; i < b.N; i++ {
+			_, err := decodeRoutes(bytes.NewReader(byt), nil, routes)
+			if err != nil {
+				b.Fatal(err)
+			}
+		}
+	})
+
+	// Decoding the whole document at once, for comparison
+	b.Run("whole", func(b *testing.B) {
+		b.ReportAllocs()
+		b.SetBytes(int64(len(byt)))
+		for i := 0; i < b.N; i++ {
+			bs := map[string][]Backend{}
+			dec := json.NewDecoder(bytes.NewReader(byt))
+			if err := dec.Decode(&bs); err != nil {
+				b.Fatal(err)
+			}
+		}
+	})
+}
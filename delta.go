@@ -0,0 +1,108 @@
+package lanhttp
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+)
+
+// delta is a partial route update, sent in place of the full routes when
+// delta updates are enabled.
+type delta struct {
+	// Op is "update" to replace the backends of Routes' hosts, or
+	// "remove" to remove Hosts
+	Op     string               `json:"op"`
+	Routes map[string][]Backend `json:"routes"`
+	Hosts  []string             `json:"hosts"`
+}
+
+// WithDeltaUpdates accepts partial route updates from update URLs, which
+// change the current routes rather than replacing them. A delta is a JSON
+// object with an "op" key, either:
+//
+//	{"op": "update", "routes": {"foo.internal": ["10.0.0.1"]}}
+//
+// which replaces the backends of each listed host, adding any that are new,
+// or:
+//
+//	{"op": "remove", "hosts": ["foo.internal"]}
+//
+// which removes the listed hosts. Any other response is decoded as the full
+// routes as usual, so feeds can still send snapshots to resync. Each delta
+// applies to the routes last received from the same URL, or to the live
+// routes if the URL hasn't sent any yet. Deltas are only accepted in the
+// default JSON format, not from WithDecoder. A delta which leaves the routes
+// unchanged doesn't count as a change.
+func (c *Client) WithDeltaUpdates() *Client {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	c.deltas = true
+	return c
+}
+
+// decodeDelta decodes either a delta, which is applied to a copy of base, or
+// the full routes. Hosts are normalized and duplicate IPs of a host are
+// removed as in decodeRoutes.
+func decodeDelta(
+	r io.Reader,
+	base map[string][]Backend,
+) (map[string][]Backend, error) {
+	byt, err := ioutil.ReadAll(r)
+	if err != nil {
+		return nil, err
+	}
+	var raw map[string]json.RawMessage
+	if err := json.Unmarshal(byt, &raw); err != nil {
+		return nil, err
+	}
+	if raw == nil {
+		// Keep the current routes for a null body, as decodeRoutes does
+		return nil, nil
+	}
+	if _, ok := raw["op"]; !ok {
+		routes := make(map[string][]Backend, len(raw))
+		for host, msg := range raw {
+			var bs []Backend
+			if err := json.Unmarshal(msg, &bs); err != nil {
+				return nil, fmt.Errorf("%s: %w", host, err)
+			}
+			routes[host] = bs
+		}
+		return dedupeBackends(normalizeRoutes(routes)), nil
+	}
+
+	var d delta
+	if err := json.Unmarshal(byt, &d); err != nil {
+		return nil, fmt.Errorf("delta: %w", err)
+	}
+	switch d.Op {
+	case "update":
+		for host, bs := range normalizeRoutes(d.Routes) {
+			base[host] = bs
+		}
+	case "remove":
+		for _, host := range d.Hosts {
+			delete(base, normalizeHost(host))
+		}
+	default:
+		return nil, fmt.Errorf("delta: unknown op %q", d.Op)
+	}
+	return dedupeBackends(base), nil
+}
+
+// deltaBase returns a copy of the routes a delta applies to: cached, the
+// routes last received from its URL, or the live routes if nil.
+func (c *Client) deltaBase(
+	cached map[string][]Backend,
+) map[string][]Backend {
+	if cached == nil {
+		return c.Backends()
+	}
+	base := make(map[string][]Backend, len(cached))
+	for host, bs := range cached {
+		base[host] = append([]Backend{}, bs...)
+	}
+	return base
+}
@@ -0,0 +1,101 @@
+package lanhttp
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"reflect"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+func TestDeltaUpdates(t *testing.T) {
+	t.Parallel()
+
+	bodies := []string{
+		`{"a.internal": ["10.0.0.1"], "b.internal": ["10.0.0.2"]}`,
+		`{"op": "update", "routes": {"A.internal": ["10.0.0.3"]}}`,
+		`{"op": "update", "routes": {"a.internal": ["10.0.0.3"]}}`,
+		`{"op": "remove", "hosts": ["b.internal"]}`,
+		`{"c.internal": ["10.0.0.4"]}`,
+		`null`,
+		`{"op": "rename"}`,
+	}
+	var i int32
+	srv := httptest.NewServer(http.HandlerFunc(
+		func(w http.ResponseWriter, r *http.Request) {
+			n := atomic.AddInt32(&i, 1) - 1
+			_, _ = w.Write([]byte(bodies[n]))
+		}))
+	defer srv.Close()
+
+	var changes int
+	c := DefaultClient(time.Second).WithDeltaUpdates()
+	c.OnChange(func(_, _ Routes) { changes++ })
+	type step struct {
+		want    Routes
+		changes int
+		fail    bool
+	}
+	steps := []step{
+		{
+			want: Routes{
+				"a.internal": {"10.0.0.1"},
+				"b.internal": {"10.0.0.2"},
+			},
+			changes: 1,
+		},
+		{
+			want: Routes{
+				"a.internal": {"10.0.0.3"},
+				"b.internal": {"10.0.0.2"},
+			},
+			changes: 2,
+		},
+		{
+			// A no-op delta isn't a change
+			want: Routes{
+				"a.internal": {"10.0.0.3"},
+				"b.internal": {"10.0.0.2"},
+			},
+			changes: 2,
+		},
+		{
+			want:    Routes{"a.internal": {"10.0.0.3"}},
+			changes: 3,
+		},
+		{
+			// Full routes resync
+			want:    Routes{"c.internal": {"10.0.0.4"}},
+			changes: 4,
+		},
+		{
+			// A null body keeps the current routes
+			want:    Routes{"c.internal": {"10.0.0.4"}},
+			changes: 4,
+		},
+		{
+			want:    Routes{"c.internal": {"10.0.0.4"}},
+			changes: 4,
+			fail:    true,
+		},
+	}
+	for n, s := range steps {
+		routes, _, err := c.firstURL(context.Background(),
+			[]string{srv.URL}, time.Second)
+		if s.fail != (err != nil) {
+			t.Fatalf("%d: unexpected error: %v", n, err)
+		}
+		if routes != nil {
+			c.changeRoutes(routes)
+		}
+		if got := c.Routes(); !reflect.DeepEqual(got, s.want) {
+			t.Fatalf("%d: expected %v, got %v", n, s.want, got)
+		}
+		if changes != s.changes {
+			t.Fatalf("%d: expected %d changes, got %d", n,
+				s.changes, changes)
+		}
+	}
+}
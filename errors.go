@@ -0,0 +1,103 @@
+package lanhttp
+
+import (
+	"errors"
+	"fmt"
+	"time"
+)
+
+var (
+	// ErrNoBackend is matched by errors.Is for errors returned by Do when
+	// it didn't send a request because an internal host had no usable
+	// backend: *ResolveError and *NoRoutesError.
+	ErrNoBackend = errors.New("no backend")
+
+	// ErrHostUnresolved is matched by errors.Is for errors returned by Do
+	// when an internal host couldn't be resolved to a backend, whether or
+	// not a request was sent. This includes every error matching
+	// ErrNoBackend and *UnresolvedError. Errors from requests which were
+	// sent to a backend never match, so these can be told apart from
+	// failures of the backends themselves.
+	ErrHostUnresolved = errors.New("host unresolved")
+)
+
+// ResolveError is returned by Do in strict resolution mode when an internal
+// host has no live backends, or all of them are unhealthy.
+type ResolveError struct {
+	Host string
+}
+
+func (e *ResolveError) Error() string {
+	return fmt.Sprintf("no live backends for host: %s", e.Host)
+}
+
+func (e *ResolveError) Is(target error) bool {
+	return target == ErrNoBackend || target == ErrHostUnresolved
+}
+
+// NoRoutesError is returned by Do in fail closed mode when an internal host
+// has no routes.
+type NoRoutesError struct {
+	Host string
+}
+
+func (e *NoRoutesError) Error() string {
+	return fmt.Sprintf("no routes for host: %s", e.Host)
+}
+
+func (e *NoRoutesError) Is(target error) bool {
+	return target == ErrNoBackend || target == ErrHostUnresolved
+}
+
+// UnresolvedError is returned by Do when an internal host had no live
+// backends, so the request was sent to the hostname itself, and that failed.
+// Err is the error from sending it, usually a failed DNS lookup.
+type UnresolvedError struct {
+	Host string
+	Err  error
+}
+
+func (e *UnresolvedError) Error() string {
+	return fmt.Sprintf("unresolved host %s: %s", e.Host, e.Err)
+}
+
+func (e *UnresolvedError) Unwrap() error { return e.Err }
+
+func (e *UnresolvedError) Is(target error) bool {
+	return target == ErrHostUnresolved
+}
+
+// InvalidURLError is returned by StartUpdating when an update URL is
+// malformed.
+type InvalidURLError struct {
+	URL string
+	Err error
+}
+
+func (e *InvalidURLError) Error() string {
+	return fmt.Sprintf("invalid update url %q: %s", e.URL, e.Err)
+}
+
+func (e *InvalidURLError) Unwrap() error { return e.Err }
+
+// statusError is returned when fetching routes receives an unexpected status.
+type statusError struct {
+	code int
+
+	// retryAfter is how long the server asked us to wait before the next
+	// update, if it did
+	retryAfter time.Duration
+}
+
+func (e *statusError) Error() string {
+	return fmt.Sprintf("bad status code: %d", e.code)
+}
+
+// decodeError is returned when fetched routes can't be decoded.
+type decodeError struct {
+	err error
+}
+
+func (e *decodeError) Error() string { return "decode: " + e.err.Error() }
+
+func (e *decodeError) Unwrap() error { return e.err }
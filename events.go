@@ -0,0 +1,76 @@
+package lanhttp
+
+import "errors"
+
+// Event is one of the typed events passed to an EventHandler: UpdateFailed,
+// BadStatus or DecodeFailed.
+type Event interface {
+	event()
+}
+
+// EventHandler receives structured events from the client in place of its
+// Printf logging, e.g. to record their fields in a logging pipeline. Events
+// may be handled concurrently.
+type EventHandler interface {
+	HandleEvent(Event)
+}
+
+// UpdateFailed is emitted when requesting routes from an update URL fails for
+// any reason other than a bad status or undecodable routes.
+type UpdateFailed struct {
+	URL string
+	Err error
+}
+
+// BadStatus is emitted when an update URL replies with a status other than
+// 200 OK or 304 Not Modified.
+type BadStatus struct {
+	URL  string
+	Code int
+}
+
+// DecodeFailed is emitted when the routes from an update URL can't be
+// decoded.
+type DecodeFailed struct {
+	URL string
+	Err error
+}
+
+func (UpdateFailed) event() {}
+func (BadStatus) event()    {}
+func (DecodeFailed) event() {}
+
+// WithEventHandler sends events about failed route updates to h rather than
+// logging them. By default they're logged with the client's Logger.
+func (c *Client) WithEventHandler(h EventHandler) *Client {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	c.events = h
+	return c
+}
+
+// updateFailed reports a failed update from uri to the event handler, or logs
+// it if there's none.
+func (c *Client) updateFailed(uri string, err error) {
+	c.mu.RLock()
+	h := c.events
+	c.mu.RUnlock()
+	if h == nil {
+		c.log.Printf("%s: %s", uri, err)
+		return
+	}
+
+	var (
+		statusErr *statusError
+		decodeErr *decodeError
+	)
+	switch {
+	case errors.As(err, &statusErr):
+		h.HandleEvent(BadStatus{URL: uri, Code: statusErr.code})
+	case errors.As(err, &decodeErr):
+		h.HandleEvent(DecodeFailed{URL: uri, Err: decodeErr.err})
+	default:
+		h.HandleEvent(UpdateFailed{URL: uri, Err: err})
+	}
+}
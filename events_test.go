@@ -0,0 +1,62 @@
+package lanhttp
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"sync"
+	"testing"
+	"time"
+)
+
+type eventRecorder struct {
+	events []Event
+	mu     sync.Mutex
+}
+
+func (r *eventRecorder) HandleEvent(e Event) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	r.events = append(r.events, e)
+}
+
+func TestEventHandler(t *testing.T) {
+	t.Parallel()
+
+	srv := httptest.NewServer(http.HandlerFunc(
+		func(w http.ResponseWriter, r *http.Request) {
+			if r.URL.Path == "/status" {
+				w.WriteHeader(http.StatusBadGateway)
+				return
+			}
+			_, _ = w.Write([]byte("{"))
+		}))
+	defer srv.Close()
+
+	rec := &eventRecorder{}
+	c := DefaultClient(time.Second).WithEventHandler(rec)
+	for _, uri := range []string{srv.URL + "/status", srv.URL, "://bad"} {
+		_, _, err := c.firstURL(context.Background(), []string{uri},
+			time.Second)
+		if err == nil {
+			t.Fatalf("%s: expected error", uri)
+		}
+	}
+
+	rec.mu.Lock()
+	defer rec.mu.Unlock()
+	if len(rec.events) != 3 {
+		t.Fatalf("expected 3 events, got %v", rec.events)
+	}
+	status, ok := rec.events[0].(BadStatus)
+	if !ok || status.Code != http.StatusBadGateway {
+		t.Fatalf("expected bad status, got %#v", rec.events[0])
+	}
+	if e, ok := rec.events[1].(DecodeFailed); !ok || e.URL != srv.URL {
+		t.Fatalf("expected decode failure, got %#v", rec.events[1])
+	}
+	if e, ok := rec.events[2].(UpdateFailed); !ok || e.Err == nil {
+		t.Fatalf("expected update failure, got %#v", rec.events[2])
+	}
+}
@@ -0,0 +1,74 @@
+package lanhttp
+
+import (
+	"context"
+	"fmt"
+	"os"
+	"time"
+)
+
+// LoadRoutesFile replaces the routes with those in a JSON file, in the same
+// format served to StartUpdating. This is useful for local development
+// without a discovery service.
+func (c *Client) LoadRoutesFile(path string) error {
+	f, err := os.Open(path)
+	if err != nil {
+		return fmt.Errorf("open: %w", err)
+	}
+	defer f.Close()
+
+	routes, err := decodeRoutes(f, nil, c.live().routes)
+	if err != nil {
+		return fmt.Errorf("decode %s: %w", path, err)
+	}
+	c.dropInvalid(path, routes)
+	c.filterHosts(routes)
+	c.changeRoutesFrom(path, routes)
+	return nil
+}
+
+// WatchRoutesFile loads routes from a file as LoadRoutesFile does, then checks
+// the file every interval and reloads it whenever it's modified, until ctx is
+// canceled. An error is only returned if the initial load fails. Failed
+// reloads are logged and the existing routes are kept.
+func (c *Client) WatchRoutesFile(
+	ctx context.Context,
+	path string,
+	every time.Duration,
+) error {
+	info, err := os.Stat(path)
+	if err != nil {
+		return fmt.Errorf("stat: %w", err)
+	}
+	if err = c.LoadRoutesFile(path); err != nil {
+		return err
+	}
+
+	c.mu.RLock()
+	clk := c.clock
+	c.mu.RUnlock()
+	go func() {
+		for {
+			select {
+			case <-clk.After(every):
+			case <-ctx.Done():
+				return
+			}
+			next, err := os.Stat(path)
+			if err != nil {
+				c.log.Printf("%s: stat: %s", path, err)
+				continue
+			}
+			if next.ModTime().Equal(info.ModTime()) &&
+				next.Size() == info.Size() {
+				continue
+			}
+			if err = c.LoadRoutesFile(path); err != nil {
+				c.log.Printf("%s: %s", path, err)
+				continue
+			}
+			info = next
+		}
+	}()
+	return nil
+}
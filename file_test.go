@@ -0,0 +1,57 @@
+package lanhttp
+
+import (
+	"context"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"reflect"
+	"testing"
+	"time"
+)
+
+func TestWatchRoutesFile(t *testing.T) {
+	t.Parallel()
+
+	dir, err := ioutil.TempDir("", "lanhttp")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	path := filepath.Join(dir, "routes.json")
+	err = ioutil.WriteFile(path, []byte(`{"a.internal":["10.0.0.1"]}`), 0600)
+	if err != nil {
+		t.Fatal(err)
+	}
+	clk := newFakeClock()
+	changed := make(chan Routes, 1)
+	c := NewClient(nil).WithClock(clk)
+	c.OnChange(func(_, new Routes) { changed <- new })
+	if err = c.LoadRoutesFile(filepath.Join(dir, "missing.json")); err == nil {
+		t.Fatal("expected error")
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	if err = c.WatchRoutesFile(ctx, path, time.Second); err != nil {
+		t.Fatal(err)
+	}
+	<-changed
+
+	err = ioutil.WriteFile(path,
+		[]byte(`{"a.internal":["10.0.0.1","10.0.0.2"]}`), 0600)
+	if err != nil {
+		t.Fatal(err)
+	}
+	clk.next(t).ch <- clk.now
+	want := Routes{"a.internal": []string{"10.0.0.1", "10.0.0.2"}}
+	select {
+	case got := <-changed:
+		if !reflect.DeepEqual(got, want) {
+			t.Fatalf("expected %v, got %v", want, got)
+		}
+	case <-time.After(time.Second):
+		t.Fatal("routes weren't reloaded")
+	}
+}
@@ -1,5 +1,5 @@
 module egt.run/lanhttp
 
-go 1.13
+go 1.14
 
 require github.com/hashicorp/go-cleanhttp v0.5.1
@@ -0,0 +1,90 @@
+package lanhttp
+
+import (
+	"context"
+	"net/url"
+	"time"
+)
+
+// routeGroup is a named set of routes, updated independently of the default
+// routes.
+type routeGroup struct {
+	urls     []string
+	backends *table
+}
+
+// WithRouteGroup adds a named group of routes updated from its own URLs
+// alongside the default routes whenever the client is updating. Use
+// ResolveHostGroup to resolve hosts against the group. Callbacks such as
+// OnChange only fire for the default routes.
+func (c *Client) WithRouteGroup(name string, urls []string) *Client {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	if c.groups == nil {
+		c.groups = map[string]*routeGroup{}
+	}
+	c.groups[name] = &routeGroup{
+		urls:     append([]string{}, urls...),
+		backends: newTable(Routes{}, nil),
+	}
+	return c
+}
+
+// ResolveHostGroup is like ResolveHost but selects IPs from the named route
+// group. An empty name selects the default routes. URLs are returned
+// unmodified if the group doesn't exist.
+func (c *Client) ResolveHostGroup(uri *url.URL, group string) *url.URL {
+	uri, _, _ = c.resolve(context.Background(), nil, group, uri, nil)
+	return uri
+}
+
+// table of backends for the named route group, or the default routes if name
+// is empty. nil is returned if the group doesn't exist. The caller must hold
+// the read lock.
+func (c *Client) table(name string) *table {
+	if name == "" {
+		return c.live()
+	}
+	g, ok := c.groups[name]
+	if !ok {
+		return nil
+	}
+	return g.backends
+}
+
+// updateGroups fetches the routes of every route group.
+func (c *Client) updateGroups(ctx context.Context, timeout time.Duration) {
+	c.mu.RLock()
+	groups := make(map[string][]string, len(c.groups))
+	for name, g := range c.groups {
+		groups[name] = g.urls
+	}
+	c.mu.RUnlock()
+
+	for name, urls := range groups {
+		// Failures are logged within race, and the existing routes
+		// are kept
+		routes, _, _ := c.race(ctx, urls, timeout)
+		if ctx.Err() != nil {
+			return
+		}
+		if routes == nil {
+			continue
+		}
+		c.changeGroupRoutes(name, routes)
+	}
+}
+
+// changeGroupRoutes replaces the routes of a route group.
+func (c *Client) changeGroupRoutes(name string, new map[string][]Backend) {
+	routes, attrs := splitBackends(new)
+	t := newTable(routes, attrs)
+
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	if g, ok := c.groups[name]; ok {
+		g.backends = t
+	}
+}
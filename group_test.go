@@ -0,0 +1,43 @@
+package lanhttp
+
+import (
+	"net/http"
+	"net/url"
+	"testing"
+	"time"
+)
+
+// groupClient serves different routes depending on the requested host.
+type groupClient map[string]string
+
+func (gc groupClient) Do(req *http.Request) (*http.Response, error) {
+	return routesClient{body: gc[req.URL.Host]}.Do(req)
+}
+
+func TestRouteGroups(t *testing.T) {
+	t.Parallel()
+
+	c := NewClient(groupClient{
+		"prod":   `{"a.internal":["10.0.0.1"]}`,
+		"canary": `{"a.internal":["10.0.0.2"]}`,
+	}).WithRouteGroup("canary", []string{"http://canary"})
+	defer c.StopUpdating()
+	err := c.StartUpdating([]string{"http://prod"}, time.Minute)
+	if err != nil {
+		t.Fatal(err)
+	}
+	tcs := map[string]string{
+		"":        "10.0.0.1",
+		"canary":  "10.0.0.2",
+		"missing": "a.internal",
+	}
+	for group, want := range tcs {
+		uri, err := url.Parse("http://a.internal")
+		if err != nil {
+			t.Fatal(err)
+		}
+		if got := c.ResolveHostGroup(uri, group).Host; got != want {
+			t.Fatalf("%q: expected %s, got %s", group, want, got)
+		}
+	}
+}
@@ -0,0 +1,57 @@
+//go:build go1.24
+// +build go1.24
+
+package lanhttp
+
+import (
+	"net"
+	"net/http"
+	"time"
+
+	"github.com/hashicorp/go-cleanhttp"
+)
+
+// H2CClient is like DefaultClient, but sends requests resolved to internal
+// backends over plain http using HTTP/2 with prior knowledge (h2c), so many
+// requests to a backend are multiplexed over a single connection. Backends
+// must accept h2c, e.g. an http.Server with UnencryptedHTTP2 in its
+// Protocols. Unresolved requests, including those to public hosts, and
+// internal https requests are sent as by DefaultClient.
+//
+// Connections to each IP are pooled, so pair this with a balancer which keeps
+// sending a host's requests to the same IPs, like ConsistentHash, for the most
+// reuse.
+func H2CClient(timeout time.Duration) *Client {
+	resolver := &net.Resolver{PreferGo: true}
+	h1 := cleanhttp.DefaultTransport()
+	configureTransport(h1, resolver)
+	h2c := cleanhttp.DefaultPooledTransport()
+	configureTransport(h2c, resolver)
+	h2c.Protocols = new(http.Protocols)
+	h2c.Protocols.SetUnencryptedHTTP2(true)
+	return NewClient(&http.Client{
+		Transport: &h2cTransport{h1: h1, h2c: h2c},
+		Timeout:   timeout,
+	})
+}
+
+// h2cTransport sends resolved http requests using h2c and every other request
+// using HTTP/1.
+type h2cTransport struct {
+	h1  *http.Transport
+	h2c *http.Transport
+}
+
+func (t *h2cTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+	_, resolved := req.Context().Value(serverNameKey{}).(string)
+	if resolved && req.URL.Scheme == "http" {
+		return t.h2c.RoundTrip(req)
+	}
+	return t.h1.RoundTrip(req)
+}
+
+// CloseIdleConnections of both transports, as called by Client.Close.
+func (t *h2cTransport) CloseIdleConnections() {
+	t.h1.CloseIdleConnections()
+	t.h2c.CloseIdleConnections()
+}
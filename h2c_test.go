@@ -0,0 +1,57 @@
+//go:build go1.24
+// +build go1.24
+
+package lanhttp
+
+import (
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestH2CClient(t *testing.T) {
+	t.Parallel()
+
+	srv := httptest.NewUnstartedServer(http.HandlerFunc(
+		func(w http.ResponseWriter, r *http.Request) {
+			_, _ = w.Write([]byte(r.Proto))
+		}))
+	srv.Config.Protocols = new(http.Protocols)
+	srv.Config.Protocols.SetHTTP1(true)
+	srv.Config.Protocols.SetUnencryptedHTTP2(true)
+	srv.Start()
+	defer srv.Close()
+
+	c := H2CClient(time.Second).WithRoutes(Routes{
+		"a.internal": []string{strings.TrimPrefix(srv.URL, "http://")},
+	})
+	defer c.Close()
+	get := func(uri string) string {
+		t.Helper()
+		req, err := http.NewRequest("GET", uri, nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+		resp, err := c.Do(req)
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer resp.Body.Close()
+		byt, err := ioutil.ReadAll(resp.Body)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return string(byt)
+	}
+	if got := get("http://a.internal/"); got != "HTTP/2.0" {
+		t.Fatalf("expected HTTP/2.0 to internal host, got %s", got)
+	}
+
+	// Requests which aren't resolved are sent normally
+	if got := get(srv.URL); got != "HTTP/1.1" {
+		t.Fatalf("expected HTTP/1.1 to public host, got %s", got)
+	}
+}
@@ -0,0 +1,306 @@
+package lanhttp
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"strings"
+	"sync"
+	"time"
+)
+
+// passiveHealth tracks failures of requests to individual backends and
+// temporarily ejects backends which fail too often.
+type passiveHealth struct {
+	maxFailures int
+	cooldown    time.Duration
+
+	// serverErrors counts 5xx responses as failures in addition to dial
+	// errors
+	serverErrors bool
+
+	// now is replaceable for testing
+	now func() time.Time
+
+	// mu protects ips from concurrent access
+	mu  sync.Mutex
+	ips map[hostIP]*ipHealth
+}
+
+type hostIP struct{ host, ip string }
+
+type ipHealth struct {
+	failures     int
+	ejectedUntil time.Time
+}
+
+// WithPassiveHealth ejects a backend IP from rotation after maxFailures
+// consecutive failed requests made through Do, restoring it after cooldown.
+// By default only dial errors count as failures. Ejections are reset whenever
+// the routes change.
+func (c *Client) WithPassiveHealth(
+	maxFailures int,
+	cooldown time.Duration,
+) *Client {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	c.health = &passiveHealth{
+		maxFailures: maxFailures,
+		cooldown:    cooldown,
+		now:         time.Now,
+		ips:         map[hostIP]*ipHealth{},
+	}
+	return c
+}
+
+// WithPassiveHealthServerErrors additionally counts 5xx responses as failures
+// for passive health tracking. It has no effect unless WithPassiveHealth is
+// also used.
+func (c *Client) WithPassiveHealthServerErrors() *Client {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	if c.health != nil {
+		c.health.serverErrors = true
+	}
+	return c
+}
+
+// observe the result of a request sent to a backend.
+func (h *passiveHealth) observe(
+	host, ip string,
+	resp *http.Response,
+	err error,
+) {
+	failed := isDialError(err) ||
+		(h.serverErrors && resp != nil && resp.StatusCode >= 500)
+
+	h.mu.Lock()
+	defer h.mu.Unlock()
+
+	key := hostIP{host: host, ip: ip}
+	if !failed {
+		delete(h.ips, key)
+		return
+	}
+	state, ok := h.ips[key]
+	if !ok {
+		state = &ipHealth{}
+		h.ips[key] = state
+	}
+	state.failures++
+	if state.failures >= h.maxFailures {
+		state.failures = 0
+		state.ejectedUntil = h.now().Add(h.cooldown)
+	}
+}
+
+// filter out ejected IPs.
+func (h *passiveHealth) filter(host string, ips []string) []string {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+
+	if len(h.ips) == 0 {
+		return ips
+	}
+	now := h.now()
+	return filterIPs(ips, func(ip string) bool {
+		state, ok := h.ips[hostIP{host: host, ip: ip}]
+		return !ok || !now.Before(state.ejectedUntil)
+	})
+}
+
+// healthy reports whether ip isn't currently ejected.
+func (h *passiveHealth) healthy(host, ip string) bool {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+
+	state, ok := h.ips[hostIP{host: host, ip: ip}]
+	return !ok || !h.now().Before(state.ejectedUntil)
+}
+
+// reset all failures and ejections, such as when the routes change.
+func (h *passiveHealth) reset() {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+
+	h.ips = map[hostIP]*ipHealth{}
+}
+
+func isDialError(err error) bool {
+	var opErr *net.OpError
+	return errors.As(err, &opErr) && opErr.Op == "dial"
+}
+
+// activeHealth periodically probes every backend and tracks which are
+// unhealthy.
+type activeHealth struct {
+	path     string
+	interval time.Duration
+
+	// mu protects unhealthy from concurrent access
+	mu        sync.RWMutex
+	unhealthy map[hostIP]struct{}
+}
+
+// WithHealthCheck actively probes every backend IP by issuing a GET to
+// "http://<ip><path>" each interval, skipping backends which fail to respond
+// with a 2xx or 3xx status code. To probe a port other than the default,
+// include it at the start of the path, e.g. ":8080/health", which also
+// replaces the port of backends listed with their own. Health checks run
+// while the client is updating, i.e. between StartUpdating and StopUpdating.
+func (c *Client) WithHealthCheck(path string, interval time.Duration) *Client {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	c.checks = &activeHealth{
+		path:      path,
+		interval:  interval,
+		unhealthy: map[hostIP]struct{}{},
+	}
+	return c
+}
+
+// runHealthChecks until the context is canceled, if health checks are
+// configured.
+func (c *Client) runHealthChecks(ctx context.Context) {
+	c.mu.RLock()
+	h := c.checks
+	clk := c.clock
+	c.mu.RUnlock()
+	if h == nil {
+		return
+	}
+	for {
+		c.checkHealth(ctx, h)
+		select {
+		case <-clk.After(h.interval):
+		case <-ctx.Done():
+			return
+		}
+	}
+}
+
+// checkHealth of every backend in the current routes. The set of unhealthy
+// backends is replaced wholesale, so backends removed from the routes are
+// forgotten and newly added backends are considered healthy until probed.
+func (c *Client) checkHealth(ctx context.Context, h *activeHealth) {
+	probeCtx, cancel := context.WithTimeout(ctx, h.interval)
+	defer cancel()
+
+	var (
+		wg        sync.WaitGroup
+		mu        sync.Mutex
+		unhealthy = map[hostIP]struct{}{}
+	)
+	for host, ips := range c.Routes() {
+		for _, ip := range ips {
+			wg.Add(1)
+			go func(host, ip string) {
+				defer wg.Done()
+				err := c.probe(probeCtx, h.path, host, ip)
+				if err != nil {
+					c.log.Printf("%s: health check %s: %s",
+						host, ip, err)
+					mu.Lock()
+					unhealthy[hostIP{host: host, ip: ip}] = struct{}{}
+					mu.Unlock()
+				}
+			}(host, ip)
+		}
+	}
+	wg.Wait()
+
+	// Don't mark everything unhealthy because we were asked to stop
+	// partway through
+	if ctx.Err() != nil {
+		return
+	}
+
+	h.mu.Lock()
+	defer h.mu.Unlock()
+
+	h.unhealthy = unhealthy
+}
+
+func (c *Client) probe(ctx context.Context, path, host, ip string) error {
+	addr := joinHostPort(ip, "")
+	if strings.HasPrefix(path, ":") {
+		// A port in the path replaces the backend's own
+		if bare, _, err := net.SplitHostPort(addr); err == nil {
+			addr = joinHostPort(bare, "")
+		}
+	}
+	uri := "http://" + addr + path
+	req, err := http.NewRequestWithContext(ctx, "GET", uri, nil)
+	if err != nil {
+		return fmt.Errorf("new request: %w", err)
+	}
+	req.Host = host
+	resp, err := c.Transport().Do(req)
+	if err != nil {
+		return fmt.Errorf("do: %w", err)
+	}
+	defer resp.Body.Close()
+
+	// Drain the body so the connection can be reused
+	_, _ = io.Copy(ioutil.Discard, resp.Body)
+	if resp.StatusCode < 200 || resp.StatusCode >= 400 {
+		return fmt.Errorf("bad status code: %d", resp.StatusCode)
+	}
+	return nil
+}
+
+// filter out unhealthy IPs.
+func (h *activeHealth) filter(host string, ips []string) []string {
+	h.mu.RLock()
+	defer h.mu.RUnlock()
+
+	if len(h.unhealthy) == 0 {
+		return ips
+	}
+	return filterIPs(ips, func(ip string) bool {
+		_, bad := h.unhealthy[hostIP{host: host, ip: ip}]
+		return !bad
+	})
+}
+
+// healthy reports whether ip passed its last check.
+func (h *activeHealth) healthy(host, ip string) bool {
+	h.mu.RLock()
+	defer h.mu.RUnlock()
+
+	_, bad := h.unhealthy[hostIP{host: host, ip: ip}]
+	return !bad
+}
+
+// filterIPs returns the IPs for which keep returns true. If none remain, all
+// IPs are returned, since sending traffic to a possibly-unhealthy backend
+// beats sending it nowhere. ips is returned as-is without allocating when
+// every IP is kept.
+func filterIPs(ips []string, keep func(string) bool) []string {
+	var kept []string
+	for i, ip := range ips {
+		if keep(ip) {
+			if kept != nil {
+				kept = append(kept, ip)
+			}
+			continue
+		}
+
+		// Only allocate once we find the first IP to drop
+		if kept == nil {
+			kept = make([]string, i, len(ips))
+			copy(kept, ips[:i])
+		}
+	}
+	if len(kept) == 0 {
+		return ips
+	}
+	return kept
+}
@@ -0,0 +1,143 @@
+package lanhttp
+
+import (
+	"context"
+	"errors"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"reflect"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+func TestPassiveHealth(t *testing.T) {
+	t.Parallel()
+
+	now := time.Date(2020, 1, 1, 0, 0, 0, 0, time.UTC)
+	c := NewClient(nil).
+		WithBalancer(&RoundRobin{}).
+		WithPassiveHealth(2, time.Minute).
+		WithRoutes(Routes{"a.internal": []string{"1", "2"}})
+	c.health.now = func() time.Time { return now }
+
+	dialErr := &net.OpError{Op: "dial", Err: errors.New("refused")}
+	c.observe("a.internal", "1", nil, dialErr)
+	if got := c.health.filter("a.internal", []string{"1", "2"}); len(got) != 2 {
+		t.Fatal("ejected before reaching max failures")
+	}
+	c.observe("a.internal", "1", nil, dialErr)
+	for i := 0; i < 3; i++ {
+		if got := c.getIP("a.internal"); got != "2" {
+			t.Fatalf("%d: expected 2, got %s", i, got)
+		}
+	}
+
+	// If all IPs are ejected, fall back to the full set
+	c.observe("a.internal", "2", nil, dialErr)
+	c.observe("a.internal", "2", nil, dialErr)
+	if got := c.health.filter("a.internal", []string{"1", "2"}); len(got) != 2 {
+		t.Fatal("expected fallback to all IPs")
+	}
+
+	// After the cooldown, IPs are restored
+	c.observe("a.internal", "2", nil, nil)
+	now = now.Add(time.Minute)
+	if got := c.health.filter("a.internal", []string{"1", "2"}); len(got) != 2 {
+		t.Fatal("expected IP to be restored after cooldown")
+	}
+
+	// Changing routes resets ejections
+	c.observe("a.internal", "1", nil, dialErr)
+	c.observe("a.internal", "1", nil, dialErr)
+	c.WithRoutes(Routes{"a.internal": []string{"1", "2"}})
+	if got := c.health.filter("a.internal", []string{"1", "2"}); len(got) != 2 {
+		t.Fatal("expected ejections to reset")
+	}
+}
+
+func TestActiveHealth(t *testing.T) {
+	t.Parallel()
+
+	handler := func(status int) http.HandlerFunc {
+		return func(w http.ResponseWriter, r *http.Request) {
+			if r.URL.Path != "/health" {
+				w.WriteHeader(http.StatusNotFound)
+				return
+			}
+			w.WriteHeader(status)
+		}
+	}
+	good := httptest.NewServer(handler(http.StatusOK))
+	defer good.Close()
+	bad := httptest.NewServer(handler(http.StatusInternalServerError))
+	defer bad.Close()
+
+	goodIP := strings.TrimPrefix(good.URL, "http://")
+	badIP := strings.TrimPrefix(bad.URL, "http://")
+	c := DefaultClient(time.Second).
+		WithHealthCheck("/health", time.Second).
+		WithRoutes(Routes{"a.internal": []string{goodIP, badIP}})
+	c.checkHealth(context.Background(), c.checks)
+	for i := 0; i < 10; i++ {
+		if got := c.getIP("a.internal"); got != goodIP {
+			t.Fatalf("%d: expected %s, got %s", i, goodIP, got)
+		}
+	}
+
+	// Backends removed from the routes are forgotten on the next check
+	c.WithRoutes(Routes{"a.internal": []string{goodIP}})
+	c.checkHealth(context.Background(), c.checks)
+	if n := len(c.checks.unhealthy); n != 0 {
+		t.Fatalf("expected no unhealthy backends, got %d", n)
+	}
+}
+
+func TestHealthCheckPorts(t *testing.T) {
+	t.Parallel()
+
+	var (
+		mu   sync.Mutex
+		uris = map[string]bool{}
+	)
+	check := func(path string, ips ...string) map[string]bool {
+		t.Helper()
+		mu.Lock()
+		uris = map[string]bool{}
+		mu.Unlock()
+		c := NewClient(clientFunc(
+			func(req *http.Request) (*http.Response, error) {
+				mu.Lock()
+				uris[req.URL.String()] = true
+				mu.Unlock()
+				return routesClient{}.Do(req)
+			})).
+			WithHealthCheck(path, time.Second).
+			WithRoutes(Routes{"a.internal": ips})
+		c.checkHealth(context.Background(), c.checks)
+		mu.Lock()
+		defer mu.Unlock()
+		return uris
+	}
+
+	// Backends keep their own port unless the path gives one
+	got := check("/health", "10.0.0.1:9000", "10.0.0.2")
+	want := map[string]bool{
+		"http://10.0.0.1:9000/health": true,
+		"http://10.0.0.2/health":      true,
+	}
+	if !reflect.DeepEqual(got, want) {
+		t.Fatalf("expected %v, got %v", want, got)
+	}
+	got = check(":8080/health", "10.0.0.1:9000", "[::1]:9000", "10.0.0.2")
+	want = map[string]bool{
+		"http://10.0.0.1:8080/health": true,
+		"http://[::1]:8080/health":    true,
+		"http://10.0.0.2:8080/health": true,
+	}
+	if !reflect.DeepEqual(got, want) {
+		t.Fatalf("expected %v, got %v", want, got)
+	}
+}
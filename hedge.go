@@ -0,0 +1,133 @@
+package lanhttp
+
+import (
+	"context"
+	"net/http"
+	"net/url"
+	"time"
+)
+
+// WithHedging makes Do send a second copy of an idempotent request to a
+// different IP of the same internal host if the first hasn't responded within
+// delay, returning whichever response arrives first and canceling the other.
+// This trades a little extra load for lower tail latency on reads. Requests
+// with a body are only hedged if it can be rewound via GetBody, and no hedge is
+// sent if the host has no other usable IP. A delay of 0 disables hedging.
+func (c *Client) WithHedging(delay time.Duration) *Client {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	c.hedge = delay
+	return c
+}
+
+// hedgeResult is the outcome of one of the requests sent by sendHedged.
+type hedgeResult struct {
+	resp *http.Response
+	err  error
+	ip   string
+}
+
+// sendHedged sends req to ip and, if it hasn't responded after delay, sends a
+// copy to another IP of host. The first successful response wins and the other
+// request is canceled, with its response body closed if it arrives anyway, so
+// trackers see each request complete exactly once. If every request fails, the
+// last error is returned. The IP which was sent the returned request is also
+// returned.
+func (c *Client) sendHedged(
+	req *http.Request,
+	orig url.URL,
+	host, ip string,
+	exclude []string,
+	delay time.Duration,
+) (*http.Response, string, error) {
+	c.mu.RLock()
+	clk := c.clock
+	c.mu.RUnlock()
+
+	results := make(chan hedgeResult, 2)
+	cancels := map[string]context.CancelFunc{}
+	launch := func(r *http.Request, ip string) {
+		ctx, cancel := context.WithCancel(r.Context())
+		r = r.WithContext(ctx)
+		cancels[ip] = cancel
+		go func() {
+			resp, err := c.send(r, host, ip, c.Transport().Do)
+			results <- hedgeResult{resp: resp, err: err, ip: ip}
+		}()
+	}
+	launch(req, ip)
+	pending := 1
+	timer := clk.After(delay)
+	var last hedgeResult
+	for pending > 0 {
+		select {
+		case <-timer:
+			timer = nil
+			hedge, hedgeIP := c.hedgeRequest(req, orig, host, ip,
+				exclude)
+			if hedge != nil {
+				launch(hedge, hedgeIP)
+				pending++
+			}
+		case res := <-results:
+			pending--
+			if res.err != nil {
+				cancels[res.ip]()
+				last = res
+				continue
+			}
+			for otherIP, cancel := range cancels {
+				if otherIP != res.ip {
+					cancel()
+				}
+			}
+			go closeLosers(results, pending)
+
+			// Keep the winner's context alive until its body is
+			// read
+			res.resp.Body = &trackedBody{
+				ReadCloser: res.resp.Body,
+				done:       cancels[res.ip],
+			}
+			return res.resp, res.ip, nil
+		}
+	}
+	return last.resp, last.ip, last.err
+}
+
+// hedgeRequest copies req to send to an IP of host other than ip, or returns
+// nil if there's no other IP or the body can't be copied.
+func (c *Client) hedgeRequest(
+	req *http.Request,
+	orig url.URL,
+	host, ip string,
+	exclude []string,
+) (*http.Request, string) {
+	uri := orig
+	exclude = append(append([]string{}, exclude...), ip)
+	u, _, hedgeIP := c.resolve(req.Context(), req, "", &uri, exclude)
+	if hedgeIP == "" || hedgeIP == ip {
+		return nil, ""
+	}
+	hedge := req.Clone(req.Context())
+	hedge.URL = u
+	if req.GetBody != nil {
+		body, err := req.GetBody()
+		if err != nil {
+			return nil, ""
+		}
+		hedge.Body = body
+	}
+	return hedge, hedgeIP
+}
+
+// closeLosers waits for the n requests still in flight after a hedged request
+// was won and closes their responses.
+func closeLosers(results <-chan hedgeResult, n int) {
+	for i := 0; i < n; i++ {
+		if res := <-results; res.resp != nil {
+			res.resp.Body.Close()
+		}
+	}
+}
@@ -0,0 +1,124 @@
+package lanhttp
+
+import (
+	"context"
+	"io/ioutil"
+	"net/http"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+// firstTracker picks the first IP and counts requests in flight.
+type firstTracker struct {
+	mu       sync.Mutex
+	inflight map[string]int
+}
+
+func (f *firstTracker) Pick(_ string, ips []string) string { return ips[0] }
+
+func (f *firstTracker) Dispatched(_, ip string) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	f.inflight[ip]++
+}
+
+func (f *firstTracker) Completed(_, ip string) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	f.inflight[ip]--
+}
+
+func TestWithHedging(t *testing.T) {
+	t.Parallel()
+
+	var (
+		mu      sync.Mutex
+		hits    = map[string]int{}
+		slow    = make(chan error, 2)
+		tracker = &firstTracker{inflight: map[string]int{}}
+	)
+	c := NewClient(clientFunc(
+		func(req *http.Request) (*http.Response, error) {
+			mu.Lock()
+			hits[req.URL.Host]++
+			mu.Unlock()
+			if req.URL.Host == "10.0.0.1" {
+				<-req.Context().Done()
+				slow <- req.Context().Err()
+				return nil, req.Context().Err()
+			}
+			return &http.Response{
+				StatusCode: http.StatusOK,
+				Body: ioutil.NopCloser(
+					strings.NewReader(req.URL.Host)),
+			}, nil
+		})).
+		WithBalancer(tracker).
+		WithHedging(10 * time.Millisecond).
+		WithRoutes(Routes{
+			"a.internal": []string{"10.0.0.1", "10.0.0.2"},
+		})
+
+	req, err := http.NewRequest("GET", "http://a.internal/x", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp, err := c.Do(req)
+	if err != nil {
+		t.Fatal(err)
+	}
+	byt, err := ioutil.ReadAll(resp.Body)
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp.Body.Close()
+	if string(byt) != "10.0.0.2" {
+		t.Fatalf("expected hedge to 10.0.0.2, got %s", byt)
+	}
+	select {
+	case err := <-slow:
+		if err != context.Canceled {
+			t.Fatalf("expected slow request canceled, got %v", err)
+		}
+	case <-time.After(time.Second):
+		t.Fatal("slow request wasn't canceled")
+	}
+
+	// Each request completes once, including the canceled one
+	deadline := time.Now().Add(time.Second)
+	for {
+		tracker.mu.Lock()
+		first := tracker.inflight["10.0.0.1"]
+		second := tracker.inflight["10.0.0.2"]
+		tracker.mu.Unlock()
+		if first == 0 && second == 0 {
+			break
+		}
+		if time.Now().After(deadline) {
+			t.Fatalf("expected nothing in flight, got %d and %d",
+				first, second)
+		}
+		time.Sleep(time.Millisecond)
+	}
+
+	// Requests which aren't idempotent are never hedged
+	ctx, cancel := context.WithTimeout(context.Background(),
+		50*time.Millisecond)
+	defer cancel()
+	req, err = http.NewRequestWithContext(ctx, "POST",
+		"http://a.internal/x", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err = c.Do(req); err == nil {
+		t.Fatal("expected post to time out on the slow IP")
+	}
+	mu.Lock()
+	defer mu.Unlock()
+	if hits["10.0.0.2"] != 1 {
+		t.Fatalf("expected post not hedged, got %d hedges",
+			hits["10.0.0.2"]-1)
+	}
+}
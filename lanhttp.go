@@ -1,16 +1,24 @@
 package lanhttp
 
 import (
+	"compress/gzip"
 	"context"
 	"encoding/json"
+	"errors"
 	"fmt"
+	"io"
+	"io/ioutil"
+	"math"
 	"math/rand"
 	"net"
 	"net/http"
 	"net/url"
+	"reflect"
 	"sort"
+	"strconv"
 	"strings"
 	"sync"
+	"sync/atomic"
 	"time"
 
 	"github.com/hashicorp/go-cleanhttp"
@@ -19,15 +27,243 @@ import (
 type Client struct {
 	client HTTPClient
 	log    *logger
-	stop   chan struct{}
 
-	// backends that are currently live
-	backends Routes
+	// updater that is currently running, if any
+	updater *updater
 
-	// mu protects backends from concurrent access
+	// updaterMu protects updater from concurrent access
+	updaterMu sync.Mutex
+
+	// pins of IPs selected by ResolveHostSticky
+	pins map[pinKey]*pin
+
+	// pinMu protects pins from concurrent access
+	pinMu sync.Mutex
+
+	// selections maps a hostIP to its *uint64 count of selections since
+	// the last reset
+	selections sync.Map
+
+	// etags of the last routes received from each update URL
+	etags map[string]etagEntry
+
+	// etagMu protects etags from concurrent access
+	etagMu sync.Mutex
+
+	// lastUpdate is when routes were last fetched successfully, and
+	// lastURL is the URL which provided them
+	lastUpdate time.Time
+	lastURL    string
+
+	// lastErr is the error from the most recent update, if it failed
+	lastErr error
+
+	// failures counts the updates which have failed since the last
+	// success
+	failures int
+
+	// onDegraded is called once failures reaches degradedAt, if set
+	onDegraded func(count int)
+	degradedAt int
+
+	// statusMu protects every field from lastUpdate to here from
+	// concurrent access. It's kept apart from mu so that recording each
+	// update doesn't block requests selecting IPs
+	statusMu sync.Mutex
+
+	// store holds the live backends, shared with any clones
+	store *routeStore
+
+	// groups of named routes, each updated from their own URLs
+	groups map[string]*routeGroup
+
+	// balancer selects an IP from a host's backends
+	balancer Balancer
+
+	// rnd is the source of randomness for the default balancer and for
+	// jitter
+	rnd *lockedRand
+
+	// health tracks failing backends when passive health is enabled
+	health *passiveHealth
+
+	// checks probes backends when active health checks are enabled
+	checks *activeHealth
+
+	// retry failed requests when configured
+	retry *retry
+
+	// suffixes of hosts which are resolved to internal IPs
+	suffixes []string
+
+	// onChange is called after the routes change, if set
+	onChange func(old, new Routes)
+
+	// onRemoved is called for each backend removed when the routes
+	// change, if set
+	onRemoved func(host, ip string)
+
+	// metrics about updates and resolution are reported here
+	metrics Collector
+
+	// maxBackoff between updates when every update URL fails. Zero
+	// disables backoff.
+	maxBackoff time.Duration
+
+	// jitter is the fraction of the update interval by which each wait
+	// between updates is randomized
+	jitter float64
+
+	// unixSockets allows routes to Unix domain sockets
+	unixSockets bool
+
+	// publicFallback makes Do resend requests to the unresolved URL when
+	// every internal backend it tried couldn't be dialed
+	publicFallback bool
+
+	// strict makes Do fail rather than send requests for internal hosts
+	// without any live backends
+	strict bool
+
+	// failClosed makes Do fail rather than send requests for internal
+	// hosts with no routes at all
+	failClosed bool
+
+	// schemes to use for resolved URLs, keyed by host
+	schemes map[string]string
+
+	// ports to use for resolved URLs, keyed by host
+	ports map[string]string
+
+	// aliases maps hosts to the host whose routes they resolve with
+	aliases map[string]string
+
+	// resolver looks up internal hosts missing from the routes, if set
+	resolver *net.Resolver
+
+	// updateHeader is added to every request for routes
+	updateHeader http.Header
+
+	// updateRequest modifies every request for routes, if set
+	updateRequest func(*http.Request)
+
+	// decoder parses routes from update responses. If nil, routes are
+	// decoded from JSON.
+	decoder func(io.Reader) (Routes, error)
+
+	// clock times route updates and health checks
+	clock Clock
+
+	// events receives failed route updates in place of the logger, if set
+	events EventHandler
+
+	// selector picks IPs for requests sent through Do and RoundTripper
+	// in place of the balancer, if set
+	selector func(*http.Request, []string) string
+
+	// breaker fails requests to hosts which keep failing, if set
+	breaker *circuitBreaker
+
+	// warmups limits the warmup requests in flight when warming up
+	// connections to new backends, if set
+	warmups chan struct{}
+
+	// verbose logs each change to the routes
+	verbose bool
+
+	// hostFilter reports whether to keep the routes of a host, if set
+	hostFilter func(host string) bool
+
+	// cache holds the *resolveCache of IPs selected for hosts, if
+	// enabled. It's read without holding mu.
+	cache atomic.Value
+
+	// hostAuth holds the Authorization header of requests to each host,
+	// if set
+	hostAuth map[string]string
+
+	// hedge is how long Do waits on an idempotent request before sending
+	// another to a different IP, or 0 to never hedge
+	hedge time.Duration
+
+	// tracer starts a span around each request sent by Do, if set
+	tracer Tracer
+
+	// trace is called with every resolution of an internal host, if set
+	trace func(host, ip string, candidates []string)
+
+	// zone is the local zone whose backends are preferred, if set
+	zone string
+
+	// family is the preferred address family of backends, "ipv4" or
+	// "ipv6", or empty if either is fine
+	family string
+
+	// backupURLs are requested for routes only when every update URL
+	// fails
+	backupURLs []string
+
+	// fetchTimeout bounds each update, or the update interval if zero
+	fetchTimeout time.Duration
+
+	// fetchConcurrency limits the update requests in flight at once, if
+	// greater than zero
+	fetchConcurrency int
+
+	// acceptStatus holds status codes from update URLs which keep the
+	// current routes rather than failing
+	acceptStatus map[int]bool
+
+	// deltas accepts partial route updates from update URLs
+	deltas bool
+
+	// merge unions the routes from every update URL rather than using
+	// whichever replies first
+	merge bool
+
+	// mu protects every field from groups to here from concurrent access
 	mu sync.RWMutex
 }
 
+// updater is a running background routes updater.
+type updater struct {
+	ctx    context.Context
+	cancel context.CancelFunc
+
+	// timeout of each update
+	timeout time.Duration
+
+	// updateMu serializes updates, so that RefreshNow and the updater
+	// don't apply their routes out of order
+	updateMu sync.Mutex
+
+	// done is closed once every goroutine of the updater has exited
+	done chan struct{}
+
+	// urls to request routes from on each update
+	urls []string
+
+	// paused skips scheduled updates
+	paused bool
+
+	// mu protects urls and paused from concurrent access
+	mu sync.Mutex
+}
+
+func (u *updater) isPaused() bool {
+	u.mu.Lock()
+	defer u.mu.Unlock()
+
+	return u.paused
+}
+
+func (u *updater) getURLs() []string {
+	u.mu.Lock()
+	defer u.mu.Unlock()
+
+	return u.urls
+}
+
 type HTTPClient interface {
 	Do(*http.Request) (*http.Response, error)
 }
@@ -36,6 +272,10 @@ type HTTPClient interface {
 // provide some more control.
 type Logger interface{ Printf(string, ...interface{}) }
 
+// Routes maps internal hosts to the IPs of their backends. An IP may include
+// its own port, e.g. "10.0.0.1:8080" or "[fe80::1]:8080", for backends which
+// listen on different ports. URLs resolved to such an IP use its port instead
+// of their own.
 type Routes map[string][]string
 
 type logger struct {
@@ -59,20 +299,185 @@ func (l *logger) Printf(s string, vs ...interface{}) {
 }
 
 func NewClient(client HTTPClient) *Client {
-	return &Client{
+	// Seed each client separately, so that different processes don't
+	// synchronize their selections
+	rnd := &lockedRand{r: rand.New(rand.NewSource(time.Now().UnixNano()))}
+	c := &Client{
 		log:      &logger{},
 		client:   client,
-		backends: Routes{},
-		stop:     make(chan struct{}),
+		store:    newRouteStore(),
+		balancer: randomBalancer{rnd: rnd},
+		rnd:      rnd,
+		suffixes: []string{".internal"},
+		metrics:  nopCollector{},
+		clock:    realClock{},
+		etags:    map[string]etagEntry{},
+		pins:     map[pinKey]*pin{},
+	}
+	return c
+}
+
+// Clone returns a client sharing this client's live routes, e.g. to send
+// requests to the same backends with a different balancer, logger or retry
+// policy. Every option is copied, and changing an option of either client
+// doesn't affect the other.
+//
+// The routes are shared both ways: whichever client updates them, whether by
+// StartUpdating or WithRoutes, updates them for both. Each client still owns
+// the updater it started, so StopUpdating on the clone doesn't stop updates
+// started on the original, or vice versa, and only the client running the
+// updater calls its OnChange and OnBackendRemoved callbacks and reports it
+// through LastUpdate. Active health checks are shared, while passive health,
+// circuit breakers and sticky pins are tracked separately by each client.
+// Route groups aren't copied.
+func (c *Client) Clone() *Client {
+	c.mu.RLock()
+	defer c.mu.RUnlock()
+
+	clone := &Client{
+		client:           c.client,
+		log:              c.log,
+		store:            c.store,
+		etags:            map[string]etagEntry{},
+		pins:             map[pinKey]*pin{},
+		balancer:         c.balancer,
+		rnd:              c.rnd,
+		checks:           c.checks,
+		retry:            c.retry,
+		suffixes:         append([]string{}, c.suffixes...),
+		onChange:         c.onChange,
+		onRemoved:        c.onRemoved,
+		metrics:          c.metrics,
+		maxBackoff:       c.maxBackoff,
+		jitter:           c.jitter,
+		unixSockets:      c.unixSockets,
+		publicFallback:   c.publicFallback,
+		strict:           c.strict,
+		failClosed:       c.failClosed,
+		schemes:          copyStringMap(c.schemes),
+		ports:            c.ports,
+		aliases:          copyStringMap(c.aliases),
+		resolver:         c.resolver,
+		updateHeader:     c.updateHeader.Clone(),
+		updateRequest:    c.updateRequest,
+		decoder:          c.decoder,
+		clock:            c.clock,
+		events:           c.events,
+		selector:         c.selector,
+		trace:            c.trace,
+		tracer:           c.tracer,
+		hedge:            c.hedge,
+		hostAuth:         copyStringMap(c.hostAuth),
+		hostFilter:       c.hostFilter,
+		verbose:          c.verbose,
+		warmups:          c.warmups,
+		zone:             c.zone,
+		family:           c.family,
+		backupURLs:       append([]string{}, c.backupURLs...),
+		fetchTimeout:     c.fetchTimeout,
+		fetchConcurrency: c.fetchConcurrency,
+		acceptStatus:     c.acceptStatus,
+		deltas:           c.deltas,
+		merge:            c.merge,
+	}
+	c.statusMu.Lock()
+	clone.onDegraded = c.onDegraded
+	clone.degradedAt = c.degradedAt
+	c.statusMu.Unlock()
+	if c.health != nil {
+		clone.health = &passiveHealth{
+			maxFailures:  c.health.maxFailures,
+			cooldown:     c.health.cooldown,
+			serverErrors: c.health.serverErrors,
+			now:          c.health.now,
+			ips:          map[hostIP]*ipHealth{},
+		}
+	}
+	if c.breaker != nil {
+		clone.breaker = newCircuitBreaker(c.breaker.maxFailures,
+			c.breaker.cooldown)
+	}
+	if rc := c.resolveCache(); rc != nil {
+		clone.cache.Store(&resolveCache{ttl: rc.ttl, now: rc.now})
 	}
+	return clone
+}
+
+func copyStringMap(m map[string]string) map[string]string {
+	if m == nil {
+		return nil
+	}
+	cp := make(map[string]string, len(m))
+	for k, v := range m {
+		cp[k] = v
+	}
+	return cp
+}
+
+// live returns the table of backends that are currently live. It must not be
+// modified.
+func (c *Client) live() *table {
+	return c.store.backends.Load().(*table)
 }
 
 func DefaultClient(timeout time.Duration) *Client {
 	cc := cleanhttp.DefaultClient()
 	cc.Timeout = timeout
+	if t, ok := cc.Transport.(*http.Transport); ok {
+		configureTransport(t, &net.Resolver{PreferGo: true})
+	}
 	return NewClient(cc)
 }
 
+// configureTransport to dial with a context-aware resolver, dial Unix socket
+// routes, and verify TLS backends with DialTLS. Go's own resolver honors the
+// context of each dial, whereas the system's may not, so together with
+// boundDial the timeouts of route updates bound DNS lookups of the update URLs
+// too.
+func configureTransport(t *http.Transport, resolver *net.Resolver) {
+	dialer := newDialer(resolver)
+	t.DialContext = func(
+		ctx context.Context,
+		network, addr string,
+	) (net.Conn, error) {
+		return dialAddr(ctx, dialer, network, addr)
+	}
+	t.DialTLSContext = dialTLS(dialer, t.TLSClientConfig)
+}
+
+// dialDeadlineKey is the context key of the deadline of a route update.
+type dialDeadlineKey struct{}
+
+// withDialDeadline records the deadline of ctx, if any, for boundDial. The
+// transport detaches dials from the deadline of their request, so that
+// connections may be reused by later requests, which would otherwise let a
+// slow DNS lookup outlive the update.
+func withDialDeadline(ctx context.Context) context.Context {
+	deadline, ok := ctx.Deadline()
+	if !ok {
+		return ctx
+	}
+	return context.WithValue(ctx, dialDeadlineKey{}, deadline)
+}
+
+// boundDial by the deadline recorded with withDialDeadline, if any.
+func boundDial(ctx context.Context) (context.Context, context.CancelFunc) {
+	deadline, ok := ctx.Value(dialDeadlineKey{}).(time.Time)
+	if !ok {
+		return ctx, func() {}
+	}
+	return context.WithDeadline(ctx, deadline)
+}
+
+// newDialer with the same settings as cleanhttp's transport.
+func newDialer(resolver *net.Resolver) *net.Dialer {
+	return &net.Dialer{
+		Timeout:   30 * time.Second,
+		KeepAlive: 30 * time.Second,
+		Resolver:  resolver,
+	}
+}
+
 // WithLogger replaces the logger of a client in a threadsafe way. This can be
 // used for instance to load up the internal LAN clients immediately, then
 // update the logger with new settings later in the program, e.g. after
@@ -86,184 +491,2348 @@ func (c *Client) WithLogger(lg Logger) *Client {
 	return c
 }
 
-// changeRoutes in the client for internal servers. This can be called
-// periodically based on healthchecks from an external service such as a
-// reverse proxy. Unless you are manually updating your routes, you should use
-// StartUpdating and StopUpdating instead.
-func (c *Client) changeRoutes(new Routes) {
-	// Check if routes have changed. Most of the time they have not, so we
-	// don't need the write lock.
-	if changed := diff(new, c.Routes()); !changed {
-		return
-	}
+// WithVerbose makes the client also log each change to its routes, including
+// where they came from and which hosts were added or removed, as positive
+// confirmation that routes are updating. It's off by default.
+func (c *Client) WithVerbose() *Client {
 	c.mu.Lock()
 	defer c.mu.Unlock()
 
-	c.backends = new
+	c.verbose = true
+	return c
 }
 
-func (c *Client) first(urls []string, timeout time.Duration) Routes {
-	// Share a single context among all requests, so they're all canceled
-	// or time out together
-	ctx, cancel := context.WithTimeout(context.Background(), timeout)
-	defer cancel()
-
-	ch := make(chan map[string][]string, len(urls))
-	update := func(uri string) {
-		req, err := http.NewRequestWithContext(ctx, "GET", uri, nil)
-		if err != nil {
-			c.log.Printf("%s: new request: %s", uri, err)
-			return
-		}
-		resp, err := c.client.Do(req)
-		if err != nil {
-			c.log.Printf("%s: do: %s", uri, err)
-			return
-		}
-		defer resp.Body.Close()
-		if resp.StatusCode != http.StatusOK {
-			c.log.Printf("%s: bad status code: %d", uri, resp.StatusCode)
-			return
+// logChange of the routes from old to new, which came from source.
+func (c *Client) logChange(source string, old, new Routes) {
+	var added, removed []string
+	var changed int
+	for host, ips := range new {
+		oldIPs, ok := old[host]
+		switch {
+		case !ok:
+			added = append(added, host)
+		case !Routes{host: ips}.Equal(Routes{host: oldIPs}):
+			changed++
 		}
-		routes := map[string][]string{}
-		if err := json.NewDecoder(resp.Body).Decode(&routes); err != nil {
-			c.log.Printf("%s: decode: %s", uri, err)
-			return
+	}
+	for host := range old {
+		if _, ok := new[host]; !ok {
+			removed = append(removed, host)
 		}
-		ch <- routes
 	}
-	for _, uri := range urls {
-		go update(uri)
+	sort.Strings(added)
+	sort.Strings(removed)
+	if source == "" {
+		source = "unknown source"
 	}
-	select {
-	case routes := <-ch:
-		return routes
-	case <-ctx.Done():
-		// Default to keeping our existing routes, so a slowdown from
-		// the reverse proxy doesn't cause an outage
-		return c.Routes()
+	c.log.Printf("routes changed from %s: %d hosts, added %v, removed %v, "+
+		"%d changed", source, len(new), added, removed, changed)
+}
+
+// WithRand replaces the source of randomness used by the balancers of this
+// package and by WithJitter, e.g. to make selection deterministic in tests.
+// The client serializes access to r, so it must not be used elsewhere. By
+// default each client has its own source seeded from the current time.
+func (c *Client) WithRand(r *rand.Rand) *Client {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	c.rnd = &lockedRand{r: r}
+	switch b := c.balancer.(type) {
+	case randomBalancer:
+		c.balancer = randomBalancer{rnd: c.rnd}
+	case randUser:
+		b.useRand(c.rnd)
 	}
+	return c
 }
 
-func (c *Client) WithRoutes(routes Routes) *Client {
+// WithBalancer replaces the strategy used to select among a host's IPs. By
+// default IPs are selected randomly. Balancers of this package which make
+// random choices use the client's source of randomness, so a balancer shared
+// by clients uses whichever client was given it last.
+func (c *Client) WithBalancer(b Balancer) *Client {
 	c.mu.Lock()
 	defer c.mu.Unlock()
 
-	c.backends = routes
+	if ru, ok := b.(randUser); ok {
+		ru.useRand(c.rnd)
+	}
+	c.balancer = b
 	return c
 }
 
-// StartUpdating live backends with an initial, synchronous update before
-// continuing. Try all URLs simultaneously and use results from the first
-// reply. Note that even when this fails, we still allow the code to
-// continue... Just don't expect internal IPs to route until the servers come
-// online.
-func (c *Client) StartUpdating(urls []string, every time.Duration) {
-	c.changeRoutes(c.first(urls, every))
-	go func() {
-		for {
-			select {
-			case <-time.After(every):
-				c.changeRoutes(c.first(urls, every))
-			case <-c.stop:
-				return
-			}
+// WithSuffix replaces the host suffixes which trigger resolution to internal
+// IPs. A leading dot is added to each suffix if missing. By default only
+// ".internal" hosts are resolved.
+func (c *Client) WithSuffix(suffixes ...string) *Client {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	if len(suffixes) == 0 {
+		c.suffixes = []string{".internal"}
+		return c
+	}
+	c.suffixes = make([]string, 0, len(suffixes))
+	for _, s := range suffixes {
+		if !strings.HasPrefix(s, ".") {
+			s = "." + s
 		}
-	}()
+		c.suffixes = append(c.suffixes, strings.ToLower(s))
+	}
+	return c
 }
 
-func (c *Client) StopUpdating() {
-	// Send if listening, otherwise do nothing
-	select {
-	case c.stop <- struct{}{}:
+// WithStrictResolution makes Do return a *ResolveError rather than sending the
+// request when an internal host has no live backends, or every one of them is
+// considered unhealthy by health checks or passive health. By default hosts
+// without backends are sent to the original, unresolved host, and hosts whose
+// backends are all unhealthy are sent to any of them.
+func (c *Client) WithStrictResolution() *Client {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	c.strict = true
+	return c
+}
+
+// WithFailClosed makes Do return a *NoRoutesError rather than sending the
+// request when an internal host has no routes at all, so that an empty route
+// table never sends internal traffic to the public internet. Unlike
+// WithStrictResolution, hosts whose backends are all unhealthy are still sent
+// to one of them.
+func (c *Client) WithFailClosed() *Client {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	c.failClosed = true
+	return c
+}
+
+// WithSelector picks the IP for each request sent through Do or RoundTripper
+// using fn rather than the balancer, e.g. to pin sessions to a backend using a
+// cookie or header. fn receives the live IPs of the request's host after any
+// health and zone filtering, and must return one of them, or "" to leave the
+// choice to the balancer. URLs resolved without a request, such as through
+// ResolveHost, always use the balancer. fn must be safe for concurrent use
+// and must not call methods of the client.
+func (c *Client) WithSelector(fn func(*http.Request, []string) string) *Client {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	c.selector = fn
+	return c
+}
+
+// WithResolveTrace calls fn each time an internal host is resolved to one of
+// its IPs, with the IP chosen and the candidates it was chosen from after any
+// health and zone filtering, e.g. to diagnose uneven load distribution in
+// production. fn is also called on a miss, when the host has no IPs, with an
+// empty ip and no candidates. Candidates are repeated in proportion to their
+// weights. fn must be safe for concurrent use.
+func (c *Client) WithResolveTrace(
+	fn func(host, ip string, candidates []string),
+) *Client {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	c.trace = fn
+	return c
+}
+
+// WithLocalZone prefers backends whose "zone" metadata matches zone, only
+// sending traffic to other zones when no local backend is healthy. Backends
+// ejected by passive health or failing health checks are excluded before the
+// preference is applied, so an unhealthy local backend spills traffic over to
+// the remaining zones rather than trapping it locally. The balancer selects
+// among whichever IPs remain.
+func (c *Client) WithLocalZone(zone string) *Client {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	c.zone = zone
+	return c
+}
+
+// WithAddressFamily prefers backends of the given address family, "ipv4" or
+// "ipv6", for hosts listing both, e.g. when egress only reliably supports
+// IPv4. Backends of the other family are only selected if none of the
+// preferred family are healthy. The default, "any", selects among either, as
+// does any other value.
+func (c *Client) WithAddressFamily(family string) *Client {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	switch family {
+	case "ipv4", "ipv6":
+		c.family = family
 	default:
+		c.family = ""
 	}
+	return c
 }
 
-func (c *Client) Do(req *http.Request) (*http.Response, error) {
-	req.URL = c.ResolveHost(req.URL)
-	return c.client.Do(req)
+// WithBackupURLs requests routes from the given URLs only when every update
+// URL fails, e.g. to keep a backup cluster in another region from serving
+// routes unless the primary cluster is down. The backups are raced like the
+// update URLs with a timeout of their own, so an update may take up to twice
+// the fetch timeout. Route groups don't use the backups.
+func (c *Client) WithBackupURLs(urls []string) *Client {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	c.backupURLs = append([]string{}, urls...)
+	return c
 }
 
-// ResolveHost from a URL to a specific IP if internal, otherwise return the
-// URL unmodified.
-func (c *Client) ResolveHost(uri *url.URL) *url.URL {
-	host, port, err := net.SplitHostPort(uri.Host)
-	if err != nil {
-		host = uri.Host
-		port = ""
-	}
-	if !strings.HasSuffix(host, ".internal") {
-		return uri
-	}
-	ip := c.getIP(host)
-	if ip == "" {
-		return uri
-	}
-	if port == "" {
-		uri.Host = ip
-	} else {
-		uri.Host = fmt.Sprintf("%s:%s", ip, port)
-	}
-	return uri
+// WithFetchTimeout bounds how long each update waits for the update URLs to
+// reply, separately from how often updates run, e.g. to poll every 30s but
+// give up on a fetch after 3s. By default the update interval passed to
+// StartUpdating is used. It must be set before StartUpdating.
+func (c *Client) WithFetchTimeout(d time.Duration) *Client {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	c.fetchTimeout = d
+	return c
 }
 
-func (c *Client) getIP(host string) string {
-	c.mu.RLock()
-	defer c.mu.RUnlock()
+// WithFetchConcurrency limits each update to n requests in flight at once,
+// avoiding a spike of connections when there are many update URLs. URLs are
+// requested in order as earlier requests complete, and the update still
+// finishes as soon as any URL replies. By default every URL is requested at
+// once.
+func (c *Client) WithFetchConcurrency(n int) *Client {
+	c.mu.Lock()
+	defer c.mu.Unlock()
 
-	ips, ok := c.backends[host]
-	if !ok {
-		return ""
-	}
-	if len(ips) == 0 {
-		return ""
-	}
-	return ips[rand.Intn(len(ips))]
+	c.fetchConcurrency = n
+	return c
 }
 
-// Routes returns a copy of all live backend IPs.
-func (c *Client) Routes() Routes {
-	c.mu.RLock()
-	defer c.mu.RUnlock()
+// WithAcceptStatus treats replies from update URLs with any of the given
+// status codes as successful updates which keep the current routes, without
+// logging an error, e.g. 204 No Content for "no change" or 202 Accepted for
+// "still computing". 200 OK is always decoded as routes and 304 Not Modified
+// always keeps the current routes. Any other status fails the update.
+func (c *Client) WithAcceptStatus(codes ...int) *Client {
+	c.mu.Lock()
+	defer c.mu.Unlock()
 
-	r := make(Routes, len(c.backends))
-	for host, ips := range c.backends {
-		r[host] = append([]string{}, ips...)
+	c.acceptStatus = make(map[int]bool, len(codes))
+	for _, code := range codes {
+		c.acceptStatus[code] = true
 	}
-	return r
+	return c
 }
 
-func diff(a, b Routes) bool {
-	// Exit quickly if lengths are different
-	if len(a) != len(b) {
-		return true
-	}
+// WithMergeRoutes waits for every update URL to reply, up to the update
+// timeout, and serves the union of their routes. This is useful when each
+// reverse proxy only knows about its own part of the network. IPs listed for
+// the same host by several URLs are kept once. By default the routes from
+// whichever URL replies first are used.
+func (c *Client) WithMergeRoutes() *Client {
+	c.mu.Lock()
+	defer c.mu.Unlock()
 
-	// Iterate through every key in a and determine if all IPs match
-	for key := range a {
-		if (a[key] == nil) != (b[key] == nil) {
-			return true
-		}
-		if len(a[key]) != len(b[key]) {
-			return true
-		}
+	c.merge = true
+	return c
+}
 
-		// Sort the live backends to get better performance when
-		// diffing them
-		sort.Slice(a[key], func(i, j int) bool {
-			return a[key][i] < a[key][j]
-		})
-		sort.Slice(b[key], func(i, j int) bool {
-			return b[key][i] < b[key][j]
-		})
+// WithHostFilter keeps only the routes of hosts for which keep returns true,
+// discarding the rest as routes are fetched, loaded from a file or streamed.
+// This saves memory when a registry lists many more hosts than the client
+// talks to. Requests to discarded hosts behave as if the hosts had no routes.
+func (c *Client) WithHostFilter(keep func(host string) bool) *Client {
+	c.mu.Lock()
+	defer c.mu.Unlock()
 
-		// Compare two and exit on the first different string
-		for i, ip := range a[key] {
-			if b[key][i] != ip {
-				return true
-			}
-		}
+	c.hostFilter = keep
+	return c
+}
+
+// WithPublicFallback makes Do send a request once more to its original,
+// unresolved URL when an internal backend can't be dialed, for services which
+// are also reachable through a public gateway. Only connection failures fall
+// back, not responses with error statuses. Requests with a body must set
+// GetBody, as http.NewRequest does for common body types, so the body can be
+// sent again. With WithRetry, the fallback happens once retries are
+// exhausted.
+func (c *Client) WithPublicFallback() *Client {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	c.publicFallback = true
+	return c
+}
+
+// WithScheme overrides the scheme of URLs for an internal host when they're
+// resolved, e.g. so that "http://foo.internal" resolves to "https://<ip>" for
+// services which only accept HTTPS. URLs which aren't resolved to an IP keep
+// their scheme.
+func (c *Client) WithScheme(host, scheme string) *Client {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	if c.schemes == nil {
+		c.schemes = map[string]string{}
 	}
-	return false
+	c.schemes[normalizeHost(host)] = scheme
+	return c
+}
+
+// WithPortMap overrides the port of URLs for internal hosts when they're
+// resolved, keyed by host, e.g. so that "https://foo.internal:443" resolves to
+// "https://<ip>:8443" for services listening on a different port internally
+// than clients use. The port is set whether or not the URL has one. Backends
+// listed with their own port keep it, and URLs which aren't resolved to an IP
+// keep their port. It replaces any previous port map.
+func (c *Client) WithPortMap(ports map[string]string) *Client {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	c.ports = make(map[string]string, len(ports))
+	for host, port := range ports {
+		c.ports[normalizeHost(host)] = port
+	}
+	return c
+}
+
+// WithHostAuth sets the Authorization header of requests resolved to a
+// backend of an internal host, keyed by host, e.g. to send a different
+// service token to each service. Requests are matched by their original
+// hostname before it's rewritten to an IP, falling back to the target of an
+// alias. Requests which already have an Authorization header keep it, and
+// requests which aren't resolved to an IP are sent without one. It replaces
+// any previous host auth.
+func (c *Client) WithHostAuth(auth map[string]string) *Client {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	c.hostAuth = make(map[string]string, len(auth))
+	for host, val := range auth {
+		c.hostAuth[normalizeHost(host)] = val
+	}
+	return c
+}
+
+// withHostAuth returns a shallow copy of a request resolved to a backend of
+// host with the Authorization header set as configured by WithHostAuth, or
+// req unmodified if there's none for it.
+func (c *Client) withHostAuth(
+	req *http.Request,
+	hostport, host string,
+) *http.Request {
+	if req.Header.Get("Authorization") != "" {
+		return req
+	}
+	orig, _ := splitHostPort(hostport)
+	c.mu.RLock()
+	val, ok := c.hostAuth[orig]
+	if !ok {
+		val, ok = c.hostAuth[host]
+	}
+	c.mu.RUnlock()
+	if !ok {
+		return req
+	}
+	req = req.WithContext(req.Context())
+	req.Header = req.Header.Clone()
+	if req.Header == nil {
+		req.Header = http.Header{}
+	}
+	req.Header.Set("Authorization", val)
+	return req
+}
+
+// WithAlias makes alias resolve using the routes of target, e.g. for a legacy
+// name of a service, without listing its backends twice. Aliases may point to
+// other aliases, which are followed, but an alias which would form a cycle is
+// logged and ignored. Requests to an alias are resolved, balanced and tracked
+// as if they were sent to target, while keeping their original Host header.
+func (c *Client) WithAlias(alias, target string) *Client {
+	alias, target = normalizeHost(alias), normalizeHost(target)
+
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	if c.canonical(target) == alias {
+		c.log.Printf("alias %s: ignoring cycle through %s", alias, target)
+		return c
+	}
+	if c.aliases == nil {
+		c.aliases = map[string]string{}
+	}
+	c.aliases[alias] = target
+	return c
+}
+
+// canonical returns the host whose routes host resolves with, following any
+// aliases. The caller must hold the read lock.
+func (c *Client) canonical(host string) string {
+	for {
+		target, ok := c.aliases[host]
+		if !ok {
+			return host
+		}
+		host = target
+	}
+}
+
+// WithDNSFallback looks up internal hosts which have no live backends using
+// the given resolver, sending requests to the first address found. By default
+// such requests are sent to the original, unresolved host.
+func (c *Client) WithDNSFallback(resolver *net.Resolver) *Client {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	c.resolver = resolver
+	return c
+}
+
+// IsInternal reports whether the URL's host ends with any of the client's
+// suffixes, regardless of whether it currently has any backends.
+func (c *Client) IsInternal(uri *url.URL) bool {
+	c.mu.RLock()
+	defer c.mu.RUnlock()
+
+	return c.isInternal(normalizeHost(uri.Hostname()))
+}
+
+// isInternal reports whether the host ends with any configured suffix. The
+// caller must hold the read lock.
+func (c *Client) isInternal(host string) bool {
+	for _, s := range c.suffixes {
+		if strings.HasSuffix(host, s) {
+			return true
+		}
+	}
+	return false
+}
+
+// changeRoutes in the client for internal servers. This can be called
+// periodically based on healthchecks from an external service such as a
+// reverse proxy. Unless you are manually updating your routes, you should use
+// StartUpdating and StopUpdating instead. The live table is built from a deep
+// copy of new, so the caller keeps ownership of it and may modify it after.
+func (c *Client) changeRoutes(new map[string][]Backend) {
+	c.changeRoutesFrom("", new)
+}
+
+// changeRoutesFrom is like changeRoutes, where source describes where the
+// routes came from, such as an update URL, for verbose logging.
+func (c *Client) changeRoutesFrom(source string, new map[string][]Backend) {
+	routes, attrs := splitBackends(new)
+
+	// Check if routes have changed against the live table. Most of the time
+	// they have not, so we don't need to take any lock or copy anything.
+	live := c.live()
+	if routes.Equal(live.routes) && reflect.DeepEqual(attrs, live.attrs) {
+		return
+	}
+	c.store.mu.Lock()
+	prev := c.live().routes
+	changed := !routes.Equal(prev)
+	c.setBackends(newTable(routes, attrs))
+	c.store.mu.Unlock()
+
+	c.mu.RLock()
+	onChange := c.onChange
+	onRemoved := c.onRemoved
+	metrics := c.metrics
+	verbose := c.verbose
+	c.mu.RUnlock()
+
+	metrics.RoutesChanged()
+	if verbose && changed {
+		c.logChange(source, prev, routes)
+	}
+
+	// Call outside of the lock, so callbacks are free to use the client.
+	// The previous table is no longer live, so its routes can be read
+	// without holding the lock.
+	if !changed {
+		return
+	}
+	if onRemoved != nil {
+		for _, r := range removed(prev, routes) {
+			onRemoved(r.host, r.ip)
+		}
+	}
+	c.warm(prev, routes)
+	if onChange != nil {
+		onChange(copyRoutes(prev), copyRoutes(routes))
+	}
+}
+
+// removed returns the backends in old which are missing from new. Swapping
+// the arguments returns the backends which were added.
+func removed(old, new Routes) []hostIP {
+	var out []hostIP
+	for host, oldIPs := range old {
+		newIPs := new[host]
+		for _, ip := range oldIPs {
+			found := false
+			for _, newIP := range newIPs {
+				if ip == newIP {
+					found = true
+					break
+				}
+			}
+			if !found {
+				out = append(out, hostIP{host: host, ip: ip})
+			}
+		}
+	}
+	return out
+}
+
+// OnBackendRemoved registers a callback fired for each backend IP which
+// disappears from a host when the routes change, replacing any previous
+// callback. Requests already in flight to the backend are unaffected, so this
+// is a good time to close idle connections to it.
+func (c *Client) OnBackendRemoved(fn func(host, ip string)) *Client {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	c.onRemoved = fn
+	return c
+}
+
+// OnChange registers a callback fired whenever the live routes change,
+// replacing any previous callback. It receives copies of the old and new
+// routes, so it may safely retain them.
+func (c *Client) OnChange(fn func(old, new Routes)) *Client {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	c.onChange = fn
+	return c
+}
+
+// setBackends replaces the live backends. The caller must hold store.mu.
+func (c *Client) setBackends(t *table) {
+	c.store.backends.Store(t)
+	if rc := c.resolveCache(); rc != nil {
+		rc.clear()
+	}
+
+	c.mu.RLock()
+	health := c.health
+	c.mu.RUnlock()
+	if health != nil {
+		health.reset()
+	}
+	close(c.store.changed)
+	c.store.changed = make(chan struct{})
+}
+
+// WaitForRoutes blocks until every host has at least one live IP, e.g. so an
+// app can wait for its dependencies at boot before serving traffic. It returns
+// the context's error if ctx is done first. Routes are checked again whenever
+// they change, so it returns as soon as the last host appears.
+func (c *Client) WaitForRoutes(ctx context.Context, hosts ...string) error {
+	for {
+		c.store.mu.Lock()
+		changed := c.store.changed
+		c.store.mu.Unlock()
+
+		ready := true
+		for _, host := range hosts {
+			if len(c.IPs(host)) == 0 {
+				ready = false
+				break
+			}
+		}
+		if ready {
+			return nil
+		}
+		select {
+		case <-changed:
+		case <-ctx.Done():
+			return ctx.Err()
+		}
+	}
+}
+
+// Ready reports whether the client has any live IP for any host, e.g. for a
+// readiness probe to gate traffic until routes arrive. If the initial update
+// in StartUpdating fails, Ready becomes true as soon as a later update
+// delivers routes. Use WaitForRoutes to wait for specific hosts instead.
+func (c *Client) Ready() bool {
+	for _, ips := range c.live().routes {
+		if len(ips) > 0 {
+			return true
+		}
+	}
+	return false
+}
+
+// firstURL returns the routes from whichever URL replies first, along with
+// that URL. If no URL replied with new routes, routes is nil rather than a
+// copy of the existing routes, so updates which change nothing don't copy the
+// table. err describes the failure if no URL replied.
+func (c *Client) firstURL(
+	ctx context.Context,
+	urls []string,
+	timeout time.Duration,
+) (map[string][]Backend, string, error) {
+	routes, uri, err := c.race(ctx, urls, timeout)
+	c.mu.RLock()
+	backups := c.backupURLs
+	c.mu.RUnlock()
+	if err != nil && len(backups) > 0 && ctx.Err() == nil {
+		routes, uri, err = c.race(ctx, backups, timeout)
+		if err != nil {
+			err = fmt.Errorf("backup: %w", err)
+		}
+	}
+
+	c.mu.RLock()
+	now := c.clock.Now()
+	c.mu.RUnlock()
+
+	var onDegraded func(int)
+	c.statusMu.Lock()
+	c.lastErr = err
+	if err == nil {
+		c.lastUpdate = now
+		c.lastURL = uri
+		c.failures = 0
+	} else if ctx.Err() == nil {
+		c.failures++
+		if c.failures == c.degradedAt {
+			onDegraded = c.onDegraded
+		}
+	}
+	failures := c.failures
+	c.statusMu.Unlock()
+
+	// Call outside of the lock, so the callback is free to use the client
+	if onDegraded != nil {
+		onDegraded(failures)
+	}
+	return routes, uri, err
+}
+
+// ConsecutiveFailures returns the number of route updates which have failed
+// in a row, or 0 if the most recent update succeeded. Updates interrupted by
+// StopUpdating aren't counted.
+func (c *Client) ConsecutiveFailures() int {
+	c.statusMu.Lock()
+	defer c.statusMu.Unlock()
+
+	return c.failures
+}
+
+// OnDegraded registers a callback fired when route updates have failed
+// threshold times in a row, replacing any previous callback, e.g. to mark the
+// service unhealthy while discovery is broken. It fires once each time the
+// count reaches threshold, so it fires again only after an update succeeds
+// and the failures build up again. Use ConsecutiveFailures to watch it
+// recover.
+func (c *Client) OnDegraded(threshold int, fn func(count int)) *Client {
+	c.statusMu.Lock()
+	defer c.statusMu.Unlock()
+
+	c.onDegraded = fn
+	c.degradedAt = threshold
+	return c
+}
+
+// race every URL, returning the routes from whichever replies first along
+// with its URL, or the union of every URL's routes when merging. routes is
+// nil if the existing routes should be kept, either because they're unchanged
+// or because no URL replied.
+func (c *Client) race(
+	ctx context.Context,
+	urls []string,
+	timeout time.Duration,
+) (map[string][]Backend, string, error) {
+	if len(urls) == 0 {
+		return nil, "", errors.New("no update urls")
+	}
+
+	// Share a single context among all requests, so they're all canceled
+	// or time out together
+	ctx, cancel := context.WithTimeout(ctx, timeout)
+	defer cancel()
+
+	c.mu.RLock()
+	metrics := c.metrics
+	merge := c.merge
+	concurrency := c.fetchConcurrency
+	c.mu.RUnlock()
+
+	type result struct {
+		routes map[string][]Backend
+		uri    string
+		err    error
+	}
+	ch := make(chan result, len(urls))
+
+	// Bound the requests in flight if configured
+	var sem chan struct{}
+	if concurrency > 0 && concurrency < len(urls) {
+		sem = make(chan struct{}, concurrency)
+	}
+	update := func(uri string) {
+		if sem != nil {
+			defer func() { <-sem }()
+		}
+		routes, err := c.fetch(ctx, uri)
+		if errors.Is(err, errNotModified) {
+			metrics.RouteUpdateNotModified(uri)
+			ch <- result{uri: uri}
+			return
+		}
+		if err != nil {
+			c.updateFailed(uri, err)
+			metrics.RouteUpdateFailed(uri, err)
+			ch <- result{err: fmt.Errorf("%s: %w", uri, err)}
+			return
+		}
+		metrics.RouteUpdateSucceeded(uri)
+		ch <- result{routes: routes, uri: uri}
+	}
+	if sem == nil {
+		for _, uri := range urls {
+			go update(uri)
+		}
+	} else {
+		// Start requests in order as slots free up, so the results can
+		// still be received below as they arrive
+		go func() {
+			for _, uri := range urls {
+				select {
+				case sem <- struct{}{}:
+					go update(uri)
+				case <-ctx.Done():
+					ch <- result{err: fmt.Errorf("%s: %w",
+						uri, ctx.Err())}
+				}
+			}
+		}()
+	}
+	var err error
+	if merge {
+		// Wait for every URL, then union what we received in URL order
+		// so the result doesn't depend on which replied first.
+		got := make(map[string]map[string][]Backend, len(urls))
+	wait:
+		for range urls {
+			select {
+			case res := <-ch:
+				if res.err != nil {
+					err = res.err
+					continue
+				}
+				got[res.uri] = res.routes
+			case <-ctx.Done():
+				break wait
+			}
+		}
+		if len(got) == 0 {
+			if err == nil {
+				err = ctx.Err()
+			}
+			return nil, "", fmt.Errorf("all urls failed, last: %w", err)
+		}
+		var merged map[string][]Backend
+		var from string
+		for _, uri := range urls {
+			routes, ok := got[uri]
+			if !ok {
+				continue
+			}
+			if from == "" {
+				from = uri
+			}
+
+			// URLs without routes of their own, such as those
+			// accepted before ever sending any, contribute nothing
+			// rather than emptying the table
+			if routes == nil {
+				continue
+			}
+			merged = mergeRoutes(merged, routes)
+		}
+		return merged, from, nil
+	}
+	for range urls {
+		select {
+		case res := <-ch:
+			if res.err == nil {
+				return res.routes, res.uri, nil
+			}
+			err = res.err
+		case <-ctx.Done():
+			return nil, "", fmt.Errorf("no url replied: %w",
+				ctx.Err())
+		}
+	}
+	return nil, "", fmt.Errorf("all urls failed, last: %w", err)
+}
+
+// mergeRoutes adds the backends in src to dst, skipping any IP a host already
+// has, and returns dst.
+func mergeRoutes(
+	dst, src map[string][]Backend,
+) map[string][]Backend {
+	if dst == nil {
+		dst = make(map[string][]Backend, len(src))
+	}
+	for host, backends := range src {
+		seen := make(map[string]struct{}, len(dst[host]))
+		for _, b := range dst[host] {
+			seen[b.IP] = struct{}{}
+		}
+		for _, b := range backends {
+			if _, ok := seen[b.IP]; ok {
+				continue
+			}
+			seen[b.IP] = struct{}{}
+			dst[host] = append(dst[host], b)
+		}
+	}
+	return dst
+}
+
+// LastUpdate reports when routes were last fetched successfully and from
+// which URL. err is the error from the most recent update if it failed, or
+// nil if it succeeded. The time is zero if no update has succeeded.
+func (c *Client) LastUpdate() (at time.Time, uri string, err error) {
+	c.statusMu.Lock()
+	defer c.statusMu.Unlock()
+
+	return c.lastUpdate, c.lastURL, c.lastErr
+}
+
+// errNotModified is returned by fetch when the routes at a URL haven't changed
+// since they were last fetched.
+var errNotModified = errors.New("not modified")
+
+type etagEntry struct {
+	etag string
+
+	// routes last received with the ETag. These are only kept when
+	// merging routes, since an unchanged URL must still contribute its
+	// routes to the merge.
+	routes map[string][]Backend
+}
+
+// fetch routes from a single URL. If the URL previously replied with an ETag,
+// it's sent back so unchanged routes needn't be sent and decoded again.
+func (c *Client) fetch(
+	ctx context.Context,
+	uri string,
+) (map[string][]Backend, error) {
+	req, err := http.NewRequestWithContext(withDialDeadline(ctx), "GET",
+		uri, nil)
+	if err != nil {
+		return nil, fmt.Errorf("new request: %w", err)
+	}
+
+	// Setting this ourselves disables the transport's transparent
+	// decompression, so gzipped bodies are decompressed below. This also
+	// supports HTTPClients which don't decompress at all.
+	req.Header.Set("Accept-Encoding", "gzip")
+	c.mu.RLock()
+	for key, vals := range c.updateHeader {
+		req.Header[key] = append([]string{}, vals...)
+	}
+	updateRequest := c.updateRequest
+	decoder := c.decoder
+	merge := c.merge
+	deltas := c.deltas
+	accept := c.acceptStatus
+	c.mu.RUnlock()
+	if updateRequest != nil {
+		updateRequest(req)
+	}
+	c.etagMu.Lock()
+	cached := c.etags[uri]
+	c.etagMu.Unlock()
+	if cached.etag != "" && (!merge || cached.routes != nil) {
+		req.Header.Set("If-None-Match", cached.etag)
+	}
+	resp, err := c.Transport().Do(req)
+	if err != nil {
+		return nil, fmt.Errorf("do: %w", err)
+	}
+	defer drainClose(resp.Body)
+	if resp.StatusCode == http.StatusNotModified ||
+		(resp.StatusCode != http.StatusOK && accept[resp.StatusCode]) {
+		if merge && cached.routes != nil {
+			return cached.routes, nil
+		}
+		return nil, errNotModified
+	}
+	if resp.StatusCode != http.StatusOK {
+		return nil, &statusError{
+			code:       resp.StatusCode,
+			retryAfter: c.retryAfter(resp),
+		}
+	}
+
+	body := io.Reader(resp.Body)
+	if strings.EqualFold(resp.Header.Get("Content-Encoding"), "gzip") {
+		gz, err := gzip.NewReader(resp.Body)
+		if err != nil {
+			return nil, &decodeError{err: fmt.Errorf("gzip: %w", err)}
+		}
+		defer gz.Close()
+		body = gz
+	}
+	var routes map[string][]Backend
+	if deltas && decoder == nil {
+		routes, err = decodeDelta(body, c.deltaBase(cached.routes))
+	} else {
+		routes, err = decodeRoutes(body, decoder, c.live().routes)
+	}
+	if err != nil {
+		return nil, &decodeError{err: err}
+	}
+	c.dropInvalid(uri, routes)
+	c.filterHosts(routes)
+
+	// When merging, keep the routes even without an ETag, since they're
+	// still needed if the URL later replies with an accepted status. Deltas
+	// apply to them too.
+	keep := merge || deltas
+	c.etagMu.Lock()
+	defer c.etagMu.Unlock()
+	if etag := resp.Header.Get("ETag"); etag != "" || keep {
+		entry := etagEntry{etag: etag}
+		if keep {
+			entry.routes = routes
+		}
+		c.etags[uri] = entry
+	} else {
+		delete(c.etags, uri)
+	}
+	return routes, nil
+}
+
+// retryAfter parses the Retry-After header of 429 and 503 responses, given
+// either in seconds or as an HTTP date. It returns zero if there's none.
+func (c *Client) retryAfter(resp *http.Response) time.Duration {
+	if resp.StatusCode != http.StatusTooManyRequests &&
+		resp.StatusCode != http.StatusServiceUnavailable {
+		return 0
+	}
+	val := strings.TrimSpace(resp.Header.Get("Retry-After"))
+	if val == "" {
+		return 0
+	}
+	if secs, err := strconv.ParseInt(val, 10, 64); err == nil {
+		if secs < 0 {
+			return 0
+		}
+		if secs > int64(math.MaxInt64/time.Second) {
+			return math.MaxInt64
+		}
+		return time.Duration(secs) * time.Second
+	}
+	at, err := http.ParseTime(val)
+	if err != nil {
+		return 0
+	}
+	c.mu.RLock()
+	now := c.clock.Now()
+	c.mu.RUnlock()
+	if d := at.Sub(now); d > 0 {
+		return d
+	}
+	return 0
+}
+
+// maxDrain is the most of an unread response body that drainClose reads.
+const maxDrain = 256 << 10
+
+// drainClose reads the rest of a response body before closing it, so the
+// connection can be reused for the next update even when we didn't read the
+// body, e.g. on a bad status or decode error. Overly large bodies are closed
+// without reading them all, which is cheaper than reusing the connection.
+func drainClose(body io.ReadCloser) {
+	_, _ = io.Copy(ioutil.Discard, io.LimitReader(body, maxDrain))
+	body.Close()
+}
+
+// decodeRoutes using decoder if set, otherwise from JSON. Hosts are normalized
+// and duplicate IPs of a host are removed. hint holds the previous routes, if
+// any, to size the decoded table.
+func decodeRoutes(
+	r io.Reader,
+	decoder func(io.Reader) (Routes, error),
+	hint Routes,
+) (map[string][]Backend, error) {
+	if decoder != nil {
+		routes, err := decoder(r)
+		if err != nil {
+			return nil, err
+		}
+		return dedupeBackends(normalizeRoutes(toBackends(routes))), nil
+	}
+
+	// Routes are accepted either as plain IP strings or as weighted
+	// backend objects
+	routes, err := decodeJSON(r, hint)
+	if err != nil {
+		return nil, err
+	}
+	return dedupeBackends(normalizeRoutes(routes)), nil
+}
+
+// WithDecoder parses update responses using fn rather than as JSON, allowing
+// routes to be fetched from registries using other formats. Passing nil
+// restores the default JSON decoder.
+func (c *Client) WithDecoder(fn func(io.Reader) (Routes, error)) *Client {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	c.decoder = fn
+	return c
+}
+
+// WithUpdateHeaders adds headers, such as authorization tokens, to every
+// request for routes made by StartUpdating.
+func (c *Client) WithUpdateHeaders(header http.Header) *Client {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	c.updateHeader = header.Clone()
+	return c
+}
+
+// WithUpdateRequest calls fn on every request for routes made by
+// StartUpdating before it's sent, after any headers from WithUpdateHeaders are
+// added. This is useful for headers which change over time, such as
+// short-lived tokens. fn must be safe for concurrent use.
+func (c *Client) WithUpdateRequest(fn func(*http.Request)) *Client {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	c.updateRequest = fn
+	return c
+}
+
+// WithRoutes replaces the live routes with a copy of routes, so the caller
+// may modify them after.
+func (c *Client) WithRoutes(routes Routes) *Client {
+	routes = copyRoutes(routes)
+
+	c.store.mu.Lock()
+	defer c.store.mu.Unlock()
+
+	c.setBackends(newTable(routes, nil))
+	return c
+}
+
+// StartUpdating live backends with an initial, synchronous update before
+// continuing. Try all URLs simultaneously and use results from the first
+// reply. Note that even when this fails, we still allow the code to
+// continue... Just don't expect internal IPs to route until the servers come
+// online. If the client is already updating, the previous updater is stopped
+// first. Any route groups are updated alongside the default routes.
+//
+// An error is returned if no URL replied to the initial update. The updater
+// keeps running regardless, so the error may be safely ignored. If any URL is
+// malformed or isn't http or https, an *InvalidURLError is returned instead
+// and nothing is started, leaving any previous updater running.
+func (c *Client) StartUpdating(urls []string, every time.Duration) error {
+	for _, uri := range urls {
+		if err := validateUpdateURL(uri); err != nil {
+			return err
+		}
+	}
+	c.StopUpdating()
+
+	ctx, cancel := context.WithCancel(context.Background())
+	u := &updater{
+		ctx:     ctx,
+		cancel:  cancel,
+		timeout: c.updateTimeout(every),
+		done:    make(chan struct{}),
+		urls:    append([]string{}, urls...),
+	}
+	c.updaterMu.Lock()
+	c.updater = u
+	c.updaterMu.Unlock()
+
+	err := c.update(u)
+	if err != nil {
+		err = fmt.Errorf("initial update: %w", err)
+	}
+
+	var wg sync.WaitGroup
+	wg.Add(2)
+	go func() {
+		defer wg.Done()
+		c.runHealthChecks(ctx)
+	}()
+	go func() {
+		defer wg.Done()
+		c.runUpdates(ctx, u, every, err)
+	}()
+	go func() {
+		wg.Wait()
+		close(u.done)
+	}()
+	return err
+}
+
+// validateUpdateURL reports an *InvalidURLError unless uri is an absolute http
+// or https URL.
+func validateUpdateURL(uri string) error {
+	u, err := url.Parse(uri)
+	switch {
+	case err != nil:
+		return &InvalidURLError{URL: uri, Err: err}
+	case u.Scheme != "http" && u.Scheme != "https":
+		return &InvalidURLError{URL: uri,
+			Err: errors.New("scheme must be http or https")}
+	case u.Host == "":
+		return &InvalidURLError{URL: uri, Err: errors.New("missing host")}
+	}
+	return nil
+}
+
+// SetUpdateURLs replaces the URLs the running updater requests routes from,
+// starting with its next update. Unlike calling StartUpdating again, the
+// updater isn't restarted and the existing routes are kept. It has no effect
+// if the client isn't updating.
+func (c *Client) SetUpdateURLs(urls []string) {
+	c.updaterMu.Lock()
+	u := c.updater
+	c.updaterMu.Unlock()
+	if u == nil {
+		return
+	}
+
+	u.mu.Lock()
+	defer u.mu.Unlock()
+
+	u.urls = append([]string{}, urls...)
+}
+
+// PauseUpdates stops the running updater from updating the routes until
+// ResumeUpdates is called, e.g. during maintenance of the registry. The
+// current routes keep being served, and the updater keeps running, skipping
+// each scheduled update. RefreshNow still updates the routes while paused. It
+// has no effect if the client isn't updating, and the updater started by a
+// later StartUpdating isn't paused.
+func (c *Client) PauseUpdates() {
+	c.setPaused(true)
+}
+
+// ResumeUpdates undoes PauseUpdates, so the updater continues with its next
+// scheduled update. If refresh is set, the routes are also updated right away
+// as by RefreshNow, returning its error. An error is returned if the client
+// isn't updating.
+func (c *Client) ResumeUpdates(refresh bool) error {
+	if !c.setPaused(false) {
+		return errors.New("not updating")
+	}
+	if refresh {
+		return c.RefreshNow()
+	}
+	return nil
+}
+
+// setPaused pauses or resumes the running updater, reporting whether there
+// is one.
+func (c *Client) setPaused(paused bool) bool {
+	c.updaterMu.Lock()
+	u := c.updater
+	c.updaterMu.Unlock()
+	if u == nil {
+		return false
+	}
+
+	u.mu.Lock()
+	defer u.mu.Unlock()
+
+	u.paused = paused
+	return true
+}
+
+// retryAfterIntervals bounds the wait asked for by a Retry-After header, in
+// update intervals, when backoff is disabled.
+const retryAfterIntervals = 10
+
+// capRetryAfter bounds d, the wait asked for by an update URL, by the maximum
+// backoff if enabled or otherwise by retryAfterIntervals intervals, so that a
+// single misbehaving URL can't stop updates indefinitely.
+func capRetryAfter(d, every, maxBackoff time.Duration) time.Duration {
+	limit := retryAfterIntervals * every
+	if maxBackoff > every {
+		limit = maxBackoff
+	}
+	if d > limit {
+		return limit
+	}
+	return d
+}
+
+// runUpdates until the context is canceled. err is the result of the previous
+// update, which determines how long to wait before the next.
+func (c *Client) runUpdates(
+	ctx context.Context,
+	u *updater,
+	every time.Duration,
+	err error,
+) {
+	c.mu.RLock()
+	maxBackoff := c.maxBackoff
+	fraction := c.jitter
+	rnd := c.rnd
+	clk := c.clock
+	c.mu.RUnlock()
+
+	var wait time.Duration
+	for {
+		wait = nextWait(wait, every, maxBackoff, err)
+		delay := jitter(wait, every, fraction, rnd.Float64)
+
+		// Wait as long as update URLs ask us to, so they can shed
+		// load. This doesn't affect the backoff of later updates.
+		var statusErr *statusError
+		if errors.As(err, &statusErr) && statusErr.retryAfter > 0 {
+			delay = capRetryAfter(statusErr.retryAfter, every,
+				maxBackoff)
+		}
+		select {
+		case <-clk.After(delay):
+		case <-ctx.Done():
+			return
+		}
+
+		// Skip updates while paused, waiting the usual interval
+		// between checks
+		if u.isPaused() {
+			err = nil
+			continue
+		}
+
+		// Failures are logged within firstURL, and the existing routes
+		// are kept
+		err = c.update(u)
+		if ctx.Err() != nil {
+			return
+		}
+	}
+}
+
+// update the routes once from the updater's URLs, along with any route
+// groups.
+func (c *Client) update(u *updater) error {
+	u.updateMu.Lock()
+	defer u.updateMu.Unlock()
+
+	routes, uri, err := c.firstURL(u.ctx, u.getURLs(), u.timeout)
+
+	// Don't apply the results of a fetch that was interrupted by
+	// StopUpdating
+	if u.ctx.Err() != nil {
+		return u.ctx.Err()
+	}
+
+	// Keep our existing routes if none arrived, so a slowdown from the
+	// reverse proxy doesn't cause an outage
+	if routes != nil {
+		c.changeRoutesFrom(uri, routes)
+	}
+	c.updateGroups(u.ctx, u.timeout)
+	return err
+}
+
+// RefreshNow updates the routes immediately rather than waiting for the next
+// scheduled update, e.g. when notified out of band that they've changed. It
+// returns once the new routes are applied, or with an error if no update URL
+// replied, in which case the existing routes are kept. Updates are serialized,
+// so it's safe to call while the updater runs. The schedule of later updates
+// is unaffected. An error is returned if the client isn't updating.
+func (c *Client) RefreshNow() error {
+	c.updaterMu.Lock()
+	u := c.updater
+	c.updaterMu.Unlock()
+	if u == nil {
+		return errors.New("not updating")
+	}
+	return c.update(u)
+}
+
+// updateTimeout returns the timeout of each update when updating every
+// interval.
+func (c *Client) updateTimeout(every time.Duration) time.Duration {
+	c.mu.RLock()
+	defer c.mu.RUnlock()
+
+	if c.fetchTimeout > 0 {
+		return c.fetchTimeout
+	}
+	return every
+}
+
+// nextWait returns how long to wait before the next update. After a failed
+// update the previous wait is doubled, up to maxBackoff, and after a
+// successful one it resets to every. A maxBackoff of zero disables backoff.
+func nextWait(prev, every, maxBackoff time.Duration, err error) time.Duration {
+	if err == nil || maxBackoff <= every || prev < every {
+		return every
+	}
+	if prev > maxBackoff/2 {
+		return maxBackoff
+	}
+	return prev * 2
+}
+
+// jitter randomizes wait by up to ±fraction of every. random returns a number
+// in [0, 1).
+func jitter(
+	wait, every time.Duration,
+	fraction float64,
+	random func() float64,
+) time.Duration {
+	if fraction == 0 {
+		return wait
+	}
+	offset := time.Duration((random()*2 - 1) * fraction * float64(every))
+	if wait+offset < 0 {
+		return 0
+	}
+	return wait + offset
+}
+
+// WithJitter randomizes each wait between updates by up to ±fraction of the
+// update interval, so that many clients started together don't refresh their
+// routes in lockstep. fraction is clamped to [0, 1]. The initial update in
+// StartUpdating is never delayed. By default there is no jitter.
+func (c *Client) WithJitter(fraction float64) *Client {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	switch {
+	case fraction < 0:
+		fraction = 0
+	case fraction > 1:
+		fraction = 1
+	}
+	c.jitter = fraction
+	return c
+}
+
+// WithBackoff makes the updater back off exponentially when every update URL
+// fails, doubling the time between updates up to max. The interval resets on
+// the next successful update. Regardless of backoff, the updater waits as
+// long as a 429 or 503 reply's Retry-After header asks before the next
+// update, up to max, or 10 update intervals without backoff.
+func (c *Client) WithBackoff(max time.Duration) *Client {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	c.maxBackoff = max
+	return c
+}
+
+// StopUpdating live backends and any health checks, blocking until they have
+// stopped. This is safe to call multiple times, even if the client isn't
+// updating.
+func (c *Client) StopUpdating() {
+	c.updaterMu.Lock()
+	u := c.updater
+	c.updater = nil
+	c.updaterMu.Unlock()
+
+	if u == nil {
+		return
+	}
+	u.cancel()
+	<-u.done
+}
+
+// Close stops updating routes and any health checks, then closes idle
+// connections of the underlying HTTPClient if it supports it, as an
+// *http.Client does. It's safe to call more than once, and on clients which
+// never started updating.
+func (c *Client) Close() error {
+	c.StopUpdating()
+	if ic, ok := c.Transport().(interface{ CloseIdleConnections() }); ok {
+		ic.CloseIdleConnections()
+	}
+	return nil
+}
+
+// noResolveKey marks a context whose requests shouldn't be resolved.
+type noResolveKey struct{}
+
+// WithoutResolution returns a copy of ctx which makes Do, DoContext and
+// RoundTripper send requests with that context unmodified, even to internal
+// hosts. This is an escape hatch for URLs which only look internal, without
+// needing a second client.
+func WithoutResolution(ctx context.Context) context.Context {
+	return context.WithValue(ctx, noResolveKey{}, true)
+}
+
+// skipResolution reports whether ctx was created by WithoutResolution.
+func skipResolution(ctx context.Context) bool {
+	skip, _ := ctx.Value(noResolveKey{}).(bool)
+	return skip
+}
+
+// resolvedIPKey is the context key of the IPs given to WithResolvedIP, keyed
+// by host.
+type resolvedIPKey struct{}
+
+// WithResolvedIP returns a copy of ctx which resolves host to ip rather than
+// selecting among its backends, e.g. to pin a canary request to a specific
+// backend or to target a known IP in tests. It applies to requests sent with
+// that context through Do, DoContext, RoundTripper and Director, which still
+// retry, trace and track the request as usual, and to ResolveHostContext.
+// Other hosts resolve normally. ip may include a port.
+func WithResolvedIP(ctx context.Context, host, ip string) context.Context {
+	prev, _ := ctx.Value(resolvedIPKey{}).(map[string]string)
+	ips := make(map[string]string, len(prev)+1)
+	for h, i := range prev {
+		ips[h] = i
+	}
+	host, _ = splitHostPort(host)
+	ips[host] = ip
+	return context.WithValue(ctx, resolvedIPKey{}, ips)
+}
+
+// isHTTP reports whether scheme is http or https, which Do retries, hedges
+// and circuit breaks.
+func isHTTP(scheme string) bool {
+	return strings.EqualFold(scheme, "http") ||
+		strings.EqualFold(scheme, "https")
+}
+
+// resolvedIP of host given to WithResolvedIP, if any.
+func resolvedIP(ctx context.Context, host string) string {
+	ips, _ := ctx.Value(resolvedIPKey{}).(map[string]string)
+	return ips[host]
+}
+
+// Do sends req, resolving internal hosts to one of their IPs. The outgoing
+// Host header keeps the original internal hostname unless req.Host is already
+// set, so servers routing by virtual host still see it.
+//
+// Requests with schemes other than http and https, such as
+// grpc://foo.internal, have their host resolved like any other but are sent
+// once through the underlying HTTPClient, without retries, hedging or circuit
+// breaking, since those assume HTTP semantics. Clients speaking other
+// protocols without an HTTPClient should resolve their URLs with ResolveHost,
+// which rewrites the host whatever the scheme.
+func (c *Client) Do(req *http.Request) (*http.Response, error) {
+	if skipResolution(req.Context()) {
+		return c.Transport().Do(req)
+	}
+	host, _ := splitHostPort(req.URL.Host)
+	c.mu.RLock()
+	host = c.canonical(host)
+	tracer := c.tracer
+	clk := c.clock
+	var breaker *circuitBreaker
+	if c.isInternal(host) && isHTTP(req.URL.Scheme) {
+		breaker = c.breaker
+	}
+	c.mu.RUnlock()
+	if breaker != nil && !breaker.allow(host, clk.Now()) {
+		return nil, &BreakerOpenError{Host: host}
+	}
+
+	span := Span(nopSpan{})
+	if tracer != nil {
+		var ctx context.Context
+		ctx, span = tracer.Start(req.Context(), host)
+		defer span.End()
+		req = req.WithContext(ctx)
+	}
+	resp, err := c.do(req, span)
+	if err != nil {
+		span.RecordError(err)
+	}
+	if breaker != nil {
+		failed := err != nil || resp.StatusCode >= 500
+		breaker.record(host, failed, clk.Now())
+	}
+	return resp, err
+}
+
+// do is Do, recording the resolution of each attempt on span.
+func (c *Client) do(req *http.Request, span Span) (*http.Response, error) {
+	c.mu.RLock()
+	retry := c.retry
+	strict := c.strict
+	failClosed := c.failClosed
+	fallback := c.publicFallback
+	hedge := c.hedge
+	c.mu.RUnlock()
+	if !isHTTP(req.URL.Scheme) {
+		retry, hedge, fallback = nil, 0, false
+	}
+
+	// Keep the original URL, so each retry can resolve it again
+	orig := *req.URL
+	var tried []string
+	for attempt := 1; ; attempt++ {
+		var host, ip string
+		uri := orig
+		req.URL, host, ip = c.resolve(req.Context(), req, "", &uri,
+			tried)
+		span.SetAttribute("lanhttp.ip", ip)
+		span.SetAttribute("lanhttp.resolve_hit", ip != "")
+		var unresolved bool
+		if ip == "" {
+			c.mu.RLock()
+			unresolved = c.isInternal(host)
+			c.mu.RUnlock()
+			switch {
+			case !unresolved:
+			case failClosed && len(c.live().routes[host]) == 0:
+				return nil, &NoRoutesError{Host: host}
+			case strict:
+				return nil, &ResolveError{Host: host}
+			}
+		} else if strict && c.allUnhealthy(host) {
+			return nil, &ResolveError{Host: host}
+		}
+		sent := req
+		if ip != "" {
+			sent = preserveHost(req, orig.Host, host)
+			sent = c.withHostAuth(sent, orig.Host, host)
+		}
+		var resp *http.Response
+		var err error
+		if hedge > 0 && ip != "" && canResend(sent) &&
+			isIdempotent(sent.Method) {
+			resp, ip, err = c.sendHedged(sent, orig, host, ip, tried,
+				hedge)
+		} else {
+			resp, err = c.send(sent, host, ip, c.Transport().Do)
+		}
+
+		// Internal hosts sent on unresolved usually fail to dial, which
+		// shouldn't look like a failure of the backend
+		if unresolved && err != nil {
+			err = &UnresolvedError{Host: host, Err: err}
+		}
+
+		// Only retry across IPs of the same internal host
+		if ip == "" || !retry.shouldRetry(attempt, req, resp, err) {
+			if ip == "" || !fallback || !isDialError(err) ||
+				rewind(req) != nil {
+				return resp, err
+			}
+
+			// Send to the original, public URL instead
+			uri := orig
+			req.URL = &uri
+			return c.Transport().Do(req)
+		}
+		if rerr := rewind(req); rerr != nil {
+			return resp, err
+		}
+		if resp != nil {
+			resp.Body.Close()
+		}
+		tried = append(tried, ip)
+	}
+}
+
+// DoContext is like Do but sends the request with the given context, which
+// bounds the whole request including any retries. The caller's request is not
+// modified.
+func (c *Client) DoContext(
+	ctx context.Context,
+	req *http.Request,
+) (*http.Response, error) {
+	return c.Do(req.WithContext(ctx))
+}
+
+// send a resolved request using fn, tracking its result. ip is empty if the
+// request wasn't resolved to a backend.
+func (c *Client) send(
+	req *http.Request,
+	host, ip string,
+	fn func(*http.Request) (*http.Response, error),
+) (*http.Response, error) {
+	if ip == "" {
+		return fn(req)
+	}
+	c.mu.RLock()
+	tracker, _ := c.balancer.(Tracker)
+	recorder, _ := c.balancer.(LatencyRecorder)
+	clk := c.clock
+	c.mu.RUnlock()
+	if recorder != nil {
+		next := fn
+		fn = func(req *http.Request) (*http.Response, error) {
+			start := clk.Now()
+			resp, err := next(req)
+			if !errors.Is(err, context.Canceled) {
+				recorder.RecordLatency(host, ip,
+					clk.Now().Sub(start), err)
+			}
+			return resp, err
+		}
+	}
+	if tracker == nil {
+		resp, err := fn(req)
+		c.observe(host, ip, resp, err)
+		return resp, err
+	}
+
+	tracker.Dispatched(host, ip)
+	resp, err := fn(req)
+	c.observe(host, ip, resp, err)
+	if err != nil {
+		tracker.Completed(host, ip)
+		return resp, err
+	}
+	resp.Body = &trackedBody{
+		ReadCloser: resp.Body,
+		done:       func() { tracker.Completed(host, ip) },
+	}
+	return resp, err
+}
+
+// trackedBody calls done once when closed.
+type trackedBody struct {
+	io.ReadCloser
+	done func()
+	once sync.Once
+}
+
+func (b *trackedBody) Close() error {
+	err := b.ReadCloser.Close()
+	b.once.Do(b.done)
+	return err
+}
+
+// observe the result of a request to a backend for health tracking. Canceled
+// requests, such as the loser of a hedged request, say nothing about the
+// backend and are ignored.
+func (c *Client) observe(
+	host, ip string,
+	resp *http.Response,
+	err error,
+) {
+	if ip == "" || errors.Is(err, context.Canceled) {
+		return
+	}
+	c.mu.RLock()
+	health := c.health
+	c.mu.RUnlock()
+	if health != nil {
+		health.observe(host, ip, resp, err)
+	}
+}
+
+// RoundTripper returns an http.RoundTripper which resolves internal hosts
+// before delegating to next. This allows lanhttp to be used with any library
+// accepting an *http.Client. If next is nil, http.DefaultTransport is used.
+func (c *Client) RoundTripper(next http.RoundTripper) http.RoundTripper {
+	if next == nil {
+		next = http.DefaultTransport
+	}
+	return &roundTripper{client: c, next: next}
+}
+
+// Transport returns the underlying HTTPClient which sends requests after
+// they're resolved, such as the *http.Client created by DefaultClient.
+func (c *Client) Transport() HTTPClient {
+	c.mu.RLock()
+	defer c.mu.RUnlock()
+
+	return c.client
+}
+
+// WithHTTPClient replaces the underlying HTTPClient, e.g. to add middleware
+// around the one returned by Transport. It's safe to call while requests are
+// in flight, which finish using the previous HTTPClient.
+func (c *Client) WithHTTPClient(client HTTPClient) *Client {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	c.client = client
+	return c
+}
+
+// HTTPClient returns an *http.Client which resolves internal hosts using this
+// client's routes. If the underlying HTTPClient is an *http.Client, its
+// transport and timeout are reused.
+func (c *Client) HTTPClient() *http.Client {
+	var (
+		next    http.RoundTripper
+		timeout time.Duration
+	)
+	if hc, ok := c.Transport().(*http.Client); ok {
+		next = hc.Transport
+		timeout = hc.Timeout
+	}
+	return &http.Client{
+		Transport: c.RoundTripper(next),
+		Timeout:   timeout,
+	}
+}
+
+type roundTripper struct {
+	client *Client
+	next   http.RoundTripper
+}
+
+// RoundTrip implements http.RoundTripper. The request is cloned before its URL
+// is rewritten, since a RoundTripper must not modify the request it's given.
+func (rt *roundTripper) RoundTrip(req *http.Request) (*http.Response, error) {
+	if skipResolution(req.Context()) {
+		return rt.next.RoundTrip(req)
+	}
+	var host, ip string
+	req = req.Clone(req.Context())
+	hostport := req.URL.Host
+	req.URL, host, ip = rt.client.resolve(req.Context(), req, "",
+		req.URL, nil)
+	if ip != "" {
+		req = preserveHost(req, hostport, host)
+		req = rt.client.withHostAuth(req, hostport, host)
+	}
+	return rt.client.send(req, host, ip, rt.next.RoundTrip)
+}
+
+// ResolveHost from a URL to a specific IP if internal, otherwise return the
+// URL unmodified. Only the host is rewritten, whatever the scheme, so URLs
+// such as grpc://foo.internal:50051 resolve to grpc://<ip>:50051 for clients
+// of other protocols to dial.
+func (c *Client) ResolveHost(uri *url.URL) *url.URL {
+	return c.ResolveHostContext(context.Background(), uri)
+}
+
+// ResolveHostContext is like ResolveHost, using any IP given to WithResolvedIP
+// in ctx. ctx also bounds any DNS fallback lookup.
+func (c *Client) ResolveHostContext(
+	ctx context.Context,
+	uri *url.URL,
+) *url.URL {
+	uri, _, _ = c.resolve(ctx, nil, "", uri, nil)
+	return uri
+}
+
+// Director returns a function for httputil.ReverseProxy's Director which
+// resolves the outgoing request's URL as ResolveHost does, and sets its Host
+// header to the internal hostport so backends see the internal hostname rather
+// than the proxy's. Set the URL to the internal target before calling it,
+// e.g.:
+//
+//	proxy := &httputil.ReverseProxy{Director: func(req *http.Request) {
+//		req.URL.Scheme = "http"
+//		req.URL.Host = "foo.internal"
+//		director(req)
+//	}}
+//
+// With the newer Rewrite API, call it on the ProxyRequest's Out request after
+// SetURL. Requests which don't target an internal host are left unmodified.
+func (c *Client) Director() func(*http.Request) {
+	return func(req *http.Request) {
+		if skipResolution(req.Context()) {
+			return
+		}
+		hostport := req.URL.Host
+		var host, ip string
+		req.URL, host, ip = c.resolve(req.Context(), req, "", req.URL,
+			nil)
+		if ip == "" {
+			return
+		}
+		*req = *withServerName(req, host)
+		req.Host = hostport
+	}
+}
+
+// Preview reports where a request to uri would be sent right now without
+// sending it: the candidate IPs the balancer would select among, in order and
+// without repeats, and a copy of uri resolved to the first of them. Unlike
+// ResolveHost, it has no side effects, so balancers, selectors, metrics and
+// traces aren't called and no DNS fallback lookup is made. If the host isn't
+// internal or has no live IPs, candidates is nil and resolved is an unmodified
+// copy of uri.
+func (c *Client) Preview(
+	uri *url.URL,
+) (resolved *url.URL, candidates []string) {
+	u := *uri
+	host, port := splitHostPort(u.Host)
+
+	c.mu.RLock()
+	host = c.canonical(host)
+	t := c.table("")
+	if t != nil && c.isInternal(host) {
+		if ips := t.candidates(host); len(ips) > 0 {
+			ips = c.filterCandidates(t, host, ips, nil)
+			seen := make(map[string]struct{}, len(ips))
+			for _, ip := range ips {
+				if _, ok := seen[ip]; ok {
+					continue
+				}
+				seen[ip] = struct{}{}
+				candidates = append(candidates, ip)
+			}
+		}
+	}
+	c.mu.RUnlock()
+
+	if len(candidates) > 0 {
+		c.rewrite(&u, host, port, candidates[0])
+	}
+	return &u, candidates
+}
+
+// AllIPs returns a copy of the URL rewritten to each live IP of its internal
+// host, as ResolveHost would for a single IP, e.g. to broadcast a request to
+// every backend. IPs currently considered unhealthy are excluded. An empty
+// slice is returned if the host isn't internal or has no live IPs.
+func (c *Client) AllIPs(uri *url.URL) []*url.URL {
+	host, port := splitHostPort(uri.Host)
+	c.mu.RLock()
+	host = c.canonical(host)
+	c.mu.RUnlock()
+	ips := c.IPs(host)
+	out := make([]*url.URL, 0, len(ips))
+	for _, ip := range ips {
+		u := *uri
+		c.rewrite(&u, host, port, ip)
+		out = append(out, &u)
+	}
+	return out
+}
+
+// resolve a URL as ResolveHost does, also reporting the internal host and the
+// IP selected for it. ip is empty if the URL was not rewritten. IPs in exclude
+// are avoided unless no other IPs are available. ctx bounds any DNS fallback
+// lookup. IPs are selected from the named route group, or the default routes
+// if group is empty. req is the request being sent, if any, for the selector.
+func (c *Client) resolve(
+	ctx context.Context,
+	req *http.Request,
+	group string,
+	uri *url.URL,
+	exclude []string,
+) (_ *url.URL, host, ip string) {
+	name, port := splitHostPort(uri.Host)
+	c.mu.RLock()
+	host = c.canonical(name)
+	c.mu.RUnlock()
+
+	// IPs may be given for either an alias or its target
+	ip = resolvedIP(ctx, name)
+	if ip == "" && host != name {
+		ip = resolvedIP(ctx, host)
+	}
+	if ip == "" {
+		ip = c.pickIP(req, group, host, exclude)
+	}
+	if ip == "" {
+		ip = c.lookupIP(ctx, host)
+	}
+	if ip == "" {
+		return uri, host, ""
+	}
+	c.rewrite(uri, host, port, ip)
+	return uri, host, ip
+}
+
+// splitHostPort of a URL host. port is empty if the host has no port. The host
+// is normalized with normalizeHost.
+func splitHostPort(hostport string) (host, port string) {
+	host, port, err := net.SplitHostPort(hostport)
+	if err != nil {
+		return normalizeHost(hostport), ""
+	}
+	return normalizeHost(host), port
+}
+
+// normalizeHost lowercases a hostname and strips any trailing dot, so that
+// e.g. "Foo.Internal." matches the routes for "foo.internal". IPs are returned
+// as-is.
+func normalizeHost(host string) string {
+	if isIP(host) {
+		return host
+	}
+	return strings.ToLower(strings.TrimSuffix(host, "."))
+}
+
+// normalizeRoutes replaces each host with its normalized form, merging the
+// IPs of hosts which normalize to the same name. routes is returned as-is if
+// every host is already normalized.
+func normalizeRoutes(routes map[string][]Backend) map[string][]Backend {
+	normal := true
+	for host := range routes {
+		if normalizeHost(host) != host {
+			normal = false
+			break
+		}
+	}
+	if normal {
+		return routes
+	}
+	out := make(map[string][]Backend, len(routes))
+	for host, bs := range routes {
+		host = normalizeHost(host)
+		out[host] = append(out[host], bs...)
+	}
+	return out
+}
+
+// rewrite a URL for an internal host to target the selected IP.
+func (c *Client) rewrite(uri *url.URL, host, port, ip string) {
+	c.mu.RLock()
+	scheme, ok := c.schemes[host]
+	if mapped, found := c.ports[host]; found {
+		port = mapped
+	}
+	c.mu.RUnlock()
+
+	uri.Host = joinHostPort(ip, port)
+	if ok {
+		uri.Scheme = scheme
+	}
+}
+
+// preserveHost returns a shallow copy of a resolved request which still sends
+// its original hostport in the Host header, so servers routing by virtual host
+// see the internal hostname rather than the IP. The hostname is also used for
+// TLS verification when dialed by DialTLS.
+func preserveHost(req *http.Request, hostport, host string) *http.Request {
+	req = withServerName(req, host)
+	if req.Host == "" {
+		req.Host = hostport
+	}
+	return req
+}
+
+// lookupIP of an internal host via DNS, if a DNS fallback is configured.
+func (c *Client) lookupIP(ctx context.Context, host string) string {
+	c.mu.RLock()
+	resolver := c.resolver
+	internal := c.isInternal(host)
+	c.mu.RUnlock()
+	if resolver == nil || !internal {
+		return ""
+	}
+	addrs, err := resolver.LookupIPAddr(ctx, host)
+	if err != nil {
+		c.log.Printf("%s: dns fallback: %s", host, err)
+		return ""
+	}
+	if len(addrs) == 0 {
+		return ""
+	}
+	return addrs[0].String()
+}
+
+// joinHostPort combines an IP and an optional port into a URL host,
+// bracketing IPv6 addresses as needed. Backends listed with their own port,
+// such as "10.0.0.1:8080", keep it in place of port.
+func joinHostPort(ip, port string) string {
+	if path, ok := socketPath(ip); ok {
+		ip = socketHost(path)
+	} else if isValidBackend(ip) && !isIP(ip) {
+		return ip
+	}
+	if port != "" {
+		return net.JoinHostPort(ip, port)
+	}
+	if isIPv6(ip) {
+		return "[" + ip + "]"
+	}
+	return ip
+}
+
+// isIPv6 reports whether ip is an IPv6 address, optionally with a zone.
+func isIPv6(ip string) bool {
+	if i := strings.LastIndexByte(ip, '%'); i >= 0 {
+		ip = ip[:i]
+	}
+	parsed := net.ParseIP(ip)
+	return parsed != nil && parsed.To4() == nil
+}
+
+func (c *Client) getIP(host string) string {
+	return c.pickIP(nil, "", host, nil)
+}
+
+// pickIP for a host from the named route group, or the default routes if
+// group is empty. IPs in exclude are avoided unless no others are available.
+// If req is set, it's passed to the selector, if any, instead of using the
+// balancer.
+func (c *Client) pickIP(
+	req *http.Request,
+	group, host string,
+	exclude []string,
+) string {
+	// Only cache selections from the default routes which are free to
+	// use any IP and don't depend on the request. The table is loaded
+	// first, so a selection made while the routes change is cached
+	// against the old table and soon replaced.
+	var t *table
+	rc := c.resolveCache()
+	if rc != nil && group == "" && len(exclude) == 0 &&
+		!c.selectsByRequest(req) {
+		t = c.live()
+		if ip, ok := rc.get(t, host); ok {
+			return ip
+		}
+	}
+	ip, candidates, trace := c.selectIP(req, group, host, exclude)
+	if ip != "" {
+		c.countSelection(host, ip)
+		if t != nil {
+			rc.set(t, host, ip)
+		}
+	}
+
+	// Trace outside of the lock, so the callback is free to use the client
+	if trace != nil {
+		trace(host, ip, candidates)
+	}
+	return ip
+}
+
+// countSelection of an IP for SelectionCounts.
+func (c *Client) countSelection(host, ip string) {
+	key := hostIP{host: host, ip: ip}
+	v, ok := c.selections.Load(key)
+	if !ok {
+		v, _ = c.selections.LoadOrStore(key, new(uint64))
+	}
+	atomic.AddUint64(v.(*uint64), 1)
+}
+
+// SelectionCounts returns how many times each IP of each internal host was
+// selected for a request or resolution since the client was created or
+// ResetSelectionCounts was last called, e.g. to check that load is spread
+// evenly. Requests reusing a sticky pin or a cached IP aren't counted, nor
+// are Preview and AllIPs.
+func (c *Client) SelectionCounts() map[string]map[string]uint64 {
+	out := map[string]map[string]uint64{}
+	c.selections.Range(func(k, v interface{}) bool {
+		key := k.(hostIP)
+		if out[key.host] == nil {
+			out[key.host] = map[string]uint64{}
+		}
+		out[key.host][key.ip] = atomic.LoadUint64(v.(*uint64))
+		return true
+	})
+	return out
+}
+
+// ResetSelectionCounts to zero. Selections made concurrently with the reset
+// may or may not be counted.
+func (c *Client) ResetSelectionCounts() {
+	c.selections.Range(func(k, _ interface{}) bool {
+		c.selections.Delete(k)
+		return true
+	})
+}
+
+// selectsByRequest reports whether the IP selected for req depends on the
+// request itself, through a selector or a RequestBalancer.
+func (c *Client) selectsByRequest(req *http.Request) bool {
+	if req == nil {
+		return false
+	}
+	c.mu.RLock()
+	defer c.mu.RUnlock()
+
+	_, ok := c.balancer.(RequestBalancer)
+	return ok || c.selector != nil
+}
+
+// selectIP as described by pickIP, also returning the candidates it selected
+// from and the resolve trace to report them to, if any. trace is nil for hosts
+// which aren't internal.
+func (c *Client) selectIP(
+	req *http.Request,
+	group, host string,
+	exclude []string,
+) (ip string, candidates []string, trace func(string, string, []string)) {
+	c.mu.RLock()
+	defer c.mu.RUnlock()
+
+	host = c.canonical(host)
+	t := c.table(group)
+	if t == nil || !c.isInternal(host) {
+		return "", nil, nil
+	}
+	trace = c.trace
+	ips := t.candidates(host)
+	if len(ips) == 0 {
+		c.metrics.ResolveMiss(host)
+		return "", nil, trace
+	}
+	c.metrics.ResolveHit(host)
+	ips = c.filterCandidates(t, host, ips, exclude)
+	metadata := func(ip string) map[string]string {
+		return t.metadata(host, ip)
+	}
+	if trace != nil {
+		candidates = append([]string{}, ips...)
+	}
+	if req != nil && c.selector != nil {
+		if ip := c.selector(req, ips); ip != "" {
+			return ip, candidates, trace
+		}
+	}
+	if rb, ok := c.balancer.(RequestBalancer); ok && req != nil {
+		return rb.PickRequest(req, host, ips), candidates, trace
+	}
+	if gb, ok := c.balancer.(GlobalBalancer); ok {
+		return gb.PickGlobal(host, ips, t.routes), candidates, trace
+	}
+	if mb, ok := c.balancer.(MetadataBalancer); ok {
+		return mb.PickWithMetadata(host, ips, metadata), candidates, trace
+	}
+	return c.balancer.Pick(host, ips), candidates, trace
+}
+
+// filterCandidates of a host before the balancer selects among them, removing
+// unhealthy and excluded IPs and applying the family and zone preferences. The
+// caller must hold the read lock.
+func (c *Client) filterCandidates(
+	t *table,
+	host string,
+	ips, exclude []string,
+) []string {
+	ips = c.healthy(host, ips)
+	if len(exclude) > 0 {
+		ips = filterIPs(ips, func(ip string) bool {
+			for _, ex := range exclude {
+				if ip == ex {
+					return false
+				}
+			}
+			return true
+		})
+	}
+	if c.family != "" {
+		ips = preferFamily(ips, c.family == "ipv6")
+	}
+	if c.zone != "" {
+		ips = preferZone(ips, c.zone, func(ip string) map[string]string {
+			return t.metadata(host, ip)
+		})
+	}
+	return ips
+}
+
+// preferFamily returns the IPv6 backends if v6 is set and the IPv4 backends
+// otherwise, or all of them if none match.
+func preferFamily(ips []string, v6 bool) []string {
+	return filterIPs(ips, func(ip string) bool {
+		if host, _, err := net.SplitHostPort(ip); err == nil {
+			ip = host
+		}
+		parsed := net.ParseIP(ip)
+		return parsed != nil && (parsed.To4() == nil) == v6
+	})
+}
+
+// healthy filters out IPs of a host that are ejected or fail health checks. If
+// none are healthy, all are returned. The caller must hold the read lock.
+func (c *Client) healthy(host string, ips []string) []string {
+	if c.health != nil {
+		ips = c.health.filter(host, ips)
+	}
+	if c.checks != nil {
+		ips = c.checks.filter(host, ips)
+	}
+	return ips
+}
+
+// allUnhealthy reports whether host has live IPs and every one of them is
+// considered unhealthy, in which case selection falls back to all of them.
+func (c *Client) allUnhealthy(host string) bool {
+	c.mu.RLock()
+	defer c.mu.RUnlock()
+
+	ips := c.live().routes[host]
+	for _, ip := range ips {
+		if (c.health == nil || c.health.healthy(host, ip)) &&
+			(c.checks == nil || c.checks.healthy(host, ip)) {
+			return false
+		}
+	}
+	return len(ips) > 0
+}
+
+// IPs returns a copy of the live IPs of an internal host, excluding any
+// currently considered unhealthy. host may include a port. An empty slice is
+// returned if the host isn't internal or has no live IPs.
+func (c *Client) IPs(host string) []string {
+	host, _ = splitHostPort(host)
+
+	c.mu.RLock()
+	defer c.mu.RUnlock()
+
+	host = c.canonical(host)
+	if !c.isInternal(host) {
+		return []string{}
+	}
+	ips := c.live().routes[host]
+	if len(ips) == 0 {
+		return []string{}
+	}
+	return append([]string{}, c.healthy(host, ips)...)
+}
+
+// Routes returns a copy of all live backend IPs.
+func (c *Client) Routes() Routes {
+	return copyRoutes(c.live().routes)
+}
+
+// RoutesVersion returns a fingerprint of the live routes, e.g. to check that
+// instances agree on their routes without comparing whole tables. It doesn't
+// depend on the order of hosts or IPs, and changes whenever the routes change
+// as reported to OnChange, barring hash collisions. Backend weights and
+// metadata aren't included.
+func (c *Client) RoutesVersion() uint64 {
+	return c.live().routesVersion()
+}
+
+// RoutesHandler returns an http.Handler which serves the client's current
+// routes as JSON on GET, e.g. for an admin endpoint. The format is the same as
+// the client consumes, so another client may update its routes from it.
+func (c *Client) RoutesHandler() http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != http.MethodGet && r.Method != http.MethodHead {
+			w.Header().Set("Allow", "GET, HEAD")
+			http.Error(w, "method not allowed",
+				http.StatusMethodNotAllowed)
+			return
+		}
+		byt, err := json.Marshal(c.Routes())
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+		w.Header().Set("Content-Type", "application/json")
+		_, _ = w.Write(byt)
+	})
+}
+
+func copyRoutes(routes Routes) Routes {
+	r := make(Routes, len(routes))
+	for host, ips := range routes {
+		r[host] = append([]string{}, ips...)
+	}
+	return r
+}
+
+// Backends returns a copy of all live backends, including their weights.
+func (c *Client) Backends() map[string][]Backend {
+	return c.live().backends()
+}
+
+// Metadata returns a copy of the metadata of a host's backend, or nil if it
+// has none. host may include a port.
+func (c *Client) Metadata(host, ip string) map[string]string {
+	host, _ = splitHostPort(host)
+	return copyMetadata(c.live().metadata(host, ip))
+}
+
+func diff(a, b Routes) bool {
+	return !a.Equal(b)
+}
+
+// Equal reports whether r and other have the same hosts with the same IPs,
+// regardless of the order of IPs. Neither is modified.
+func (r Routes) Equal(other Routes) bool {
+	// Exit quickly if lengths are different
+	if len(r) != len(other) {
+		return false
+	}
+
+	// Iterate through every key in r and determine if all IPs match
+	for key, ips := range r {
+		otherIPs, ok := other[key]
+		if !ok || len(ips) != len(otherIPs) {
+			return false
+		}
+
+		// IPs are usually listed in the same order, which needs no
+		// sorting
+		if equalIPs(ips, otherIPs) {
+			continue
+		}
+
+		// Sort copies of the live backends to get better performance
+		// when comparing them. The originals may be shared with readers
+		// or still held by the caller, so they must not be reordered.
+		aIPs := sortedCopy(ips)
+		bIPs := sortedCopy(otherIPs)
+
+		// Compare two and exit on the first different string
+		for i, ip := range aIPs {
+			if bIPs[i] != ip {
+				return false
+			}
+		}
+	}
+	return true
+}
+
+// version hashes routes such that routes which are Equal hash the same.
+func (r Routes) version() uint64 {
+	// Sum the hash of every host, so their order doesn't matter
+	var sum uint64
+	var b strings.Builder
+	for host, ips := range r {
+		b.Reset()
+		b.WriteString(host)
+		for _, ip := range sortedCopy(ips) {
+			b.WriteByte(0)
+			b.WriteString(ip)
+		}
+		sum += hashKey(b.String())
+	}
+	return sum
+}
+
+// MarshalJSON encodes routes with their hosts and each host's IPs sorted, so
+// the same routes always encode identically, e.g. for comparing snapshots.
+// The routes themselves aren't reordered.
+func (r Routes) MarshalJSON() ([]byte, error) {
+	if r == nil {
+		return []byte("null"), nil
+	}
+	sorted := make(map[string][]string, len(r))
+	for host, ips := range r {
+		if ips != nil {
+			ips = sortedCopy(ips)
+		}
+		sorted[host] = ips
+	}
+
+	// encoding/json sorts the keys of maps
+	return json.Marshal(sorted)
+}
+
+// equalIPs reports whether a and b hold the same IPs in the same order.
+func equalIPs(a, b []string) bool {
+	if len(a) != len(b) {
+		return false
+	}
+	for i := range a {
+		if a[i] != b[i] {
+			return false
+		}
+	}
+	return true
+}
+
+func sortedCopy(ips []string) []string {
+	out := append([]string{}, ips...)
+	sort.Strings(out)
+	return out
 }
@@ -1,8 +1,33 @@
 package lanhttp
 
 import (
+	"bufio"
+	"bytes"
+	"compress/gzip"
+	"context"
+	"encoding/binary"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"log"
 	"math/rand"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"net/http/httputil"
+	"net/url"
+	"reflect"
+	"runtime"
+	"sort"
+	"strings"
+	"sync"
+	"sync/atomic"
 	"testing"
+	"time"
+
+	"github.com/hashicorp/go-cleanhttp"
 )
 
 func TestDiff(t *testing.T) {
@@ -59,9 +84,14 @@ func TestDiff(t *testing.T) {
 			haveB: Routes{"a": []string{"b"}},
 			want:  true,
 		},
+		"a != b empty": testcase{
+			haveA: Routes{"a": nil},
+			haveB: Routes{"b": nil},
+			want:  true,
+		},
 	}
 	for name, tc := range tcs {
-		tc := tc // capture reference
+		name, tc := name, tc // capture reference
 		t.Run(name, func(t *testing.T) {
 			t.Parallel()
 
@@ -72,10 +102,28 @@ func TestDiff(t *testing.T) {
 	}
 }
 
+func TestEqualDoesNotMutate(t *testing.T) {
+	t.Parallel()
+
+	a := Routes{"a": []string{"c", "b", "a"}}
+	b := Routes{"a": []string{"b", "a", "c"}}
+	if !a.Equal(b) {
+		t.Fatal("expected equal routes")
+	}
+	if !reflect.DeepEqual(a, Routes{"a": []string{"c", "b", "a"}}) {
+		t.Fatalf("a was mutated: %v", a)
+	}
+	if !reflect.DeepEqual(b, Routes{"a": []string{"b", "a", "c"}}) {
+		t.Fatalf("b was mutated: %v", b)
+	}
+}
+
 func TestGetIP(t *testing.T) {
+	t.Parallel()
+
 	// Set a seed to ensure our results below are consistent
-	rand.Seed(16)
-	c := NewClient(nil).WithRoutes(Routes{
+	rnd := rand.New(rand.NewSource(16))
+	c := NewClient(nil).WithRand(rnd).WithRoutes(Routes{
 		"a.internal": []string{"1", "2"},
 	})
 	if got := c.getIP("a.internal"); got != "1" {
@@ -91,3 +139,2276 @@ func TestGetIP(t *testing.T) {
 		t.Fatal("expected 2 (2nd)")
 	}
 }
+
+// routesClient serves the same routes for every request.
+type routesClient struct{ body string }
+
+func (rc routesClient) Do(req *http.Request) (*http.Response, error) {
+	return &http.Response{
+		StatusCode: http.StatusOK,
+		Body:       ioutil.NopCloser(strings.NewReader(rc.body)),
+	}, nil
+}
+
+func TestStopUpdating(t *testing.T) {
+	// Stopping when nothing is running is a no-op
+	c := NewClient(routesClient{body: `{"a.internal":["10.0.0.1"]}`})
+	c.StopUpdating()
+
+	before := runtime.NumGoroutine()
+	for i := 0; i < 100; i++ {
+		c.StartUpdating([]string{"http://a", "http://b"}, time.Millisecond)
+		c.StopUpdating()
+		c.StopUpdating()
+	}
+	if got := c.getIP("a.internal"); got != "10.0.0.1" {
+		t.Fatalf("expected 10.0.0.1, got %s", got)
+	}
+
+	// Allow any goroutines from first which lost the race to reply to
+	// finish
+	for i := 0; i < 100; i++ {
+		if runtime.NumGoroutine() <= before {
+			return
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	t.Fatalf("leaked goroutines: %d before, %d after", before,
+		runtime.NumGoroutine())
+}
+
+// idleClient counts calls to CloseIdleConnections.
+type idleClient struct {
+	routesClient
+	closed int
+}
+
+func (ic *idleClient) CloseIdleConnections() { ic.closed++ }
+
+func TestClose(t *testing.T) {
+	t.Parallel()
+
+	ic := &idleClient{
+		routesClient: routesClient{body: `{"a.internal":["10.0.0.1"]}`},
+	}
+	c := NewClient(ic)
+
+	// Closing a client which never started updating is fine
+	if err := c.Close(); err != nil {
+		t.Fatal(err)
+	}
+	if err := c.StartUpdating([]string{"http://a"}, time.Second); err != nil {
+		t.Fatal(err)
+	}
+	for i := 0; i < 2; i++ {
+		if err := c.Close(); err != nil {
+			t.Fatal(err)
+		}
+	}
+	c.updaterMu.Lock()
+	u := c.updater
+	c.updaterMu.Unlock()
+	if u != nil {
+		t.Fatal("expected updates to stop")
+	}
+	if ic.closed != 3 {
+		t.Fatalf("expected 3 closes, got %d", ic.closed)
+	}
+}
+
+func TestRoundTripper(t *testing.T) {
+	srv := httptest.NewServer(http.HandlerFunc(
+		func(w http.ResponseWriter, r *http.Request) {
+			w.WriteHeader(http.StatusNoContent)
+		}))
+	defer srv.Close()
+
+	srvURL, err := url.Parse(srv.URL)
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, port, err := net.SplitHostPort(srvURL.Host)
+	if err != nil {
+		t.Fatal(err)
+	}
+	c := NewClient(nil).WithRoutes(Routes{
+		"a.internal": []string{"127.0.0.1"},
+	})
+	req, err := http.NewRequest("GET", "http://a.internal:"+port, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp, err := c.HTTPClient().Do(req)
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusNoContent {
+		t.Fatalf("expected 204, got %d", resp.StatusCode)
+	}
+	if req.URL.Host != "a.internal:"+port {
+		t.Fatalf("request was mutated: %s", req.URL.Host)
+	}
+}
+
+func TestPreserveHost(t *testing.T) {
+	t.Parallel()
+
+	hosts := make(chan string, 1)
+	srv := httptest.NewServer(http.HandlerFunc(
+		func(w http.ResponseWriter, r *http.Request) {
+			hosts <- r.Host
+		}))
+	defer srv.Close()
+
+	srvURL, err := url.Parse(srv.URL)
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, port, err := net.SplitHostPort(srvURL.Host)
+	if err != nil {
+		t.Fatal(err)
+	}
+	c := DefaultClient(time.Second).WithRoutes(Routes{
+		"a.internal": []string{"127.0.0.1"},
+	})
+	type testcase struct {
+		host string
+		do   func(*http.Request) (*http.Response, error)
+		want string
+	}
+	tcs := map[string]testcase{
+		"do": {
+			do:   c.Do,
+			want: "a.internal:" + port,
+		},
+		"round tripper": {
+			do:   c.HTTPClient().Do,
+			want: "a.internal:" + port,
+		},
+		"explicit host": {
+			host: "vhost.example",
+			do:   c.Do,
+			want: "vhost.example",
+		},
+	}
+	for name, tc := range tcs {
+		name, tc := name, tc // capture reference
+		req, err := http.NewRequest("GET", "http://a.internal:"+port, nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+		req.Host = tc.host
+		resp, err := tc.do(req)
+		if err != nil {
+			t.Fatalf("%s: %s", name, err)
+		}
+		resp.Body.Close()
+		if got := <-hosts; got != tc.want {
+			t.Fatalf("%s: expected host %s, got %s", name, tc.want,
+				got)
+		}
+	}
+}
+
+func TestWithSuffix(t *testing.T) {
+	t.Parallel()
+
+	c := NewClient(nil).WithSuffix(".svc.cluster.local", "lan").WithRoutes(
+		Routes{
+			"a.svc.cluster.local": []string{"1"},
+			"b.lan":               []string{"2"},
+			"c.internal":          []string{"3"},
+		})
+	tcs := map[string]string{
+		"http://a.svc.cluster.local:8080": "1:8080",
+		"http://b.lan":                    "2",
+		"http://c.internal":               "c.internal",
+	}
+	for have, want := range tcs {
+		uri, err := url.Parse(have)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if got := c.ResolveHost(uri).Host; got != want {
+			t.Fatalf("%s: expected %s, got %s", have, want, got)
+		}
+	}
+	for have, want := range map[string]bool{
+		"http://a.svc.cluster.local:8080": true,
+		"http://d.lan":                    true,
+		"http://c.internal":               false,
+	} {
+		uri, err := url.Parse(have)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if got := c.IsInternal(uri); got != want {
+			t.Fatalf("%s: expected internal %t, got %t", have, want,
+				got)
+		}
+	}
+}
+
+func TestOnChange(t *testing.T) {
+	t.Parallel()
+
+	var calls int
+	c := NewClient(nil)
+	c.OnChange(func(old, new Routes) {
+		calls++
+
+		// Calling back into the client must not deadlock
+		if !reflect.DeepEqual(c.Routes(), new) {
+			t.Errorf("expected %v, got %v", new, c.Routes())
+		}
+		if len(old) != 0 {
+			t.Errorf("expected empty old routes, got %v", old)
+		}
+		new["a.internal"][0] = "changed"
+	})
+	c.changeRoutes(toBackends(Routes{"a.internal": []string{"1"}}))
+	c.changeRoutes(toBackends(Routes{"a.internal": []string{"1"}}))
+	if calls != 1 {
+		t.Fatalf("expected 1 call, got %d", calls)
+	}
+	if got := c.getIP("a.internal"); got != "1" {
+		t.Fatalf("callback mutated live routes: %s", got)
+	}
+}
+
+func TestWithVerbose(t *testing.T) {
+	t.Parallel()
+
+	var buf bytes.Buffer
+	rc := &countingRoutesClient{}
+	c := NewClient(rc).WithLogger(log.New(&buf, "", 0))
+	if err := c.StartUpdating([]string{"http://a"}, time.Minute); err != nil {
+		t.Fatal(err)
+	}
+	defer c.StopUpdating()
+	if buf.Len() != 0 {
+		t.Fatalf("expected no logs by default, got %q", buf.String())
+	}
+
+	c.WithVerbose()
+	c.changeRoutes(toBackends(Routes{"b.internal": []string{"10.0.0.9"}}))
+	if err := c.RefreshNow(); err != nil {
+		t.Fatal(err)
+	}
+	want := "routes changed from unknown source: 1 hosts, added " +
+		"[b.internal], removed [a.internal], 0 changed\n" +
+		"routes changed from http://a: 1 hosts, added [a.internal], " +
+		"removed [b.internal], 0 changed\n"
+	if got := buf.String(); got != want {
+		t.Fatalf("expected %q, got %q", want, got)
+	}
+
+	// Unchanged routes aren't logged
+	buf.Reset()
+	c.changeRoutes(c.Backends())
+	if buf.Len() != 0 {
+		t.Fatalf("expected no logs, got %q", buf.String())
+	}
+}
+
+func TestStartUpdatingError(t *testing.T) {
+	t.Parallel()
+
+	c := NewClient(routesClient{body: `{"a.internal":["1"]}`})
+	defer c.StopUpdating()
+	if err := c.StartUpdating([]string{"://bad"}, time.Second); err == nil {
+		t.Fatal("expected error")
+	}
+	err := c.StartUpdating([]string{"http://a"}, time.Second)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// Malformed URLs fail before anything is started, even alongside
+	// valid ones
+	for _, uri := range []string{"://bad", "a", "ftp://a", "http://"} {
+		err := c.StartUpdating([]string{"http://a", uri}, time.Second)
+		var urlErr *InvalidURLError
+		if !errors.As(err, &urlErr) || urlErr.URL != uri {
+			t.Fatalf("%s: expected invalid url error, got %v", uri, err)
+		}
+	}
+	if err := c.RefreshNow(); err != nil {
+		t.Fatalf("expected previous updater running, got %v", err)
+	}
+}
+
+func TestBackupURLs(t *testing.T) {
+	t.Parallel()
+
+	var primaryUp, backupCalls int32
+	primary := httptest.NewServer(http.HandlerFunc(
+		func(w http.ResponseWriter, r *http.Request) {
+			if atomic.LoadInt32(&primaryUp) == 0 {
+				w.WriteHeader(http.StatusInternalServerError)
+				return
+			}
+			_, _ = w.Write([]byte(`{"a.internal":["10.0.0.1"]}`))
+		}))
+	defer primary.Close()
+	backup := httptest.NewServer(http.HandlerFunc(
+		func(w http.ResponseWriter, r *http.Request) {
+			atomic.AddInt32(&backupCalls, 1)
+			_, _ = w.Write([]byte(`{"a.internal":["10.0.0.2"]}`))
+		}))
+	defer backup.Close()
+
+	c := DefaultClient(time.Second).WithBackupURLs([]string{backup.URL})
+	urls := []string{primary.URL}
+
+	// The backup is used while the primary is down
+	routes, _, err := c.firstURL(context.Background(), urls, time.Second)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got := routes["a.internal"]; len(got) != 1 || got[0].IP != "10.0.0.2" {
+		t.Fatalf("expected backup routes, got %v", got)
+	}
+
+	// And not otherwise
+	atomic.StoreInt32(&primaryUp, 1)
+	routes, _, err = c.firstURL(context.Background(), urls, time.Second)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got := routes["a.internal"]; len(got) != 1 || got[0].IP != "10.0.0.1" {
+		t.Fatalf("expected primary routes, got %v", got)
+	}
+	if got := atomic.LoadInt32(&backupCalls); got != 1 {
+		t.Fatalf("expected 1 backup call, got %d", got)
+	}
+}
+
+func TestFetchTimeout(t *testing.T) {
+	t.Parallel()
+
+	type testcase struct {
+		timeout time.Duration
+		want    time.Duration
+	}
+	tcs := map[string]testcase{
+		"default": {want: time.Hour},
+		"set":     {timeout: time.Second, want: time.Second},
+	}
+	for name, tc := range tcs {
+		name, tc := name, tc // capture reference
+		t.Run(name, func(t *testing.T) {
+			t.Parallel()
+
+			var deadline time.Time
+			c := NewClient(clientFunc(
+				func(req *http.Request) (*http.Response, error) {
+					deadline, _ = req.Context().Deadline()
+					return routesClient{body: "{}"}.Do(req)
+				})).WithFetchTimeout(tc.timeout)
+			start := time.Now()
+			err := c.StartUpdating([]string{"http://a"}, time.Hour)
+			if err != nil {
+				t.Fatal(err)
+			}
+			c.StopUpdating()
+			got := deadline.Sub(start)
+			if got < tc.want || got > tc.want+time.Second/2 {
+				t.Fatalf("expected timeout %s, got %s", tc.want, got)
+			}
+		})
+	}
+}
+
+func TestFetchConcurrency(t *testing.T) {
+	t.Parallel()
+
+	var (
+		mu              sync.Mutex
+		inflight, maxIn int
+	)
+	srv := httptest.NewServer(http.HandlerFunc(
+		func(w http.ResponseWriter, r *http.Request) {
+			mu.Lock()
+			inflight++
+			if inflight > maxIn {
+				maxIn = inflight
+			}
+			mu.Unlock()
+			defer func() {
+				mu.Lock()
+				inflight--
+				mu.Unlock()
+			}()
+
+			time.Sleep(10 * time.Millisecond)
+			if r.URL.Path != "/ok" {
+				w.WriteHeader(http.StatusInternalServerError)
+				return
+			}
+			_, _ = w.Write([]byte(`{"a.internal":["10.0.0.1"]}`))
+		}))
+	defer srv.Close()
+
+	urls := []string{}
+	for i := 0; i < 6; i++ {
+		urls = append(urls, fmt.Sprintf("%s/%d", srv.URL, i))
+	}
+	urls = append(urls, srv.URL+"/ok")
+	c := DefaultClient(time.Second).WithFetchConcurrency(2)
+	routes, _, err := c.firstURL(context.Background(), urls, time.Second)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(routes["a.internal"]) != 1 {
+		t.Fatalf("unexpected routes: %v", routes)
+	}
+	mu.Lock()
+	defer mu.Unlock()
+	if maxIn > 2 {
+		t.Fatalf("expected at most 2 requests in flight, got %d", maxIn)
+	}
+}
+
+func TestFirstSlowResolver(t *testing.T) {
+	t.Parallel()
+
+	// Simulate a DNS server which never replies
+	canceled := make(chan struct{}, 1)
+	resolver := &net.Resolver{
+		PreferGo: true,
+		Dial: func(ctx context.Context, _, _ string) (net.Conn, error) {
+			<-ctx.Done()
+			select {
+			case canceled <- struct{}{}:
+			default:
+			}
+			return nil, ctx.Err()
+		},
+	}
+	transport := cleanhttp.DefaultTransport()
+	configureTransport(transport, resolver)
+	c := NewClient(&http.Client{Transport: transport})
+
+	start := time.Now()
+	_, _, err := c.firstURL(context.Background(),
+		[]string{"http://slow.example"}, 50*time.Millisecond)
+	if err == nil {
+		t.Fatal("expected error")
+	}
+	if elapsed := time.Since(start); elapsed > time.Second {
+		t.Fatalf("update took %s", elapsed)
+	}
+	select {
+	case <-canceled:
+	case <-time.After(time.Second):
+		t.Fatal("dns lookup outlived the update")
+	}
+}
+
+// fakeDNS answers A queries over stream connections with ips, and every
+// other query with no records. It counts the queries it answers.
+func fakeDNS(queries *int32, ips ...net.IP) func(
+	context.Context, string, string,
+) (net.Conn, error) {
+	return func(context.Context, string, string) (net.Conn, error) {
+		client, server := net.Pipe()
+		go func() {
+			defer server.Close()
+			for serveDNS(server, queries, ips) {
+			}
+		}()
+		return client, nil
+	}
+}
+
+// serveDNS answers a single length-prefixed query on conn, reporting whether
+// it succeeded.
+func serveDNS(conn net.Conn, queries *int32, ips []net.IP) bool {
+	var n uint16
+	if err := binary.Read(conn, binary.BigEndian, &n); err != nil {
+		return false
+	}
+	query := make([]byte, n)
+	if _, err := io.ReadFull(conn, query); err != nil {
+		return false
+	}
+	atomic.AddInt32(queries, 1)
+
+	// The question ends at the root label, followed by its type and class
+	end := 12
+	for query[end] != 0 {
+		end += int(query[end]) + 1
+	}
+	end += 5
+	var answers []net.IP
+	if binary.BigEndian.Uint16(query[end-4:]) == 1 {
+		answers = ips
+	}
+	resp := append([]byte{}, query[:2]...)
+	resp = append(resp, 0x81, 0x80, 0, 1, 0, byte(len(answers)), 0, 0, 0, 0)
+	resp = append(resp, query[12:end]...)
+	for _, ip := range answers {
+		resp = append(resp, 0xc0, 12, 0, 1, 0, 1, 0, 0, 0, 60, 0, 4)
+		resp = append(resp, ip.To4()...)
+	}
+	msg := make([]byte, 2, 2+len(resp))
+	binary.BigEndian.PutUint16(msg, uint16(len(resp)))
+	_, err := conn.Write(append(msg, resp...))
+	return err == nil
+}
+
+func TestWithDNSFallback(t *testing.T) {
+	t.Parallel()
+
+	var got string
+	hc := clientFunc(func(req *http.Request) (*http.Response, error) {
+		got = req.URL.Host
+		if err := req.Context().Err(); err != nil {
+			return nil, err
+		}
+		return routesClient{}.Do(req)
+	})
+	send := func(c *Client, ctx context.Context, uri string) error {
+		t.Helper()
+		req, err := http.NewRequestWithContext(ctx, "GET", uri, nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+		resp, err := c.Do(req)
+		if err == nil {
+			resp.Body.Close()
+		}
+		return err
+	}
+
+	// Hosts without routes use the first record
+	var queries int32
+	c := NewClient(hc).
+		WithRoutes(Routes{"a.internal": []string{"10.0.0.1"}}).
+		WithDNSFallback(&net.Resolver{
+			PreferGo: true,
+			Dial: fakeDNS(&queries, net.IPv4(10, 0, 0, 8),
+				net.IPv4(10, 0, 0, 9)),
+		})
+	err := send(c, context.Background(), "http://b.internal:8080/x")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got != "10.0.0.8:8080" {
+		t.Fatalf("expected 10.0.0.8:8080, got %s", got)
+	}
+
+	// Hosts with routes and external hosts never look up
+	atomic.StoreInt32(&queries, 0)
+	for _, uri := range []string{"http://a.internal", "http://x.com"} {
+		if err = send(c, context.Background(), uri); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if n := atomic.LoadInt32(&queries); n != 0 {
+		t.Fatalf("expected no lookups, got %d", n)
+	}
+
+	// Failed lookups are logged and leave the URL unresolved
+	var buf bytes.Buffer
+	c = NewClient(hc).
+		WithLogger(log.New(&buf, "", 0)).
+		WithDNSFallback(&net.Resolver{
+			PreferGo: true,
+			Dial: func(context.Context, string, string) (net.Conn,
+				error) {
+				return nil, errors.New("refused")
+			},
+		})
+	err = send(c, context.Background(), "http://b.internal")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got != "b.internal" {
+		t.Fatalf("expected b.internal, got %s", got)
+	}
+	if !strings.Contains(buf.String(), "b.internal: dns fallback:") {
+		t.Fatalf("expected lookup error logged, got %q", buf.String())
+	}
+
+	// The request's context cancels the lookup
+	dialed := make(chan struct{}, 1)
+	c = NewClient(hc).
+		WithLogger(log.New(ioutil.Discard, "", 0)).
+		WithDNSFallback(&net.Resolver{
+			PreferGo: true,
+			Dial: func(ctx context.Context, _, _ string) (net.Conn,
+				error) {
+				select {
+				case dialed <- struct{}{}:
+				default:
+				}
+				<-ctx.Done()
+				return nil, ctx.Err()
+			},
+		})
+	ctx, cancel := context.WithCancel(context.Background())
+	go func() {
+		<-dialed
+		cancel()
+	}()
+	start := time.Now()
+	if err := send(c, ctx, "http://b.internal"); err == nil {
+		t.Fatal("expected error")
+	}
+	if elapsed := time.Since(start); elapsed > time.Second {
+		t.Fatalf("lookup took %s", elapsed)
+	}
+}
+
+func TestFetchETag(t *testing.T) {
+	t.Parallel()
+
+	var calls int
+	srv := httptest.NewServer(http.HandlerFunc(
+		func(w http.ResponseWriter, r *http.Request) {
+			calls++
+			if r.Header.Get("If-None-Match") == `"v1"` {
+				w.WriteHeader(http.StatusNotModified)
+				return
+			}
+			w.Header().Set("ETag", `"v1"`)
+			_, _ = w.Write([]byte(`{"a.internal":["10.0.0.1"]}`))
+		}))
+	defer srv.Close()
+
+	cc := &countingCollector{}
+	c := DefaultClient(time.Second).WithCollector(cc)
+	for i := 0; i < 2; i++ {
+		routes, _, err := c.firstURL(context.Background(),
+			[]string{srv.URL}, time.Second)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if routes != nil {
+			c.changeRoutes(routes)
+		}
+		if got := c.getIP("a.internal"); got != "10.0.0.1" {
+			t.Fatalf("%d: expected 10.0.0.1, got %s", i, got)
+		}
+	}
+	if calls != 2 || cc.succeeded != 1 || cc.notModified != 1 {
+		t.Fatalf("unexpected counts: %d calls, %d succeeded, "+
+			"%d not modified", calls, cc.succeeded, cc.notModified)
+	}
+}
+
+func TestMergeRoutes(t *testing.T) {
+	t.Parallel()
+
+	srv1 := httptest.NewServer(http.HandlerFunc(
+		func(w http.ResponseWriter, r *http.Request) {
+			_, _ = w.Write([]byte(`{"a.internal":["10.0.0.1"]}`))
+		}))
+	defer srv1.Close()
+	srv2 := httptest.NewServer(http.HandlerFunc(
+		func(w http.ResponseWriter, r *http.Request) {
+			if r.Header.Get("If-None-Match") == `"v1"` {
+				w.WriteHeader(http.StatusNotModified)
+				return
+			}
+			w.Header().Set("ETag", `"v1"`)
+			_, _ = w.Write([]byte(`{
+				"a.internal": ["10.0.0.1", "10.0.0.2"],
+				"b.internal": ["10.0.0.3"]
+			}`))
+		}))
+	defer srv2.Close()
+
+	want := map[string][]string{
+		"a.internal": {"10.0.0.1", "10.0.0.2"},
+		"b.internal": {"10.0.0.3"},
+	}
+	c := DefaultClient(time.Second).WithMergeRoutes()
+	urls := []string{srv1.URL, srv2.URL}
+
+	// The second fetch is answered with 304 by srv2, whose routes must
+	// still be merged in
+	for i := 0; i < 2; i++ {
+		routes, _, err := c.firstURL(context.Background(), urls,
+			time.Second)
+		if err != nil {
+			t.Fatal(err)
+		}
+		got := map[string][]string{}
+		for host, backends := range routes {
+			for _, b := range backends {
+				got[host] = append(got[host], b.IP)
+			}
+		}
+		if !reflect.DeepEqual(got, want) {
+			t.Fatalf("%d: expected %v, got %v", i, want, got)
+		}
+	}
+}
+
+func TestGzipRoutes(t *testing.T) {
+	t.Parallel()
+
+	srv := httptest.NewServer(http.HandlerFunc(
+		func(w http.ResponseWriter, r *http.Request) {
+			if r.Header.Get("Accept-Encoding") != "gzip" {
+				_, _ = w.Write([]byte(`{}`))
+				return
+			}
+			w.Header().Set("Content-Encoding", "gzip")
+			gz := gzip.NewWriter(w)
+			_, _ = gz.Write([]byte(`{"a.internal":["10.0.0.1"]}`))
+			_ = gz.Close()
+		}))
+	defer srv.Close()
+
+	// Both the default transport and clients which don't decompress are
+	// supported
+	clients := map[string]HTTPClient{
+		"default": DefaultClient(time.Second).client,
+		"raw": &http.Client{Transport: &http.Transport{
+			DisableCompression: true,
+		}},
+	}
+	want := Routes{"a.internal": {"10.0.0.1"}}
+	for name, hc := range clients {
+		c := NewClient(hc)
+		routes, _, err := c.firstURL(context.Background(),
+			[]string{srv.URL}, time.Second)
+		if err != nil {
+			t.Fatalf("%s: %v", name, err)
+		}
+		c.changeRoutes(routes)
+		if got := c.Routes(); !reflect.DeepEqual(got, want) {
+			t.Fatalf("%s: expected %v, got %v", name, want, got)
+		}
+	}
+}
+
+// drainBody records whether it was read to the end before being closed.
+type drainBody struct {
+	r       io.Reader
+	drained bool
+}
+
+func (b *drainBody) Read(p []byte) (int, error) {
+	n, err := b.r.Read(p)
+	if err == io.EOF {
+		b.drained = true
+	}
+	return n, err
+}
+
+func (b *drainBody) Close() error { return nil }
+
+func TestFailedUpdateDrainsBody(t *testing.T) {
+	t.Parallel()
+
+	tcs := map[string]*http.Response{
+		"bad status": {
+			StatusCode: http.StatusInternalServerError,
+			Header:     http.Header{},
+		},
+		"decode error": {
+			StatusCode: http.StatusOK,
+			Header:     http.Header{},
+		},
+	}
+	for name, resp := range tcs {
+		name, resp := name, resp // capture reference
+		t.Run(name, func(t *testing.T) {
+			t.Parallel()
+
+			body := &drainBody{r: strings.NewReader(
+				"not json" + strings.Repeat("x", 8<<10))}
+			resp.Body = body
+			c := NewClient(clientFunc(
+				func(*http.Request) (*http.Response, error) {
+					return resp, nil
+				}))
+			_, err := c.fetch(context.Background(), "http://x")
+			if err == nil {
+				t.Fatal("expected error")
+			}
+			if !body.drained {
+				t.Fatal("expected body to be drained")
+			}
+		})
+	}
+}
+
+func TestAcceptStatus(t *testing.T) {
+	t.Parallel()
+
+	var calls int32
+	srv := httptest.NewServer(http.HandlerFunc(
+		func(w http.ResponseWriter, r *http.Request) {
+			if atomic.AddInt32(&calls, 1) == 1 {
+				_, _ = w.Write([]byte(`{"a.internal":["10.0.0.1"]}`))
+				return
+			}
+			w.WriteHeader(http.StatusNoContent)
+		}))
+	defer srv.Close()
+
+	want := Routes{"a.internal": {"10.0.0.1"}}
+	urls := []string{srv.URL}
+
+	// Without accepting 204, it fails the update
+	c := DefaultClient(time.Second)
+	for i := 0; i < 2; i++ {
+		routes, _, err := c.firstURL(context.Background(), urls,
+			time.Second)
+		if i == 1 && err == nil {
+			t.Fatal("expected error for 204")
+		}
+		if i == 0 && err != nil {
+			t.Fatal(err)
+		}
+		if routes != nil {
+			c.changeRoutes(routes)
+		}
+	}
+
+	// Accepting 204 keeps the current routes without an error
+	atomic.StoreInt32(&calls, 0)
+	c = DefaultClient(time.Second).WithAcceptStatus(http.StatusNoContent)
+	for i := 0; i < 2; i++ {
+		routes, _, err := c.firstURL(context.Background(), urls,
+			time.Second)
+		if err != nil {
+			t.Fatalf("%d: %v", i, err)
+		}
+		if routes != nil {
+			c.changeRoutes(routes)
+		}
+		if got := c.Routes(); !reflect.DeepEqual(got, want) {
+			t.Fatalf("%d: expected %v, got %v", i, want, got)
+		}
+	}
+
+	// Accepting 200 still decodes it
+	atomic.StoreInt32(&calls, 0)
+	c = DefaultClient(time.Second).
+		WithAcceptStatus(http.StatusOK, http.StatusNoContent)
+	if err := c.StartUpdating(urls, time.Hour); err != nil {
+		t.Fatal(err)
+	}
+	c.StopUpdating()
+	if got := c.Routes(); !reflect.DeepEqual(got, want) {
+		t.Fatalf("expected %v, got %v", want, got)
+	}
+
+	// When merging, URLs accepted before sending any routes keep the
+	// current routes
+	atomic.StoreInt32(&calls, 1)
+	c = DefaultClient(time.Second).
+		WithMergeRoutes().
+		WithAcceptStatus(http.StatusNoContent).
+		WithRoutes(want)
+	if err := c.StartUpdating(urls, time.Hour); err != nil {
+		t.Fatal(err)
+	}
+	c.StopUpdating()
+	if got := c.Routes(); !reflect.DeepEqual(got, want) {
+		t.Fatalf("expected %v, got %v", want, got)
+	}
+}
+
+func TestNextWait(t *testing.T) {
+	t.Parallel()
+
+	const every = time.Second
+	failed := errors.New("failed")
+	type testcase struct {
+		prev, max time.Duration
+		err       error
+		want      time.Duration
+	}
+	tcs := map[string]testcase{
+		"first": {
+			max:  time.Minute,
+			err:  failed,
+			want: every,
+		},
+		"success": {
+			prev: 8 * every,
+			max:  time.Minute,
+			want: every,
+		},
+		"no backoff": {
+			prev: every,
+			err:  failed,
+			want: every,
+		},
+		"doubles": {
+			prev: 2 * every,
+			max:  time.Minute,
+			err:  failed,
+			want: 4 * every,
+		},
+		"capped": {
+			prev: 40 * every,
+			max:  time.Minute,
+			err:  failed,
+			want: time.Minute,
+		},
+		"stay capped": {
+			prev: time.Minute,
+			max:  time.Minute,
+			err:  failed,
+			want: time.Minute,
+		},
+	}
+	for name, tc := range tcs {
+		name, tc := name, tc // capture reference
+		t.Run(name, func(t *testing.T) {
+			t.Parallel()
+
+			got := nextWait(tc.prev, every, tc.max, tc.err)
+			if got != tc.want {
+				t.Fatalf("expected %s, got %s", tc.want, got)
+			}
+		})
+	}
+}
+
+func TestJitter(t *testing.T) {
+	t.Parallel()
+
+	const every = 10 * time.Second
+	fixed := func(f float64) func() float64 {
+		return func() float64 { return f }
+	}
+	if got := jitter(every, every, 0, fixed(0)); got != every {
+		t.Fatalf("expected no jitter, got %s", got)
+	}
+	if got := jitter(every, every, 0.5, fixed(0)); got != 5*time.Second {
+		t.Fatalf("expected 5s, got %s", got)
+	}
+	got := jitter(every, every, 0.5, fixed(0.75))
+	if got != 12500*time.Millisecond {
+		t.Fatalf("expected 12.5s, got %s", got)
+	}
+	c := NewClient(nil).WithJitter(2)
+	if c.jitter != 1 {
+		t.Fatalf("expected jitter clamped to 1, got %f", c.jitter)
+	}
+}
+
+func TestStrictResolution(t *testing.T) {
+	t.Parallel()
+
+	c := NewClient(routesClient{}).WithStrictResolution()
+	req, err := http.NewRequest("GET", "http://a.internal", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, err = c.Do(req)
+	var resolveErr *ResolveError
+	if !errors.As(err, &resolveErr) || resolveErr.Host != "a.internal" {
+		t.Fatalf("expected resolve error, got %v", err)
+	}
+
+	// External hosts are unaffected
+	req, err = http.NewRequest("GET", "http://example.com", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp, err := c.Do(req)
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp.Body.Close()
+}
+
+func TestResolutionErrors(t *testing.T) {
+	t.Parallel()
+
+	dnsErr := &net.DNSError{Err: "no such host", Name: "a.internal"}
+	c := NewClient(clientFunc(
+		func(req *http.Request) (*http.Response, error) {
+			if req.URL.Host == "a.internal" {
+				return nil, dnsErr
+			}
+			return nil, errors.New("backend failed")
+		}))
+	do := func() error {
+		req, err := http.NewRequest("GET", "http://a.internal", nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+		_, err = c.Do(req)
+		return err
+	}
+
+	// Sending an unresolved host fails distinctly, keeping the cause
+	err := do()
+	if !errors.Is(err, ErrHostUnresolved) || errors.Is(err, ErrNoBackend) {
+		t.Fatalf("expected unresolved host, got %v", err)
+	}
+	var unresolved *UnresolvedError
+	if !errors.As(err, &unresolved) || unresolved.Host != "a.internal" ||
+		!errors.Is(err, dnsErr) {
+		t.Fatalf("expected dns error for a.internal, got %v", err)
+	}
+
+	// Failures of backends don't match
+	c.WithRoutes(Routes{"a.internal": []string{"10.0.0.1"}})
+	if err := do(); err == nil || errors.Is(err, ErrHostUnresolved) {
+		t.Fatalf("expected backend error, got %v", err)
+	}
+
+	c.WithRoutes(Routes{}).WithStrictResolution()
+	if err := do(); !errors.Is(err, ErrNoBackend) ||
+		!errors.Is(err, ErrHostUnresolved) {
+		t.Fatalf("expected no backend, got %v", err)
+	}
+}
+
+func TestFailClosed(t *testing.T) {
+	t.Parallel()
+
+	c := NewClient(routesClient{}).WithFailClosed()
+	req, err := http.NewRequest("GET", "http://a.internal", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, err = c.Do(req)
+	var noRoutes *NoRoutesError
+	if !errors.As(err, &noRoutes) || noRoutes.Host != "a.internal" {
+		t.Fatalf("expected no routes error, got %v", err)
+	}
+
+	// Hosts whose backends are all unhealthy are still sent to one, where
+	// strict resolution fails
+	var got string
+	c = NewClient(clientFunc(
+		func(req *http.Request) (*http.Response, error) {
+			got = req.URL.Host
+			return routesClient{}.Do(req)
+		})).
+		WithRoutes(Routes{"a.internal": []string{"10.0.0.1"}}).
+		WithHealthCheck("/health", time.Minute).
+		WithFailClosed()
+	c.checks.unhealthy[hostIP{host: "a.internal", ip: "10.0.0.1"}] =
+		struct{}{}
+	req, err = http.NewRequest("GET", "http://a.internal", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp, err := c.Do(req)
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp.Body.Close()
+	if got != "10.0.0.1" {
+		t.Fatalf("expected 10.0.0.1, got %s", got)
+	}
+
+	c.WithStrictResolution()
+	req, err = http.NewRequest("GET", "http://a.internal", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, err = c.Do(req)
+	var resolveErr *ResolveError
+	if !errors.As(err, &resolveErr) {
+		t.Fatalf("expected resolve error, got %v", err)
+	}
+}
+
+func TestDirector(t *testing.T) {
+	t.Parallel()
+
+	var host string
+	backend := httptest.NewServer(http.HandlerFunc(
+		func(w http.ResponseWriter, r *http.Request) {
+			host = r.Host
+			_, _ = w.Write([]byte(r.URL.Path))
+		}))
+	defer backend.Close()
+	backendURL, err := url.Parse(backend.URL)
+	if err != nil {
+		t.Fatal(err)
+	}
+	ip, port, err := net.SplitHostPort(backendURL.Host)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	c := NewClient(nil).WithRoutes(Routes{"a.internal": []string{ip}})
+	director := c.Director()
+	proxy := httptest.NewServer(&httputil.ReverseProxy{
+		Director: func(req *http.Request) {
+			req.URL.Scheme = "http"
+			req.URL.Host = "a.internal:" + port
+			director(req)
+		},
+	})
+	defer proxy.Close()
+
+	resp, err := http.Get(proxy.URL + "/x")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer resp.Body.Close()
+	body, err := ioutil.ReadAll(resp.Body)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if string(body) != "/x" {
+		t.Fatalf("expected /x, got %q", body)
+	}
+	if want := "a.internal:" + port; host != want {
+		t.Fatalf("expected host %s, got %s", want, host)
+	}
+}
+
+func TestAddressFamily(t *testing.T) {
+	t.Parallel()
+
+	type testcase struct {
+		family string
+		ips    []string
+		want   map[string]bool
+	}
+	tcs := map[string]testcase{
+		"ipv4": {
+			family: "ipv4",
+			ips:    []string{"10.0.0.1", "fd00::1", "[fd00::2]:80"},
+			want:   map[string]bool{"10.0.0.1": true},
+		},
+		"ipv6": {
+			family: "ipv6",
+			ips:    []string{"10.0.0.1", "fd00::1", "[fd00::2]:80"},
+			want: map[string]bool{
+				"fd00::1":      true,
+				"[fd00::2]:80": true,
+			},
+		},
+		"fallback": {
+			family: "ipv6",
+			ips:    []string{"10.0.0.1", "10.0.0.2:80"},
+			want: map[string]bool{
+				"10.0.0.1":    true,
+				"10.0.0.2:80": true,
+			},
+		},
+		"any": {
+			family: "any",
+			ips:    []string{"10.0.0.1", "fd00::1"},
+			want: map[string]bool{
+				"10.0.0.1": true,
+				"fd00::1":  true,
+			},
+		},
+	}
+	for name, tc := range tcs {
+		name, tc := name, tc // capture reference
+		t.Run(name, func(t *testing.T) {
+			t.Parallel()
+
+			c := NewClient(nil).
+				WithAddressFamily(tc.family).
+				WithBalancer(&RoundRobin{}).
+				WithRoutes(Routes{"a.internal": tc.ips})
+			got := map[string]bool{}
+			for i := 0; i < len(tc.ips); i++ {
+				got[c.getIP("a.internal")] = true
+			}
+			if !reflect.DeepEqual(got, tc.want) {
+				t.Fatalf("expected %v, got %v", tc.want, got)
+			}
+		})
+	}
+}
+
+func TestWithHTTPClient(t *testing.T) {
+	t.Parallel()
+
+	first := routesClient{}
+	c := NewClient(first).
+		WithRoutes(Routes{"a.internal": []string{"10.0.0.1"}})
+	if got := c.Transport(); got != first {
+		t.Fatalf("expected %v, got %v", first, got)
+	}
+
+	get := func() error {
+		req, err := http.NewRequest("GET", "http://a.internal", nil)
+		if err != nil {
+			return err
+		}
+		resp, err := c.Do(req)
+		if err != nil {
+			return err
+		}
+		return resp.Body.Close()
+	}
+
+	// Wrap the transport with middleware while requests are in flight
+	var hits int32
+	var wg sync.WaitGroup
+	for i := 0; i < 10; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			if err := get(); err != nil {
+				t.Error(err)
+			}
+		}()
+	}
+	next := c.Transport()
+	c.WithHTTPClient(clientFunc(
+		func(req *http.Request) (*http.Response, error) {
+			atomic.AddInt32(&hits, 1)
+			return next.Do(req)
+		}))
+	wg.Wait()
+
+	if err := get(); err != nil {
+		t.Fatal(err)
+	}
+	if atomic.LoadInt32(&hits) == 0 {
+		t.Fatal("expected requests through the new client")
+	}
+}
+
+func TestClone(t *testing.T) {
+	t.Parallel()
+
+	clk := newFakeClock()
+	rc := &countingRoutesClient{}
+	c := NewClient(rc).WithClock(clk)
+	if err := c.StartUpdating([]string{"http://a"}, time.Minute); err != nil {
+		t.Fatal(err)
+	}
+	defer c.StopUpdating()
+
+	clone := c.Clone().
+		WithBalancer(&RoundRobin{}).
+		WithScheme("a.internal", "https")
+	if got := clone.IPs("a.internal"); len(got) != 1 || got[0] != "10.0.0.1" {
+		t.Fatalf("expected shared routes, got %v", got)
+	}
+
+	// Options of the clone don't affect the original
+	uri, err := url.Parse("http://a.internal")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got := c.ResolveHost(uri).Scheme; got != "http" {
+		t.Fatalf("expected http, got %s", got)
+	}
+
+	// Stopping the clone doesn't stop the original's updates, which the
+	// clone still sees
+	clone.StopUpdating()
+	clk.next(t).ch <- clk.now
+	ctx, cancel := context.WithTimeout(context.Background(), time.Second)
+	defer cancel()
+	for {
+		got := clone.IPs("a.internal")
+		if len(got) == 1 && got[0] == "10.0.0.2" {
+			break
+		}
+		select {
+		case <-ctx.Done():
+			t.Fatalf("expected updated routes, got %v", got)
+		case <-time.After(time.Millisecond):
+		}
+	}
+
+	// Routes set on the clone are seen by the original too
+	clone.WithRoutes(Routes{"b.internal": []string{"10.0.0.9"}})
+	if got := c.IPs("b.internal"); len(got) != 1 || got[0] != "10.0.0.9" {
+		t.Fatalf("expected routes from clone, got %v", got)
+	}
+}
+
+func TestWithResolveCache(t *testing.T) {
+	t.Parallel()
+
+	clk := newFakeClock()
+	c := NewClient(nil).
+		WithClock(clk).
+		WithBalancer(&RoundRobin{}).
+		WithResolveCache(time.Second).
+		WithRoutes(Routes{"a.internal": []string{"10.0.0.1", "10.0.0.2"}})
+	for i := 0; i < 3; i++ {
+		if got := c.getIP("a.internal"); got != "10.0.0.1" {
+			t.Fatalf("%d: expected cached 10.0.0.1, got %s", i, got)
+		}
+	}
+
+	// Retries still move on to other IPs
+	if got := c.pickIP(nil, "", "a.internal",
+		[]string{"10.0.0.1"}); got != "10.0.0.2" {
+		t.Fatalf("expected 10.0.0.2, got %s", got)
+	}
+
+	// Expired IPs are selected again
+	clk.now = clk.now.Add(time.Second)
+	if got := c.getIP("a.internal"); got != "10.0.0.1" {
+		t.Fatalf("expected 10.0.0.1 after expiry, got %s", got)
+	}
+	if got := c.getIP("a.internal"); got != "10.0.0.1" {
+		t.Fatalf("expected cached 10.0.0.1, got %s", got)
+	}
+
+	// Changing routes invalidates the cache immediately
+	c.changeRoutes(toBackends(Routes{"a.internal": []string{"10.0.0.3"}}))
+	if got := c.getIP("a.internal"); got != "10.0.0.3" {
+		t.Fatalf("expected 10.0.0.3 after change, got %s", got)
+	}
+
+	c.WithResolveCache(0).
+		WithRoutes(Routes{"a.internal": []string{"10.0.0.1", "10.0.0.2"}})
+	if a, b := c.getIP("a.internal"), c.getIP("a.internal"); a == b {
+		t.Fatalf("expected no cache, got %s twice", a)
+	}
+
+	// Requests picked by a RequestBalancer or selector keep their affinity
+	ch := &ConsistentHash{Key: func(req *http.Request) string {
+		return req.Header.Get("X-Key")
+	}}
+	c.WithResolveCache(time.Second).WithBalancer(ch)
+	for i := 0; i < 2; i++ {
+		if i == 1 {
+			c.WithBalancer(&RoundRobin{}).WithSelector(
+				func(req *http.Request, ips []string) string {
+					return req.Header.Get("X-Key")
+				})
+		}
+		for _, key := range []string{"10.0.0.1", "10.0.0.2"} {
+			req, err := http.NewRequest("GET", "http://a.internal", nil)
+			if err != nil {
+				t.Fatal(err)
+			}
+			req.Header.Set("X-Key", key)
+			want := key
+			if i == 0 {
+				want = ch.PickRequest(req, "a.internal",
+					[]string{"10.0.0.1", "10.0.0.2"})
+			}
+			for j := 0; j < 3; j++ {
+				got := c.pickIP(req, "", "a.internal", nil)
+				if got != want {
+					t.Fatalf("%s: expected %s, got %s", key,
+						want, got)
+				}
+			}
+		}
+	}
+}
+
+func TestSelectionCounts(t *testing.T) {
+	t.Parallel()
+
+	c := NewClient(nil).WithBalancer(&RoundRobin{}).WithRoutes(Routes{
+		"a.internal": []string{"1", "2"},
+	})
+	for i := 0; i < 5; i++ {
+		c.getIP("a.internal")
+	}
+	c.getIP("example.com")
+	want := map[string]map[string]uint64{"a.internal": {"1": 3, "2": 2}}
+	if got := c.SelectionCounts(); !reflect.DeepEqual(got, want) {
+		t.Fatalf("expected %v, got %v", want, got)
+	}
+
+	c.ResetSelectionCounts()
+	c.getIP("a.internal")
+	want = map[string]map[string]uint64{"a.internal": {"2": 1}}
+	if got := c.SelectionCounts(); !reflect.DeepEqual(got, want) {
+		t.Fatalf("expected %v after reset, got %v", want, got)
+	}
+}
+
+func TestWithResolvedIP(t *testing.T) {
+	t.Parallel()
+
+	var got string
+	c := NewClient(clientFunc(
+		func(req *http.Request) (*http.Response, error) {
+			got = req.URL.Host
+			return routesClient{}.Do(req)
+		})).
+		WithRoutes(Routes{"a.internal": []string{"10.0.0.1"}})
+	ctx := WithResolvedIP(context.Background(), "A.internal:80",
+		"10.0.0.9")
+
+	req, err := http.NewRequestWithContext(ctx, "GET",
+		"http://a.internal:8080/x", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp, err := c.Do(req)
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp.Body.Close()
+	if got != "10.0.0.9:8080" {
+		t.Fatalf("expected 10.0.0.9:8080, got %s", got)
+	}
+
+	uri, err := url.Parse("http://a.internal/x")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got := c.ResolveHostContext(ctx, uri).Host; got != "10.0.0.9" {
+		t.Fatalf("expected 10.0.0.9, got %s", got)
+	}
+
+	// Other hosts and contexts resolve normally
+	ctx = WithResolvedIP(ctx, "b.internal", "10.0.0.8")
+	uri, err = url.Parse("http://a.internal/x")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got := c.ResolveHost(uri).Host; got != "10.0.0.1" {
+		t.Fatalf("expected 10.0.0.1, got %s", got)
+	}
+	if got := resolvedIP(ctx, "a.internal"); got != "10.0.0.9" {
+		t.Fatalf("expected 10.0.0.9 kept, got %s", got)
+	}
+}
+
+func TestCustomSchemes(t *testing.T) {
+	t.Parallel()
+
+	var got []string
+	c := NewClient(clientFunc(
+		func(req *http.Request) (*http.Response, error) {
+			got = append(got, req.URL.String())
+			return routesClient{}.Do(req)
+		})).
+		WithRoutes(Routes{
+			"a.internal": []string{"10.0.0.1"},
+			"b.internal": []string{"10.0.0.2"},
+		}).
+		WithPortMap(map[string]string{"b.internal": "9000"}).
+		WithAlias("c.internal", "a.internal").
+		WithRetry(3, func(*http.Response, error) bool { return true })
+	tcs := map[string]string{
+		"grpc://a.internal:50051":    "grpc://10.0.0.1:50051",
+		"grpc://a.internal":          "grpc://10.0.0.1",
+		"GRPC://A.internal:50051/x":  "grpc://10.0.0.1:50051/x",
+		"grpc://b.internal:50051":    "grpc://10.0.0.2:9000",
+		"redis://b.internal":         "redis://10.0.0.2:9000",
+		"grpc://c.internal:50051":    "grpc://10.0.0.1:50051",
+		"grpc://z.internal:50051":    "grpc://z.internal:50051",
+		"grpc://example.com:50051/x": "grpc://example.com:50051/x",
+	}
+	for have, want := range tcs {
+		uri, err := url.Parse(have)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if resolved := c.ResolveHost(uri).String(); resolved != want {
+			t.Fatalf("%s: expected %s, got %s", have, want, resolved)
+		}
+	}
+
+	// Do resolves other schemes too, but sends them once without retries
+	req, err := http.NewRequest("GET", "grpc://a.internal:50051/x", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp, err := c.Do(req)
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp.Body.Close()
+	if len(got) != 1 || got[0] != "grpc://10.0.0.1:50051/x" {
+		t.Fatalf("expected request sent resolved once, got %v", got)
+	}
+}
+
+func TestWithHostAuth(t *testing.T) {
+	t.Parallel()
+
+	var got string
+	c := NewClient(clientFunc(
+		func(req *http.Request) (*http.Response, error) {
+			got = req.Header.Get("Authorization")
+			return routesClient{}.Do(req)
+		})).
+		WithRoutes(Routes{
+			"a.internal": []string{"10.0.0.1"},
+			"b.internal": []string{"10.0.0.2"},
+		}).
+		WithAlias("old.internal", "a.internal").
+		WithHostAuth(map[string]string{
+			"A.internal":   "Bearer a",
+			"old.internal": "Bearer old",
+		})
+	tcs := map[string]struct {
+		uri  string
+		have string
+		want string
+	}{
+		"host":       {uri: "http://a.internal:8080", want: "Bearer a"},
+		"alias":      {uri: "http://old.internal", want: "Bearer old"},
+		"other host": {uri: "http://b.internal"},
+		"unresolved": {uri: "http://c.internal"},
+		"caller set": {
+			uri:  "http://a.internal",
+			have: "Basic x",
+			want: "Basic x",
+		},
+	}
+	for name, tc := range tcs {
+		req, err := http.NewRequest("GET", tc.uri, nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if tc.have != "" {
+			req.Header.Set("Authorization", tc.have)
+		}
+		resp, err := c.Do(req)
+		if err != nil {
+			t.Fatalf("%s: %s", name, err)
+		}
+		resp.Body.Close()
+		if got != tc.want {
+			t.Fatalf("%s: expected %q, got %q", name, tc.want, got)
+		}
+		if req.Header.Get("Authorization") != tc.have {
+			t.Fatalf("%s: caller's header was modified", name)
+		}
+	}
+}
+
+func TestWithAlias(t *testing.T) {
+	t.Parallel()
+
+	c := NewClient(nil).
+		WithAlias("gateway.internal", "api.internal").
+		WithAlias("Legacy.internal", "gateway.internal").
+		WithRoutes(Routes{"api.internal": []string{"10.0.0.1"}})
+	tcs := map[string]string{
+		"http://gateway.internal/x": "http://10.0.0.1/x",
+		"http://legacy.internal/x":  "http://10.0.0.1/x",
+		"http://other.internal/x":   "http://other.internal/x",
+	}
+	for have, want := range tcs {
+		uri, err := url.Parse(have)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if got := c.ResolveHost(uri).String(); got != want {
+			t.Fatalf("%s: expected %s, got %s", have, want, got)
+		}
+	}
+	if got := c.IPs("legacy.internal"); len(got) != 1 {
+		t.Fatalf("expected aliased IPs, got %v", got)
+	}
+
+	// Resolved IPs apply when given for either the alias or its target
+	for _, name := range []string{"gateway.internal", "api.internal"} {
+		ctx := WithResolvedIP(context.Background(), name, "10.0.0.9")
+		uri, err := url.Parse("http://gateway.internal/x")
+		if err != nil {
+			t.Fatal(err)
+		}
+		if got := c.ResolveHostContext(ctx, uri).Host; got != "10.0.0.9" {
+			t.Fatalf("%s: expected 10.0.0.9, got %s", name, got)
+		}
+	}
+
+	// Sticky pins of an alias hold while its target's IP is live
+	c.WithRoutes(Routes{"api.internal": []string{"1", "2", "3", "4"}})
+	seen := map[string]bool{}
+	for i := 0; i < 50; i++ {
+		uri, err := url.Parse("http://gateway.internal/x")
+		if err != nil {
+			t.Fatal(err)
+		}
+		seen[c.ResolveHostSticky(uri, "k").Host] = true
+	}
+	if len(seen) != 1 {
+		t.Fatalf("expected one pinned IP, got %v", seen)
+	}
+
+	// Cycles are ignored
+	c.WithAlias("api.internal", "legacy.internal")
+	if got := c.getIP("gateway.internal"); got == "" {
+		t.Fatal("expected an IP")
+	}
+}
+
+func TestPreview(t *testing.T) {
+	t.Parallel()
+
+	rr := &RoundRobin{}
+	c := NewClient(nil).WithBalancer(rr).WithRoutes(Routes{
+		"a.internal": []string{"1", "2"},
+	})
+	uri, err := url.Parse("http://a.internal/x")
+	if err != nil {
+		t.Fatal(err)
+	}
+	for i := 0; i < 3; i++ {
+		resolved, candidates := c.Preview(uri)
+		if got := resolved.String(); got != "http://1/x" {
+			t.Fatalf("%d: expected http://1/x, got %s", i, got)
+		}
+		if want := []string{"1", "2"}; !reflect.DeepEqual(
+			candidates, want) {
+			t.Fatalf("%d: expected %v, got %v", i, want, candidates)
+		}
+	}
+	if uri.Host != "a.internal" {
+		t.Fatalf("expected uri unmodified, got %s", uri)
+	}
+
+	// The round robin didn't advance
+	if got := c.getIP("a.internal"); got != "1" {
+		t.Fatalf("expected 1, got %s", got)
+	}
+
+	// External hosts aren't resolved
+	uri, err = url.Parse("http://example.com/x")
+	if err != nil {
+		t.Fatal(err)
+	}
+	resolved, candidates := c.Preview(uri)
+	if resolved.String() != uri.String() || candidates != nil {
+		t.Fatalf("expected no resolution, got %s %v", resolved,
+			candidates)
+	}
+}
+
+func TestWithHostFilter(t *testing.T) {
+	t.Parallel()
+
+	c := NewClient(routesClient{body: `{
+		"a.internal": ["10.0.0.1"],
+		"b.internal": ["10.0.0.2"],
+		"c.internal": ["10.0.0.3"]
+	}`}).WithHostFilter(func(host string) bool {
+		return host != "b.internal"
+	})
+	if err := c.StartUpdating([]string{"http://a"}, time.Minute); err != nil {
+		t.Fatal(err)
+	}
+	defer c.StopUpdating()
+	want := Routes{
+		"a.internal": []string{"10.0.0.1"},
+		"c.internal": []string{"10.0.0.3"},
+	}
+	if got := c.Routes(); !got.Equal(want) {
+		t.Fatalf("expected %v, got %v", want, got)
+	}
+}
+
+func TestWithPortMap(t *testing.T) {
+	t.Parallel()
+
+	c := NewClient(nil).
+		WithPortMap(map[string]string{
+			"a.internal": "8443",
+			"b.internal": "8443",
+		}).
+		WithRoutes(Routes{
+			"a.internal": []string{"1"},
+			"b.internal": []string{"10.0.0.2:9000"},
+		})
+	tcs := map[string]string{
+		"https://a.internal:443/x": "https://1:8443/x",
+		"https://a.internal/x":     "https://1:8443/x",
+		"https://b.internal:443/x": "https://10.0.0.2:9000/x",
+		"https://c.internal:443/x": "https://c.internal:443/x",
+	}
+	for have, want := range tcs {
+		uri, err := url.Parse(have)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if got := c.ResolveHost(uri).String(); got != want {
+			t.Fatalf("%s: expected %s, got %s", have, want, got)
+		}
+	}
+}
+
+func TestRoutesMarshalJSON(t *testing.T) {
+	t.Parallel()
+
+	routes := Routes{
+		"b.internal": []string{"10.0.0.3", "10.0.0.1", "10.0.0.2"},
+		"a.internal": []string{"10.0.0.9", "10.0.0.8"},
+		"c.internal": nil,
+	}
+	want := `{"a.internal":["10.0.0.8","10.0.0.9"],` +
+		`"b.internal":["10.0.0.1","10.0.0.2","10.0.0.3"],` +
+		`"c.internal":null}`
+	for i := 0; i < 10; i++ {
+		byt, err := json.Marshal(routes)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if string(byt) != want {
+			t.Fatalf("expected %s, got %s", want, byt)
+		}
+	}
+	if routes["b.internal"][0] != "10.0.0.3" {
+		t.Fatalf("routes were reordered: %v", routes["b.internal"])
+	}
+
+	// Routes nested in other values are sorted too
+	byt, err := json.Marshal(struct{ R Routes }{routes})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if string(byt) != `{"R":`+want+`}` {
+		t.Fatalf("unexpected nested encoding: %s", byt)
+	}
+}
+
+func TestRoutesVersion(t *testing.T) {
+	t.Parallel()
+
+	a := NewClient(nil).WithRoutes(Routes{
+		"a.internal": []string{"1", "2"},
+		"b.internal": []string{"3"},
+	})
+	b := NewClient(nil).WithRoutes(Routes{
+		"b.internal": []string{"3"},
+		"a.internal": []string{"2", "1"},
+	})
+	if a.RoutesVersion() != b.RoutesVersion() {
+		t.Fatal("expected equal routes to have the same version")
+	}
+	if NewClient(nil).RoutesVersion() == a.RoutesVersion() {
+		t.Fatal("expected empty routes to have a different version")
+	}
+	tcs := map[string]Routes{
+		"ip removed":   {"a.internal": {"1"}, "b.internal": {"3"}},
+		"ip moved":     {"a.internal": {"1", "2", "3"}, "b.internal": {}},
+		"ip repeated":  {"a.internal": {"1", "1"}, "b.internal": {"3"}},
+		"host renamed": {"a.internal": {"1", "2"}, "c.internal": {"3"}},
+	}
+	for name, routes := range tcs {
+		b.WithRoutes(routes)
+		if a.RoutesVersion() == b.RoutesVersion() {
+			t.Fatalf("%s: expected a different version", name)
+		}
+	}
+}
+
+func TestWithScheme(t *testing.T) {
+	t.Parallel()
+
+	c := NewClient(nil).
+		WithScheme("a.internal", "https").
+		WithRoutes(Routes{"a.internal": []string{"1"}})
+	tcs := map[string]string{
+		"http://a.internal/x": "https://1/x",
+		"http://b.internal/x": "http://b.internal/x",
+	}
+	for have, want := range tcs {
+		uri, err := url.Parse(have)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if got := c.ResolveHost(uri).String(); got != want {
+			t.Fatalf("expected %s, got %s", want, got)
+		}
+	}
+}
+
+func TestResolveHostIPv6(t *testing.T) {
+	t.Parallel()
+
+	c := NewClient(nil).WithRoutes(Routes{
+		"a.internal": []string{"fe80::1"},
+		"b.internal": []string{"10.0.0.1"},
+	})
+	if got := c.getIP("a.internal"); got != "fe80::1" {
+		t.Fatalf("expected fe80::1, got %s", got)
+	}
+	tcs := map[string]string{
+		"http://a.internal:8080/x": "http://[fe80::1]:8080/x",
+		"http://a.internal/x":      "http://[fe80::1]/x",
+		"http://b.internal:8080/x": "http://10.0.0.1:8080/x",
+		"http://b.internal/x":      "http://10.0.0.1/x",
+	}
+	for have, want := range tcs {
+		uri, err := url.Parse(have)
+		if err != nil {
+			t.Fatal(err)
+		}
+		got := c.ResolveHost(uri)
+		if got.String() != want {
+			t.Fatalf("expected %s, got %s", want, got)
+		}
+
+		// The result must round trip through the URL parser
+		if _, err = url.Parse(got.String()); err != nil {
+			t.Fatalf("%s: %s", got, err)
+		}
+	}
+}
+
+func TestIPs(t *testing.T) {
+	t.Parallel()
+
+	c := NewClient(nil).WithRoutes(Routes{
+		"a.internal": []string{"1", "2"},
+		"a.external": []string{"3"},
+	})
+	tcs := map[string][]string{
+		"a.internal":      {"1", "2"},
+		"a.internal:8080": {"1", "2"},
+		"b.internal":      {},
+		"a.external":      {},
+	}
+	for have, want := range tcs {
+		got := c.IPs(have)
+		if !reflect.DeepEqual(got, want) {
+			t.Fatalf("%s: expected %v, got %v", have, want, got)
+		}
+	}
+	c.IPs("a.internal")[0] = "changed"
+	if got := c.IPs("a.internal")[0]; got != "1" {
+		t.Fatalf("IPs returned live slice")
+	}
+}
+
+func TestAllIPs(t *testing.T) {
+	t.Parallel()
+
+	c := NewClient(nil).WithRoutes(Routes{
+		"a.internal": []string{"10.0.0.1", "10.0.0.2:9000"},
+	})
+	tcs := map[string][]string{
+		"http://a.internal:8080/x": {
+			"http://10.0.0.1:8080/x",
+			"http://10.0.0.2:9000/x",
+		},
+		"http://b.internal/x": {},
+		"http://example.com/": {},
+	}
+	for have, want := range tcs {
+		uri, err := url.Parse(have)
+		if err != nil {
+			t.Fatal(err)
+		}
+		got := []string{}
+		for _, u := range c.AllIPs(uri) {
+			got = append(got, u.String())
+		}
+		if !reflect.DeepEqual(got, want) {
+			t.Fatalf("%s: expected %v, got %v", have, want, got)
+		}
+		if uri.String() != have {
+			t.Fatalf("%s: url was mutated: %s", have, uri)
+		}
+	}
+}
+
+func TestUpdateHeaders(t *testing.T) {
+	t.Parallel()
+
+	srv := httptest.NewServer(http.HandlerFunc(
+		func(w http.ResponseWriter, r *http.Request) {
+			if r.Header.Get("Authorization") != "Bearer token" ||
+				r.Header.Get("X-Tenant") != "t1" {
+				w.WriteHeader(http.StatusUnauthorized)
+				return
+			}
+			_, _ = w.Write([]byte(`{"a.internal":["1"]}`))
+		}))
+	defer srv.Close()
+
+	c := DefaultClient(time.Second).
+		WithUpdateHeaders(http.Header{"Authorization": {"Bearer token"}}).
+		WithUpdateRequest(func(r *http.Request) {
+			r.Header.Set("X-Tenant", "t1")
+		})
+	_, _, err := c.firstURL(context.Background(), []string{srv.URL,
+		srv.URL},
+		time.Second)
+	if err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestWithDecoder(t *testing.T) {
+	t.Parallel()
+
+	// Parse lines of "host ip"
+	lines := func(r io.Reader) (Routes, error) {
+		routes := Routes{}
+		scanner := bufio.NewScanner(r)
+		for scanner.Scan() {
+			fields := strings.Fields(scanner.Text())
+			if len(fields) != 2 {
+				return nil, fmt.Errorf("bad line: %q", scanner.Text())
+			}
+			routes[fields[0]] = append(routes[fields[0]], fields[1])
+		}
+		return routes, scanner.Err()
+	}
+	body := "a.internal 10.0.0.1\na.internal 10.0.0.2\nb.internal 10.0.0.3\n"
+	c := NewClient(routesClient{body: body}).WithDecoder(lines)
+	routes, _, err := c.firstURL(context.Background(), []string{"http://a"},
+		time.Second)
+	if err != nil {
+		t.Fatal(err)
+	}
+	c.changeRoutes(routes)
+	want := Routes{
+		"a.internal": []string{"10.0.0.1", "10.0.0.2"},
+		"b.internal": []string{"10.0.0.3"},
+	}
+	if got := c.Routes(); !reflect.DeepEqual(got, want) {
+		t.Fatalf("expected %v, got %v", want, got)
+	}
+}
+
+func TestOnBackendRemoved(t *testing.T) {
+	t.Parallel()
+
+	var got []string
+	c := NewClient(nil).OnBackendRemoved(func(host, ip string) {
+		got = append(got, host+" "+ip)
+	})
+	c.changeRoutes(toBackends(Routes{
+		"a.internal": []string{"1", "2"},
+		"b.internal": []string{"3"},
+	}))
+	c.changeRoutes(toBackends(Routes{"a.internal": []string{"2", "4"}}))
+	sort.Strings(got)
+	want := []string{"a.internal 1", "b.internal 3"}
+	if !reflect.DeepEqual(got, want) {
+		t.Fatalf("expected %v, got %v", want, got)
+	}
+}
+
+func TestLastUpdate(t *testing.T) {
+	t.Parallel()
+
+	c := NewClient(routesClient{body: `{"a.internal":["10.0.0.1"]}`})
+	if at, _, _ := c.LastUpdate(); !at.IsZero() {
+		t.Fatal("expected zero time before any update")
+	}
+	_, _, _ = c.firstURL(context.Background(), []string{"http://a"},
+		time.Second)
+	at, uri, err := c.LastUpdate()
+	if at.IsZero() || uri != "http://a" || err != nil {
+		t.Fatalf("unexpected last update: %s %s %v", at, uri, err)
+	}
+
+	// A failure keeps the last success but reports the error
+	_, _, _ = c.firstURL(context.Background(), []string{"://bad"},
+		time.Second)
+	at2, uri, err := c.LastUpdate()
+	if !at2.Equal(at) || uri != "http://a" || err == nil {
+		t.Fatalf("unexpected last update: %s %s %v", at2, uri, err)
+	}
+}
+
+func TestWaitForRoutes(t *testing.T) {
+	t.Parallel()
+
+	c := NewClient(nil).WithRoutes(Routes{"a.internal": []string{"1"}})
+	ctx, cancel := context.WithTimeout(context.Background(),
+		10*time.Millisecond)
+	defer cancel()
+	err := c.WaitForRoutes(ctx, "a.internal", "b.internal")
+	if !errors.Is(err, context.DeadlineExceeded) {
+		t.Fatalf("expected deadline exceeded, got %v", err)
+	}
+
+	go c.changeRoutes(map[string][]Backend{
+		"a.internal": {{IP: "1"}},
+		"b.internal": {{IP: "2"}},
+	})
+	ctx, cancel = context.WithTimeout(context.Background(), time.Second)
+	defer cancel()
+	if err = c.WaitForRoutes(ctx, "a.internal", "b.internal"); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestWithoutResolution(t *testing.T) {
+	t.Parallel()
+
+	fc := &fakeClient{}
+	c := NewClient(fc).
+		WithStrictResolution().
+		WithRoutes(Routes{"a.internal": []string{"1"}})
+	req, err := http.NewRequest("GET", "http://a.internal", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	ctx := WithoutResolution(context.Background())
+	resp, err := c.DoContext(ctx, req)
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp.Body.Close()
+	if len(fc.hosts) != 1 || fc.hosts[0] != "a.internal" {
+		t.Fatalf("expected unresolved a.internal, got %v", fc.hosts)
+	}
+}
+
+func TestRoutesHandler(t *testing.T) {
+	t.Parallel()
+
+	routes := Routes{"a.internal": []string{"10.0.0.1", "10.0.0.2"}}
+	srv := httptest.NewServer(NewClient(nil).WithRoutes(routes).
+		RoutesHandler())
+	defer srv.Close()
+
+	resp, err := http.Get(srv.URL)
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp.Body.Close()
+	if got := resp.Header.Get("Content-Type"); got != "application/json" {
+		t.Fatalf("unexpected content type: %s", got)
+	}
+
+	// Another client can update from the handler
+	c := DefaultClient(time.Second)
+	got, _, err := c.firstURL(context.Background(), []string{srv.URL},
+		time.Second)
+	if err != nil {
+		t.Fatal(err)
+	}
+	c.changeRoutes(got)
+	if !reflect.DeepEqual(c.Routes(), routes) {
+		t.Fatalf("expected %v, got %v", routes, c.Routes())
+	}
+
+	resp, err = http.Post(srv.URL, "application/json", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusMethodNotAllowed {
+		t.Fatalf("expected 405, got %d", resp.StatusCode)
+	}
+}
+
+func TestWithSelector(t *testing.T) {
+	t.Parallel()
+
+	fc := &fakeClient{}
+	c := NewClient(fc).
+		WithBalancer(&RoundRobin{}).
+		WithSelector(func(req *http.Request, ips []string) string {
+			want := req.Header.Get("X-Backend")
+			for _, ip := range ips {
+				if ip == want {
+					return ip
+				}
+			}
+			return ""
+		}).
+		WithRoutes(Routes{"a.internal": []string{"1", "2", "3"}})
+	for _, backend := range []string{"2", "2", "2", "", ""} {
+		req, err := http.NewRequest("GET", "http://a.internal", nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+		req.Header.Set("X-Backend", backend)
+		resp, err := c.Do(req)
+		if err != nil {
+			t.Fatal(err)
+		}
+		resp.Body.Close()
+	}
+	want := []string{"2", "2", "2", "1", "2"}
+	if !reflect.DeepEqual(fc.hosts, want) {
+		t.Fatalf("expected %v, got %v", want, fc.hosts)
+	}
+
+	// Resolving without a request uses the balancer
+	uri, err := url.Parse("http://a.internal")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got := c.ResolveHost(uri).Host; got != "3" {
+		t.Fatalf("expected 3, got %s", got)
+	}
+}
+
+func TestNormalizeHost(t *testing.T) {
+	t.Parallel()
+
+	body := `{
+		"Foo.Internal.": ["10.0.0.1"],
+		"foo.internal": ["10.0.0.1"]
+	}`
+	c := NewClient(routesClient{body: body})
+	routes, _, err := c.firstURL(context.Background(), []string{"http://a"},
+		time.Second)
+	if err != nil {
+		t.Fatal(err)
+	}
+	c.changeRoutes(routes)
+	want := Routes{"foo.internal": []string{"10.0.0.1"}}
+	if !reflect.DeepEqual(c.Routes(), want) {
+		t.Fatalf("expected %v, got %v", want, c.Routes())
+	}
+	tcs := map[string]string{
+		"http://FOO.internal/x":       "http://10.0.0.1/x",
+		"http://foo.internal./x":      "http://10.0.0.1/x",
+		"http://Foo.Internal.:8080/x": "http://10.0.0.1:8080/x",
+	}
+	for have, want := range tcs {
+		uri, err := url.Parse(have)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !c.IsInternal(uri) {
+			t.Fatalf("%s: expected internal", have)
+		}
+		if got := c.ResolveHost(uri).String(); got != want {
+			t.Fatalf("%s: expected %s, got %s", have, want, got)
+		}
+	}
+}
+
+func TestResolveTrace(t *testing.T) {
+	t.Parallel()
+
+	type trace struct {
+		host, ip   string
+		candidates []string
+	}
+	var traces []trace
+	c := NewClient(nil).
+		WithBalancer(&RoundRobin{}).
+		WithResolveTrace(func(host, ip string, candidates []string) {
+			traces = append(traces, trace{host, ip, candidates})
+		}).
+		WithRoutes(Routes{"a.internal": []string{"1", "2"}})
+	for _, have := range []string{
+		"http://a.internal",
+		"http://b.internal",
+		"http://example.com",
+	} {
+		uri, err := url.Parse(have)
+		if err != nil {
+			t.Fatal(err)
+		}
+		c.ResolveHost(uri)
+	}
+	want := []trace{
+		{host: "a.internal", ip: "1", candidates: []string{"1", "2"}},
+		{host: "b.internal"},
+	}
+	if !reflect.DeepEqual(traces, want) {
+		t.Fatalf("expected %v, got %v", want, traces)
+	}
+}
+
+func BenchmarkChangeRoutesUnchanged(b *testing.B) {
+	routes := make(map[string][]Backend, 1000)
+	for i := 0; i < 1000; i++ {
+		host := fmt.Sprintf("%d.internal", i)
+		for j := 0; j < 10; j++ {
+			ip := fmt.Sprintf("10.0.%d.%d", i%256, j)
+			routes[host] = append(routes[host], Backend{IP: ip})
+		}
+	}
+	c := NewClient(nil)
+	c.changeRoutes(routes)
+
+	b.ReportAllocs()
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		c.changeRoutes(routes)
+	}
+}
+
+func BenchmarkUpdateNotModified(b *testing.B) {
+	routes := make(Routes, 1000)
+	for i := 0; i < 1000; i++ {
+		host := fmt.Sprintf("%d.internal", i)
+		for j := 0; j < 10; j++ {
+			ip := fmt.Sprintf("10.0.%d.%d", i%256, j)
+			routes[host] = append(routes[host], ip)
+		}
+	}
+	c := NewClient(clientFunc(
+		func(*http.Request) (*http.Response, error) {
+			return &http.Response{
+				StatusCode: http.StatusNotModified,
+				Body:       ioutil.NopCloser(strings.NewReader("")),
+			}, nil
+		})).
+		WithClock(newFakeClock()).
+		WithRoutes(routes)
+	_ = c.StartUpdating([]string{"http://a"}, time.Minute)
+	defer c.StopUpdating()
+
+	b.ReportAllocs()
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		if err := c.RefreshNow(); err != nil {
+			b.Fatal(err)
+		}
+	}
+}
+
+func BenchmarkGetIPParallel(b *testing.B) {
+	c := NewClient(nil).WithRoutes(Routes{
+		"a.internal": []string{"10.0.0.1", "10.0.0.2", "10.0.0.3"},
+	})
+	b.RunParallel(func(pb *testing.PB) {
+		for pb.Next() {
+			c.getIP("a.internal")
+		}
+	})
+}
+
+func BenchmarkResolveHostWhileUpdating(b *testing.B) {
+	c := NewClient(clientFunc(
+		func(*http.Request) (*http.Response, error) {
+			return &http.Response{
+				StatusCode: http.StatusNotModified,
+				Body:       ioutil.NopCloser(strings.NewReader("")),
+			}, nil
+		})).
+		WithClock(newFakeClock()).
+		WithRoutes(Routes{
+			"a.internal": []string{"10.0.0.1", "10.0.0.2", "10.0.0.3"},
+		})
+	_ = c.StartUpdating([]string{"http://a"}, time.Minute)
+	defer c.StopUpdating()
+
+	done := make(chan struct{})
+	stopped := make(chan struct{})
+	go func() {
+		defer close(stopped)
+		for {
+			select {
+			case <-done:
+				return
+			default:
+				_ = c.RefreshNow()
+			}
+		}
+	}()
+	defer func() {
+		close(done)
+		<-stopped
+	}()
+
+	uri := &url.URL{Scheme: "http", Host: "a.internal"}
+	b.ResetTimer()
+	b.RunParallel(func(pb *testing.PB) {
+		for pb.Next() {
+			c.ResolveHost(uri)
+		}
+	})
+}
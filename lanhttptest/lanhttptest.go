@@ -0,0 +1,39 @@
+// Package lanhttptest provides utilities for testing code using lanhttp.
+package lanhttptest
+
+import (
+	"net/http/httptest"
+
+	"egt.run/lanhttp"
+)
+
+// RouteServer is an HTTP server serving routes in the format lanhttp clients
+// request from their update URLs. Pass its URL to Client.StartUpdating.
+type RouteServer struct {
+	*httptest.Server
+
+	// routes holds the served routes. Its RoutesHandler defines the wire
+	// format.
+	routes *lanhttp.Client
+}
+
+// NewRouteServer starts and returns a new RouteServer serving routes. The
+// caller should call Close when finished, to shut it down.
+func NewRouteServer(routes lanhttp.Routes) *RouteServer {
+	s := &RouteServer{routes: lanhttp.NewClient(nil)}
+	s.SetRoutes(routes)
+	s.Server = httptest.NewServer(s.routes.RoutesHandler())
+	return s
+}
+
+// SetRoutes replaces the served routes with a copy of routes. Clients see
+// them on their next update, or immediately after calling Client.RefreshNow.
+// It's safe to call while clients are updating.
+func (s *RouteServer) SetRoutes(routes lanhttp.Routes) {
+	s.routes.WithRoutes(routes)
+}
+
+// Routes returns a copy of the served routes.
+func (s *RouteServer) Routes() lanhttp.Routes {
+	return s.routes.Routes()
+}
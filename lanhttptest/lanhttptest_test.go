@@ -0,0 +1,38 @@
+package lanhttptest
+
+import (
+	"testing"
+	"time"
+
+	"egt.run/lanhttp"
+)
+
+func TestRouteServer(t *testing.T) {
+	t.Parallel()
+
+	srv := NewRouteServer(lanhttp.Routes{
+		"a.internal": []string{"10.0.0.1"},
+	})
+	defer srv.Close()
+
+	c := lanhttp.NewClient(srv.Client())
+	if err := c.StartUpdating([]string{srv.URL}, time.Minute); err != nil {
+		t.Fatal(err)
+	}
+	defer c.StopUpdating()
+	if got := c.IPs("a.internal"); len(got) != 1 || got[0] != "10.0.0.1" {
+		t.Fatalf("expected 10.0.0.1, got %v", got)
+	}
+
+	routes := lanhttp.Routes{"b.internal": []string{"10.0.0.2", "10.0.0.3"}}
+	srv.SetRoutes(routes)
+	if err := c.RefreshNow(); err != nil {
+		t.Fatal(err)
+	}
+	if got := c.Routes(); !got.Equal(routes) {
+		t.Fatalf("expected %v, got %v", routes, got)
+	}
+	if got := srv.Routes(); !got.Equal(routes) {
+		t.Fatalf("expected server to serve %v, got %v", routes, got)
+	}
+}
@@ -0,0 +1,49 @@
+package lanhttp
+
+// Collector receives metrics about route updates and host resolution, e.g. to
+// export them to Prometheus. Implementations must be safe for concurrent use
+// and should return quickly, since ResolveHit and ResolveMiss are called on
+// every request.
+type Collector interface {
+	// RouteUpdateSucceeded is called when a URL replies with routes.
+	RouteUpdateSucceeded(url string)
+
+	// RouteUpdateNotModified is called when a URL replies that its
+	// routes haven't changed since they were last fetched.
+	RouteUpdateNotModified(url string)
+
+	// RouteUpdateFailed is called when fetching routes from a URL fails.
+	RouteUpdateFailed(url string, err error)
+
+	// RoutesChanged is called when an update changes the live routes.
+	RoutesChanged()
+
+	// ResolveHit is called when an internal host resolves to an IP.
+	ResolveHit(host string)
+
+	// ResolveMiss is called when an internal host has no live IPs.
+	ResolveMiss(host string)
+}
+
+// nopCollector discards all metrics. This is the default.
+type nopCollector struct{}
+
+func (nopCollector) RouteUpdateSucceeded(string)     {}
+func (nopCollector) RouteUpdateNotModified(string)   {}
+func (nopCollector) RouteUpdateFailed(string, error) {}
+func (nopCollector) RoutesChanged()                  {}
+func (nopCollector) ResolveHit(string)               {}
+func (nopCollector) ResolveMiss(string)              {}
+
+// WithCollector reports metrics to the given collector. Passing nil disables
+// metrics, which is the default.
+func (c *Client) WithCollector(col Collector) *Client {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	if col == nil {
+		col = nopCollector{}
+	}
+	c.metrics = col
+	return c
+}
@@ -0,0 +1,81 @@
+package lanhttp
+
+import (
+	"context"
+	"sync"
+	"testing"
+	"time"
+)
+
+type countingCollector struct {
+	mu                                                 sync.Mutex
+	succeeded, notModified, failed, changed, hit, miss int
+}
+
+func (cc *countingCollector) RouteUpdateSucceeded(string) {
+	cc.mu.Lock()
+	defer cc.mu.Unlock()
+	cc.succeeded++
+}
+
+func (cc *countingCollector) RouteUpdateNotModified(string) {
+	cc.mu.Lock()
+	defer cc.mu.Unlock()
+	cc.notModified++
+}
+
+func (cc *countingCollector) RouteUpdateFailed(string, error) {
+	cc.mu.Lock()
+	defer cc.mu.Unlock()
+	cc.failed++
+}
+
+func (cc *countingCollector) RoutesChanged() {
+	cc.mu.Lock()
+	defer cc.mu.Unlock()
+	cc.changed++
+}
+
+func (cc *countingCollector) ResolveHit(string) {
+	cc.mu.Lock()
+	defer cc.mu.Unlock()
+	cc.hit++
+}
+
+func (cc *countingCollector) ResolveMiss(string) {
+	cc.mu.Lock()
+	defer cc.mu.Unlock()
+	cc.miss++
+}
+
+func TestCollector(t *testing.T) {
+	t.Parallel()
+
+	cc := &countingCollector{}
+	c := NewClient(routesClient{body: `{"a.internal":["10.0.0.1"]}`}).
+		WithCollector(cc)
+	routes, _, err := c.firstURL(context.Background(), []string{"http://a"},
+		time.Second)
+	if err != nil {
+		t.Fatal(err)
+	}
+	c.changeRoutes(routes)
+	c.getIP("a.internal")
+	c.getIP("b.internal")
+
+	// Fetch failures are reported without a request being made
+	_, _, err = c.firstURL(context.Background(), []string{"://bad"},
+		time.Second)
+	if err == nil {
+		t.Fatal("expected error")
+	}
+
+	cc.mu.Lock()
+	defer cc.mu.Unlock()
+	if cc.succeeded != 1 || cc.failed != 1 || cc.changed != 1 ||
+		cc.hit != 1 || cc.miss != 1 {
+		t.Fatalf("unexpected counts: %d succeeded, %d failed, "+
+			"%d changed, %d hit, %d miss", cc.succeeded, cc.failed,
+			cc.changed, cc.hit, cc.miss)
+	}
+}
@@ -0,0 +1,89 @@
+package lanhttp
+
+import (
+	"errors"
+	"net/http"
+)
+
+// retry configures how Do retries failed requests against other backends.
+type retry struct {
+	attempts int
+	on       func(*http.Response, error) bool
+}
+
+// WithRetry makes Do retry failed requests to internal hosts up to a total of
+// attempts, failing over to a different IP of the same host each time. Once
+// every IP of the host has been tried, IPs are reused. retryOn reports whether
+// a request should be retried; if nil, requests are retried only on transport
+// errors. Requests are only retried if they're idempotent or their body can
+// be rewound via GetBody.
+func (c *Client) WithRetry(
+	attempts int,
+	retryOn func(*http.Response, error) bool,
+) *Client {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	if retryOn == nil {
+		retryOn = func(_ *http.Response, err error) bool {
+			return err != nil
+		}
+	}
+	c.retry = &retry{attempts: attempts, on: retryOn}
+	return c
+}
+
+// shouldRetry reports whether a request should be sent again after the given
+// attempt, which starts from 1.
+func (r *retry) shouldRetry(
+	attempt int,
+	req *http.Request,
+	resp *http.Response,
+	err error,
+) bool {
+	if r == nil || attempt >= r.attempts {
+		return false
+	}
+	if req.Context().Err() != nil {
+		return false
+	}
+	if !canResend(req) {
+		return false
+	}
+	return r.on(resp, err)
+}
+
+// canResend reports whether a request may safely be sent more than once.
+func canResend(req *http.Request) bool {
+	if req.GetBody != nil {
+		return true
+	}
+	hasBody := req.Body != nil && req.Body != http.NoBody
+	return !hasBody && isIdempotent(req.Method)
+}
+
+// rewind prepares a request to be resent, resetting its body if needed. It
+// fails if the request has a body without GetBody.
+func rewind(req *http.Request) error {
+	if req.GetBody == nil {
+		if req.Body != nil && req.Body != http.NoBody {
+			return errors.New("body cannot be rewound")
+		}
+		return nil
+	}
+	body, err := req.GetBody()
+	if err != nil {
+		return err
+	}
+	req.Body = body
+	return nil
+}
+
+func isIdempotent(method string) bool {
+	switch method {
+	case "", http.MethodGet, http.MethodHead, http.MethodOptions,
+		http.MethodTrace, http.MethodPut, http.MethodDelete:
+		return true
+	}
+	return false
+}
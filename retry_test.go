@@ -0,0 +1,148 @@
+package lanhttp
+
+import (
+	"context"
+	"errors"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"net/url"
+	"strings"
+	"testing"
+)
+
+// fakeClient fails requests to any host in fail and records every host it
+// receives.
+type fakeClient struct {
+	fail  map[string]bool
+	hosts []string
+}
+
+func (f *fakeClient) Do(req *http.Request) (*http.Response, error) {
+	f.hosts = append(f.hosts, req.URL.Host)
+	if f.fail[req.URL.Host] {
+		return nil, errors.New("failed")
+	}
+	return &http.Response{
+		StatusCode: http.StatusOK,
+		Body:       ioutil.NopCloser(strings.NewReader("")),
+	}, nil
+}
+
+func TestRetry(t *testing.T) {
+	t.Parallel()
+
+	fc := &fakeClient{fail: map[string]bool{"1": true}}
+	c := NewClient(fc).
+		WithBalancer(&RoundRobin{}).
+		WithRetry(3, nil).
+		WithRoutes(Routes{"a.internal": []string{"1", "2"}})
+
+	req, err := http.NewRequest("GET", "http://a.internal", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp, err := c.Do(req)
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp.Body.Close()
+	if len(fc.hosts) != 2 || fc.hosts[0] != "1" || fc.hosts[1] != "2" {
+		t.Fatalf("expected failover from 1 to 2, got %v", fc.hosts)
+	}
+
+	// Requests which can't be safely resent aren't retried
+	fc.hosts = nil
+	req, err = http.NewRequest("POST", "http://a.internal",
+		ioutil.NopCloser(strings.NewReader("body")))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err = c.Do(req); err == nil {
+		t.Fatal("expected error")
+	}
+	if len(fc.hosts) != 1 {
+		t.Fatalf("expected a single attempt, got %v", fc.hosts)
+	}
+}
+
+func TestDoContext(t *testing.T) {
+	t.Parallel()
+
+	fc := &fakeClient{fail: map[string]bool{"1": true, "2": true}}
+	c := NewClient(fc).
+		WithRetry(5, nil).
+		WithRoutes(Routes{"a.internal": []string{"1", "2"}})
+	req, err := http.NewRequest("GET", "http://a.internal", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// A canceled context stops retries after the first attempt
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	if _, err = c.DoContext(ctx, req); err == nil {
+		t.Fatal("expected error")
+	}
+	if len(fc.hosts) != 1 {
+		t.Fatalf("expected a single attempt, got %v", fc.hosts)
+	}
+	if req.URL.Host != "a.internal" {
+		t.Fatalf("request was mutated: %s", req.URL.Host)
+	}
+}
+
+// dialFailClient fails to dial any host in fail and records every host it
+// receives.
+type dialFailClient struct {
+	fail  map[string]bool
+	hosts []string
+}
+
+func (f *dialFailClient) Do(req *http.Request) (*http.Response, error) {
+	f.hosts = append(f.hosts, req.URL.Host)
+	if f.fail[req.URL.Host] {
+		return nil, &url.Error{Op: "Get", URL: req.URL.String(),
+			Err: &net.OpError{Op: "dial", Err: errors.New("refused")}}
+	}
+	return &http.Response{
+		StatusCode: http.StatusOK,
+		Body:       ioutil.NopCloser(strings.NewReader("")),
+	}, nil
+}
+
+func TestPublicFallback(t *testing.T) {
+	t.Parallel()
+
+	fc := &dialFailClient{fail: map[string]bool{"1": true}}
+	c := NewClient(fc).
+		WithPublicFallback().
+		WithRoutes(Routes{"a.internal": []string{"1"}})
+	req, err := http.NewRequest("POST", "http://a.internal",
+		strings.NewReader("body"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp, err := c.Do(req)
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp.Body.Close()
+	if len(fc.hosts) != 2 || fc.hosts[1] != "a.internal" {
+		t.Fatalf("expected fallback to a.internal, got %v", fc.hosts)
+	}
+
+	// Bodies which can't be rewound aren't sent again
+	fc.hosts = nil
+	req, err = http.NewRequest("POST", "http://a.internal",
+		ioutil.NopCloser(strings.NewReader("body")))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err = c.Do(req); err == nil {
+		t.Fatal("expected error")
+	}
+	if len(fc.hosts) != 1 {
+		t.Fatalf("expected a single attempt, got %v", fc.hosts)
+	}
+}
@@ -0,0 +1,120 @@
+package lanhttp
+
+import (
+	"context"
+	"net/url"
+	"time"
+)
+
+// stickyLookupTimeout bounds the DNS fallback lookup of ResolveHostSticky
+const stickyLookupTimeout = 5 * time.Second
+
+type pinKey struct{ key, host string }
+
+// pin is the IP selected for a host under a sticky key.
+type pin struct {
+	ip string
+
+	// avoid are IPs previously pinned and then unpinned for this key
+	avoid []string
+}
+
+// ResolveHostSticky is like ResolveHost, but the IP selected for the URL's
+// host is remembered under key, so that every call with the same key and host
+// resolves to the same IP for as long as it remains live. This keeps retries
+// of one logical request predictable. Aliases share the pins of their target.
+// Call Unpin to move the key to a different IP, and Release once the key is
+// no longer needed.
+func (c *Client) ResolveHostSticky(uri *url.URL, key string) *url.URL {
+	host, port := splitHostPort(uri.Host)
+	c.mu.RLock()
+	host = c.canonical(host)
+	c.mu.RUnlock()
+	pk := pinKey{key: key, host: host}
+
+	var pinned string
+	var avoid []string
+	c.pinMu.Lock()
+	if p, ok := c.pins[pk]; ok {
+		pinned = p.ip
+		avoid = append([]string{}, p.avoid...)
+	}
+	c.pinMu.Unlock()
+
+	ip := pinned
+	if ip == "" || !c.isLive(host, ip) {
+		// Select outside of the lock, so trace callbacks are free to
+		// use the client and a slow DNS fallback doesn't hold up
+		// every other key
+		ip = c.pickIP(nil, "", host, avoid)
+		if ip == "" {
+			ctx, cancel := context.WithTimeout(context.Background(),
+				stickyLookupTimeout)
+			ip = c.lookupIP(ctx, host)
+			cancel()
+		}
+		ip = c.storePin(pk, pinned, ip)
+	}
+	if ip == "" {
+		return uri
+	}
+	c.rewrite(uri, host, port, ip)
+	return uri
+}
+
+// storePin records ip as the pin for pk, returning the IP now pinned. If
+// another call pinned a live IP since pinned was read, that IP wins, so that
+// concurrent calls with the same key agree.
+func (c *Client) storePin(pk pinKey, pinned, ip string) string {
+	c.pinMu.Lock()
+	defer c.pinMu.Unlock()
+
+	p, ok := c.pins[pk]
+	if !ok {
+		p = &pin{}
+		c.pins[pk] = p
+	}
+	if p.ip != "" && p.ip != pinned && c.isLive(pk.host, p.ip) {
+		return p.ip
+	}
+	p.ip = ip
+	return ip
+}
+
+// Unpin the IPs selected for key, such as after a request to one failed. The
+// next call to ResolveHostSticky with this key selects a different IP,
+// avoiding every IP previously pinned to it where possible.
+func (c *Client) Unpin(key string) {
+	c.pinMu.Lock()
+	defer c.pinMu.Unlock()
+
+	for pk, p := range c.pins {
+		if pk.key != key || p.ip == "" {
+			continue
+		}
+		p.avoid = append(p.avoid, p.ip)
+		p.ip = ""
+	}
+}
+
+// Release forgets every IP selected for key.
+func (c *Client) Release(key string) {
+	c.pinMu.Lock()
+	defer c.pinMu.Unlock()
+
+	for pk := range c.pins {
+		if pk.key == key {
+			delete(c.pins, pk)
+		}
+	}
+}
+
+// isLive reports whether ip is among the live backends of host.
+func (c *Client) isLive(host, ip string) bool {
+	for _, liveIP := range c.live().routes[host] {
+		if liveIP == ip {
+			return true
+		}
+	}
+	return false
+}
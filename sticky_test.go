@@ -0,0 +1,81 @@
+package lanhttp
+
+import (
+	"net/url"
+	"testing"
+	"time"
+)
+
+func TestResolveHostSticky(t *testing.T) {
+	t.Parallel()
+
+	c := NewClient(nil).WithRoutes(Routes{
+		"a.internal": []string{"1", "2", "3"},
+	})
+	resolve := func(key string) string {
+		uri, err := url.Parse("http://a.internal")
+		if err != nil {
+			t.Fatal(err)
+		}
+		return c.ResolveHostSticky(uri, key).Host
+	}
+	first := resolve("k")
+	for i := 0; i < 10; i++ {
+		if got := resolve("k"); got != first {
+			t.Fatalf("%d: expected %s, got %s", i, first, got)
+		}
+	}
+
+	// Unpinning avoids previously selected IPs
+	seen := map[string]bool{first: true}
+	for i := 0; i < 2; i++ {
+		c.Unpin("k")
+		got := resolve("k")
+		if seen[got] {
+			t.Fatalf("%d: reused unpinned IP %s", i, got)
+		}
+		seen[got] = true
+	}
+
+	c.Release("k")
+	if n := len(c.pins); n != 0 {
+		t.Fatalf("expected no pins after release, got %d", n)
+	}
+}
+
+func TestResolveHostStickyReentrant(t *testing.T) {
+	t.Parallel()
+
+	c := NewClient(nil).WithRoutes(Routes{
+		"a.internal": []string{"1", "2", "3"},
+		"b.internal": []string{"4"},
+	})
+	c.WithResolveTrace(func(host, ip string, candidates []string) {
+		if host != "a.internal" {
+			return
+		}
+		uri, err := url.Parse("http://b.internal")
+		if err != nil {
+			t.Error(err)
+			return
+		}
+		c.ResolveHostSticky(uri, "k")
+	})
+
+	done := make(chan string)
+	go func() {
+		uri, err := url.Parse("http://a.internal")
+		if err != nil {
+			t.Error(err)
+		}
+		done <- c.ResolveHostSticky(uri, "k").Host
+	}()
+	select {
+	case got := <-done:
+		if got == "a.internal" {
+			t.Fatal("expected an IP to be selected")
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("deadlocked calling ResolveHostSticky from a trace")
+	}
+}
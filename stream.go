@@ -0,0 +1,151 @@
+package lanhttp
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"time"
+
+	"github.com/hashicorp/go-cleanhttp"
+)
+
+// RouteSource pushes routes to the client as they change, as an alternative
+// to polling with StartUpdating.
+type RouteSource interface {
+	// Subscribe returns a channel which receives the complete routes each
+	// time they change. The channel should be closed once ctx is done.
+	Subscribe(ctx context.Context) (<-chan Routes, error)
+}
+
+// StartStreaming routes from src in the background until ctx is canceled or
+// src closes its channel. Each set of routes received replaces the live
+// routes, after normalizing hosts and dropping duplicate and invalid backends
+// as for routes fetched by StartUpdating. An error is returned if subscribing
+// to src fails.
+func (c *Client) StartStreaming(ctx context.Context, src RouteSource) error {
+	ch, err := src.Subscribe(ctx)
+	if err != nil {
+		return fmt.Errorf("subscribe: %w", err)
+	}
+	go func() {
+		for {
+			select {
+			case routes, ok := <-ch:
+				if !ok {
+					return
+				}
+				bs := dedupeBackends(normalizeRoutes(
+					toBackends(routes)))
+				c.dropInvalid("stream", bs)
+				c.filterHosts(bs)
+				c.changeRoutesFrom("stream", bs)
+			case <-ctx.Done():
+				return
+			}
+		}
+	}()
+	return nil
+}
+
+// LongPoll is a RouteSource which repeatedly requests routes from a URL,
+// serving the same JSON format as StartUpdating. Each request carries the
+// ETag of the last routes received in If-None-Match, so the server may hold
+// the request open until the routes change, replying 304 Not Modified if they
+// don't change within its own timeout.
+type LongPoll struct {
+	URL string
+
+	// Client used to make requests. If nil, a client without a timeout is
+	// used, since the server is expected to hold requests open.
+	Client HTTPClient
+
+	// RetryWait is how long to wait after a failed request before trying
+	// again, and the least time between the start of successive requests,
+	// so a server replying without holding requests open isn't polled in
+	// a busy loop. Defaults to one second.
+	RetryWait time.Duration
+
+	// Log receives errors from failed requests, if set.
+	Log Logger
+}
+
+func (lp *LongPoll) Subscribe(ctx context.Context) (<-chan Routes, error) {
+	req, err := http.NewRequestWithContext(ctx, "GET", lp.URL, nil)
+	if err != nil {
+		return nil, fmt.Errorf("new request: %w", err)
+	}
+	client := lp.Client
+	if client == nil {
+		client = cleanhttp.DefaultClient()
+	}
+	retryWait := lp.RetryWait
+	if retryWait <= 0 {
+		retryWait = time.Second
+	}
+	log := &logger{l: lp.Log}
+
+	ch := make(chan Routes)
+	go func() {
+		defer close(ch)
+
+		var etag string
+		for ctx.Err() == nil {
+			start := time.Now()
+			routes, newETag, err := lp.poll(client, req, etag)
+			if err != nil {
+				log.Printf("%s: %s", lp.URL, err)
+				select {
+				case <-time.After(retryWait):
+				case <-ctx.Done():
+				}
+				continue
+			}
+			if routes != nil {
+				etag = newETag
+				select {
+				case ch <- routes:
+				case <-ctx.Done():
+				}
+			}
+			select {
+			case <-time.After(retryWait - time.Since(start)):
+			case <-ctx.Done():
+			}
+		}
+	}()
+	return ch, nil
+}
+
+// poll the URL once. routes is nil if the server replied 304 Not Modified.
+func (lp *LongPoll) poll(
+	client HTTPClient,
+	req *http.Request,
+	etag string,
+) (Routes, string, error) {
+	req = req.Clone(req.Context())
+	if etag != "" {
+		req.Header.Set("If-None-Match", etag)
+	}
+	resp, err := client.Do(req)
+	if err != nil {
+		return nil, "", fmt.Errorf("do: %w", err)
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode == http.StatusNotModified {
+		_, _ = io.Copy(ioutil.Discard, resp.Body)
+		return nil, etag, nil
+	}
+	if resp.StatusCode != http.StatusOK {
+		_, _ = io.Copy(ioutil.Discard, resp.Body)
+		return nil, "", fmt.Errorf("bad status code: %d",
+			resp.StatusCode)
+	}
+	bs, err := decodeRoutes(resp.Body, nil, nil)
+	if err != nil {
+		return nil, "", fmt.Errorf("decode: %w", err)
+	}
+	routes, _ := splitBackends(bs)
+	return routes, resp.Header.Get("ETag"), nil
+}
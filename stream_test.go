@@ -0,0 +1,117 @@
+package lanhttp
+
+import (
+	"context"
+	"io/ioutil"
+	"log"
+	"net/http"
+	"net/http/httptest"
+	"reflect"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+func TestLongPoll(t *testing.T) {
+	t.Parallel()
+
+	srv := httptest.NewServer(http.HandlerFunc(
+		func(w http.ResponseWriter, r *http.Request) {
+			switch r.Header.Get("If-None-Match") {
+			case "":
+				w.Header().Set("ETag", "v1")
+				_, _ = w.Write([]byte(`{"a.internal":["10.0.0.1"]}`))
+			case "v1":
+				w.Header().Set("ETag", "v2")
+				_, _ = w.Write([]byte(
+					`{"a.internal":["10.0.0.1","10.0.0.2"]}`))
+			default:
+				// Hold the request open until the client
+				// gives up
+				<-r.Context().Done()
+			}
+		}))
+	defer srv.Close()
+
+	changes := make(chan Routes, 2)
+	c := NewClient(nil).OnChange(func(_, new Routes) {
+		changes <- new
+	})
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	err := c.StartStreaming(ctx, &LongPoll{
+		URL:       srv.URL,
+		RetryWait: 10 * time.Millisecond,
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, want := range []Routes{
+		{"a.internal": []string{"10.0.0.1"}},
+		{"a.internal": []string{"10.0.0.1", "10.0.0.2"}},
+	} {
+		select {
+		case got := <-changes:
+			if !reflect.DeepEqual(got, want) {
+				t.Fatalf("expected %v, got %v", want, got)
+			}
+		case <-time.After(5 * time.Second):
+			t.Fatal("timed out waiting for routes")
+		}
+	}
+}
+
+func TestLongPollNotModified(t *testing.T) {
+	t.Parallel()
+
+	// A server replying 304 right away is polled at most every RetryWait
+	var polls int32
+	srv := httptest.NewServer(http.HandlerFunc(
+		func(w http.ResponseWriter, r *http.Request) {
+			atomic.AddInt32(&polls, 1)
+			w.WriteHeader(http.StatusNotModified)
+		}))
+	defer srv.Close()
+
+	ctx, cancel := context.WithCancel(context.Background())
+	lp := &LongPoll{URL: srv.URL, RetryWait: 20 * time.Millisecond}
+	if _, err := lp.Subscribe(ctx); err != nil {
+		t.Fatal(err)
+	}
+	time.Sleep(100 * time.Millisecond)
+	cancel()
+	if n := atomic.LoadInt32(&polls); n > 10 {
+		t.Fatalf("expected at most 10 polls, got %d", n)
+	}
+}
+
+// routeSource pushes routes from its channel.
+type routeSource chan Routes
+
+func (src routeSource) Subscribe(context.Context) (<-chan Routes, error) {
+	return src, nil
+}
+
+func TestStartStreamingNormalizes(t *testing.T) {
+	t.Parallel()
+
+	changes := make(chan Routes, 1)
+	c := NewClient(nil).
+		WithLogger(log.New(ioutil.Discard, "", 0)).
+		OnChange(func(_, new Routes) { changes <- new })
+	src := make(routeSource, 1)
+	if err := c.StartStreaming(context.Background(), src); err != nil {
+		t.Fatal(err)
+	}
+	src <- Routes{"Foo.Internal.": {"10.0.0.1", "10.0.0.1", "garbage"}}
+	close(src)
+	want := Routes{"foo.internal": {"10.0.0.1"}}
+	select {
+	case got := <-changes:
+		if !reflect.DeepEqual(got, want) {
+			t.Fatalf("expected %v, got %v", want, got)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("timed out waiting for routes")
+	}
+}
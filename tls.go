@@ -0,0 +1,83 @@
+package lanhttp
+
+import (
+	"context"
+	"crypto/tls"
+	"net"
+	"net/http"
+	"time"
+)
+
+// serverNameKey is the context key of the hostname a resolved request was
+// originally sent to.
+type serverNameKey struct{}
+
+// withServerName returns a shallow copy of req which presents host as the TLS
+// server name when dialed by DialTLS.
+func withServerName(req *http.Request, host string) *http.Request {
+	ctx := context.WithValue(req.Context(), serverNameKey{}, host)
+	return req.WithContext(ctx)
+}
+
+// DialTLS returns a function for http.Transport's DialTLSContext which
+// verifies resolved backends against the original internal hostname rather
+// than their IP, since certificates for internal services are issued for
+// names like foo.internal. The name is also sent via SNI. Connections for
+// requests which weren't resolved by lanhttp verify the dialed host, as the
+// transport does by default.
+//
+// cfg may be nil. It's cloned for each connection and a ServerName set in it
+// takes precedence. DefaultClient configures this automatically, including for
+// the *http.Client returned by its HTTPClient method. When using NewClient or
+// RoundTripper with your own *http.Transport, set its DialTLSContext to
+// DialTLS(transport.TLSClientConfig) to get the same behavior.
+//
+// The transport pools connections by IP, so a connection opened for one
+// internal host may be reused for another host sharing that IP. Backends
+// serving several hosts should present a certificate valid for all of them.
+func DialTLS(
+	cfg *tls.Config,
+) func(ctx context.Context, network, addr string) (net.Conn, error) {
+	return dialTLS(defaultDialer, cfg)
+}
+
+// dialTLS is DialTLS using the given dialer.
+func dialTLS(
+	dialer *net.Dialer,
+	cfg *tls.Config,
+) func(ctx context.Context, network, addr string) (net.Conn, error) {
+	return func(
+		ctx context.Context,
+		network, addr string,
+	) (net.Conn, error) {
+		ctx, cancel := boundDial(ctx)
+		defer cancel()
+		conn, err := dialAddr(ctx, dialer, network, addr)
+		if err != nil {
+			return nil, err
+		}
+		var tcfg *tls.Config
+		if cfg == nil {
+			tcfg = &tls.Config{}
+		} else {
+			tcfg = cfg.Clone()
+		}
+		if tcfg.ServerName == "" {
+			name, _ := ctx.Value(serverNameKey{}).(string)
+			if name == "" {
+				name, _ = splitHostPort(addr)
+			}
+			tcfg.ServerName = name
+		}
+		if deadline, ok := ctx.Deadline(); ok {
+			_ = conn.SetDeadline(deadline)
+		}
+		tconn := tls.Client(conn, tcfg)
+		if err = tconn.Handshake(); err != nil {
+			conn.Close()
+			return nil, err
+		}
+		_ = conn.SetDeadline(time.Time{})
+		return tconn, nil
+	}
+}
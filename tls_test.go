@@ -0,0 +1,52 @@
+package lanhttp
+
+import (
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"testing"
+)
+
+func TestDialTLS(t *testing.T) {
+	t.Parallel()
+
+	// The test server's certificate is valid for example.com and 127.0.0.1
+	var serverName, host string
+	srv := httptest.NewTLSServer(http.HandlerFunc(
+		func(w http.ResponseWriter, r *http.Request) {
+			serverName = r.TLS.ServerName
+			host = r.Host
+		}))
+	defer srv.Close()
+
+	srvURL, err := url.Parse(srv.URL)
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, port, err := net.SplitHostPort(srvURL.Host)
+	if err != nil {
+		t.Fatal(err)
+	}
+	transport := srv.Client().Transport.(*http.Transport).Clone()
+	transport.DialTLSContext = DialTLS(transport.TLSClientConfig)
+	c := NewClient(&http.Client{Transport: transport}).
+		WithSuffix(".com").
+		WithRoutes(Routes{"example.com": []string{"127.0.0.1"}})
+
+	req, err := http.NewRequest("GET", "https://example.com:"+port, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp, err := c.Do(req)
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp.Body.Close()
+	if serverName != "example.com" {
+		t.Fatalf("expected server name example.com, got %q", serverName)
+	}
+	if want := "example.com:" + port; host != want {
+		t.Fatalf("expected host %s, got %s", want, host)
+	}
+}
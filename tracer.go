@@ -0,0 +1,66 @@
+package lanhttp
+
+import "context"
+
+// Tracer starts spans around requests sent by Do. It mirrors the parts of
+// OpenTelemetry's trace.Tracer that lanhttp uses, so tracing adds no
+// dependency for those who don't use it. To trace with OpenTelemetry, wrap its
+// tracer:
+//
+//	type otelTracer struct{ t trace.Tracer }
+//
+//	func (o otelTracer) Start(
+//		ctx context.Context,
+//		name string,
+//	) (context.Context, lanhttp.Span) {
+//		ctx, span := o.t.Start(ctx, name, trace.WithSpanKind(
+//			trace.SpanKindClient))
+//		return ctx, otelSpan{span}
+//	}
+//
+//	type otelSpan struct{ trace.Span }
+//
+//	func (s otelSpan) SetAttribute(key string, value interface{}) {
+//		switch v := value.(type) {
+//		case bool:
+//			s.SetAttributes(attribute.Bool(key, v))
+//		case string:
+//			s.SetAttributes(attribute.String(key, v))
+//		}
+//	}
+//
+//	func (s otelSpan) RecordError(err error) { s.Span.RecordError(err) }
+//
+//	func (s otelSpan) End() { s.Span.End() }
+type Tracer interface {
+	Start(ctx context.Context, name string) (context.Context, Span)
+}
+
+// Span of a single request sent by Do. Attribute values are strings or
+// bools.
+type Span interface {
+	SetAttribute(key string, value interface{})
+	RecordError(err error)
+	End()
+}
+
+// nopSpan is used when tracing is disabled.
+type nopSpan struct{}
+
+func (nopSpan) SetAttribute(string, interface{}) {}
+func (nopSpan) RecordError(error)                {}
+func (nopSpan) End()                             {}
+
+// WithTracer starts a span with tr around each request sent by Do, named after
+// the request's host. The span records the IP selected as "lanhttp.ip" and
+// whether the host resolved to an IP as "lanhttp.resolve_hit", which reflect
+// the final attempt when requests are retried. It ends once Do returns, and
+// records the error if the request fails. The request is sent with the span's
+// context, so the transport can propagate it.
+func (c *Client) WithTracer(tr Tracer) *Client {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	c.tracer = tr
+	return c
+}
@@ -0,0 +1,97 @@
+package lanhttp
+
+import (
+	"context"
+	"errors"
+	"net/http"
+	"reflect"
+	"sync"
+	"testing"
+)
+
+type spanKey struct{}
+
+// recordingTracer records every span it starts.
+type recordingTracer struct {
+	mu    sync.Mutex
+	spans []*recordedSpan
+}
+
+type recordedSpan struct {
+	name  string
+	attrs map[string]interface{}
+	err   error
+	ended bool
+}
+
+func (rt *recordingTracer) Start(
+	ctx context.Context,
+	name string,
+) (context.Context, Span) {
+	rt.mu.Lock()
+	defer rt.mu.Unlock()
+
+	span := &recordedSpan{name: name, attrs: map[string]interface{}{}}
+	rt.spans = append(rt.spans, span)
+	return context.WithValue(ctx, spanKey{}, span), span
+}
+
+func (s *recordedSpan) SetAttribute(key string, value interface{}) {
+	s.attrs[key] = value
+}
+
+func (s *recordedSpan) RecordError(err error) { s.err = err }
+
+func (s *recordedSpan) End() { s.ended = true }
+
+func TestWithTracer(t *testing.T) {
+	t.Parallel()
+
+	failed := errors.New("failed")
+	tr := &recordingTracer{}
+	var spanned bool
+	c := NewClient(clientFunc(
+		func(req *http.Request) (*http.Response, error) {
+			_, spanned = req.Context().Value(spanKey{}).(*recordedSpan)
+			if req.URL.Host == "example.com" {
+				return nil, failed
+			}
+			return routesClient{}.Do(req)
+		})).
+		WithTracer(tr).
+		WithRoutes(Routes{"a.internal": []string{"1"}})
+
+	for _, uri := range []string{"http://a.internal", "http://example.com"} {
+		req, err := http.NewRequest("GET", uri, nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+		resp, err := c.Do(req)
+		if err == nil {
+			resp.Body.Close()
+		}
+		if !spanned {
+			t.Fatalf("%s: expected request sent with span", uri)
+		}
+	}
+
+	want := []*recordedSpan{{
+		name: "a.internal",
+		attrs: map[string]interface{}{
+			"lanhttp.ip":          "1",
+			"lanhttp.resolve_hit": true,
+		},
+		ended: true,
+	}, {
+		name: "example.com",
+		attrs: map[string]interface{}{
+			"lanhttp.ip":          "",
+			"lanhttp.resolve_hit": false,
+		},
+		err:   failed,
+		ended: true,
+	}}
+	if !reflect.DeepEqual(tr.spans, want) {
+		t.Fatalf("expected %+v, got %+v", want, tr.spans)
+	}
+}
@@ -0,0 +1,80 @@
+package lanhttp
+
+import (
+	"context"
+	"fmt"
+	"net"
+	"strings"
+	"sync"
+)
+
+// unixPrefix starts routes to Unix domain sockets, e.g. "unix:/run/foo.sock".
+const unixPrefix = "unix:"
+
+// socketSuffix ends the placeholder hosts of URLs resolved to Unix sockets.
+// The .invalid TLD is reserved, so such hosts never resolve via DNS.
+const socketSuffix = ".lanhttp.invalid"
+
+// sockets maps the placeholder host of each Unix socket to its path.
+var sockets sync.Map
+
+// socketPath of a backend routed to a Unix socket. ok is false for other
+// backends.
+func socketPath(backend string) (path string, ok bool) {
+	if !strings.HasPrefix(backend, unixPrefix) {
+		return "", false
+	}
+	path = strings.TrimPrefix(backend, unixPrefix)
+	return path, strings.HasPrefix(path, "/")
+}
+
+// socketHost returns the placeholder host which URLs resolved to the socket at
+// path use, registering it for Dial. Each socket has its own host, so the
+// transport pools their connections separately.
+func socketHost(path string) string {
+	host := fmt.Sprintf("unix-%016x%s", hashKey(path), socketSuffix)
+	sockets.LoadOrStore(host, path)
+	return host
+}
+
+// WithUnixSockets allows routes to Unix domain sockets, given as
+// "unix:/path/to.sock", e.g. for sidecars reached through a socket rather than
+// TCP. They're dropped as invalid otherwise.
+//
+// URLs resolved to a socket use a placeholder host, and the request keeps its
+// original Host header as usual. The transport must dial with Dial, or DialTLS
+// for HTTPS, to reach the socket. DefaultClient configures this automatically.
+func (c *Client) WithUnixSockets() *Client {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	c.unixSockets = true
+	return c
+}
+
+// Dial is for http.Transport's DialContext. It connects to the Unix socket of
+// URLs resolved to one, and dials other addresses as usual.
+func Dial(ctx context.Context, network, addr string) (net.Conn, error) {
+	return dialAddr(ctx, defaultDialer, network, addr)
+}
+
+// defaultDialer is used by Dial and DialTLS.
+var defaultDialer = newDialer(nil)
+
+// dialAddr with dialer, connecting to the Unix socket addr refers to, if any.
+func dialAddr(
+	ctx context.Context,
+	dialer *net.Dialer,
+	network, addr string,
+) (net.Conn, error) {
+	ctx, cancel := boundDial(ctx)
+	defer cancel()
+
+	host, _, err := net.SplitHostPort(addr)
+	if err == nil && strings.HasSuffix(host, socketSuffix) {
+		if path, ok := sockets.Load(host); ok {
+			return dialer.DialContext(ctx, "unix", path.(string))
+		}
+	}
+	return dialer.DialContext(ctx, network, addr)
+}
@@ -0,0 +1,67 @@
+package lanhttp
+
+import (
+	"io/ioutil"
+	"net"
+	"net/http"
+	"os"
+	"path/filepath"
+	"reflect"
+	"testing"
+	"time"
+)
+
+func TestUnixSockets(t *testing.T) {
+	t.Parallel()
+
+	dir, err := ioutil.TempDir("", "lanhttp")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	path := filepath.Join(dir, "a.sock")
+	ln, err := net.Listen("unix", path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var host string
+	srv := &http.Server{Handler: http.HandlerFunc(
+		func(w http.ResponseWriter, r *http.Request) {
+			host = r.Host
+		})}
+	go func() { _ = srv.Serve(ln) }()
+	defer srv.Close()
+
+	c := DefaultClient(time.Second).WithUnixSockets().WithRoutes(Routes{
+		"a.internal": []string{"unix:" + path},
+	})
+	req, err := http.NewRequest("GET", "http://a.internal:8080/x", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp, err := c.Do(req)
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp.Body.Close()
+	if host != "a.internal:8080" {
+		t.Fatalf("expected host a.internal:8080, got %s", host)
+	}
+
+	// Socket routes are only valid when enabled
+	routes := map[string][]Backend{"a.internal": {
+		{IP: "unix:" + path},
+		{IP: "unix:relative.sock"},
+		{IP: "10.0.0.1"},
+	}}
+	c.dropInvalid("test", routes)
+	want := []Backend{{IP: "unix:" + path}, {IP: "10.0.0.1"}}
+	if !reflect.DeepEqual(routes["a.internal"], want) {
+		t.Fatalf("expected %v, got %v", want, routes["a.internal"])
+	}
+	routes = map[string][]Backend{"a.internal": {{IP: "unix:" + path}}}
+	NewClient(nil).dropInvalid("test", routes)
+	if len(routes["a.internal"]) != 0 {
+		t.Fatalf("expected socket dropped, got %v", routes["a.internal"])
+	}
+}
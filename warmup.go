@@ -0,0 +1,122 @@
+package lanhttp
+
+import (
+	"context"
+	"net/http"
+	"net/url"
+	"strings"
+	"time"
+)
+
+const (
+	// maxWarmups limits the warmup requests in flight at once
+	maxWarmups = 4
+
+	// warmupTimeout bounds each warmup request
+	warmupTimeout = 5 * time.Second
+)
+
+// WithWarmup makes the client open a connection to each backend which
+// appears in the routes, so the first real request to a new backend doesn't
+// pay for the TCP and TLS handshakes. Each new backend is sent a HEAD request
+// to the active health check path, or "/" without health checks, using its
+// host's scheme and port map rather than any port given in the health check
+// path. Warmups run in the background a few at a time, and failures are
+// ignored.
+//
+// Warmed connections are only reused if the underlying HTTPClient keeps
+// connections alive, which the one created by DefaultClient doesn't, so use
+// NewClient with a pooled client such as cleanhttp.DefaultPooledClient.
+// Warmups are skipped and logged for an *http.Client whose *http.Transport
+// disables keep-alives, since they'd only open connections to close them.
+func (c *Client) WithWarmup() *Client {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	if c.warmups == nil {
+		c.warmups = make(chan struct{}, maxWarmups)
+	}
+	return c
+}
+
+// warm up connections to the backends in new which are missing from old, in
+// the background.
+func (c *Client) warm(old, new Routes) {
+	c.mu.RLock()
+	sem := c.warmups
+	path := "/"
+	if c.checks != nil {
+		path = warmupPath(c.checks.path)
+	}
+	c.mu.RUnlock()
+	if sem == nil {
+		return
+	}
+	backends := removed(new, old)
+	if len(backends) == 0 {
+		return
+	}
+	if !keepsAlive(c.Transport()) {
+		c.log.Printf("warmup: skipping %d backends: "+
+			"transport disables keep-alives", len(backends))
+		return
+	}
+	go func() {
+		for _, b := range backends {
+			sem <- struct{}{}
+			go func(b hostIP) {
+				defer func() { <-sem }()
+				c.warmBackend(path, b.host, b.ip)
+			}(b)
+		}
+	}()
+}
+
+// warmBackend sends a HEAD request to ip, leaving its connection idle in the
+// HTTPClient's pool.
+func (c *Client) warmBackend(path, host, ip string) {
+	ctx, cancel := context.WithTimeout(context.Background(),
+		warmupTimeout)
+	defer cancel()
+
+	uri := url.URL{Scheme: "http", Path: path}
+	c.rewrite(&uri, host, "", ip)
+	req, err := http.NewRequestWithContext(ctx, "HEAD", uri.String(), nil)
+	if err != nil {
+		return
+	}
+	req.Host = host
+	req = withServerName(req, host)
+	resp, err := c.Transport().Do(req)
+	if err != nil {
+		return
+	}
+	drainClose(resp.Body)
+}
+
+// warmupPath for a health check path, without any port at its start, since
+// warmups go to the port real requests use.
+func warmupPath(path string) string {
+	if !strings.HasPrefix(path, ":") {
+		return path
+	}
+	if i := strings.IndexByte(path, '/'); i >= 0 {
+		return path[i:]
+	}
+	return "/"
+}
+
+// keepsAlive reports whether hc may keep connections alive between requests.
+// Only an *http.Client sending through an *http.Transport is known not to.
+func keepsAlive(hc HTTPClient) bool {
+	client, ok := hc.(*http.Client)
+	if !ok {
+		return true
+	}
+	rt := client.Transport
+	if rt == nil {
+		rt = http.DefaultTransport
+	}
+	t, ok := rt.(*http.Transport)
+	return !ok || !t.DisableKeepAlives
+}
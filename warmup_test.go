@@ -0,0 +1,133 @@
+package lanhttp
+
+import (
+	"bytes"
+	"log"
+	"net/http"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/hashicorp/go-cleanhttp"
+)
+
+func TestWithWarmup(t *testing.T) {
+	t.Parallel()
+
+	var (
+		mu      sync.Mutex
+		warmed  []string
+		active  int
+		maxSeen int
+	)
+	release := make(chan struct{})
+	c := NewClient(clientFunc(
+		func(req *http.Request) (*http.Response, error) {
+			mu.Lock()
+			warmed = append(warmed, req.Method+" "+req.Host+" "+
+				req.URL.String())
+			active++
+			if active > maxSeen {
+				maxSeen = active
+			}
+			mu.Unlock()
+			<-release
+			mu.Lock()
+			active--
+			mu.Unlock()
+			return routesClient{}.Do(req)
+		})).
+		WithWarmup().
+		WithPortMap(map[string]string{"a.internal": "8080"})
+	count := func() int {
+		mu.Lock()
+		defer mu.Unlock()
+		return len(warmed)
+	}
+	waitFor := func(n int) {
+		t.Helper()
+		deadline := time.Now().Add(time.Second)
+		for count() < n {
+			if time.Now().After(deadline) {
+				t.Fatalf("expected %d warmups, got %d", n, count())
+			}
+			time.Sleep(time.Millisecond)
+		}
+	}
+
+	// Routes change without waiting on the warmups, which are limited
+	// in number
+	c.changeRoutes(toBackends(Routes{"a.internal": []string{
+		"10.0.0.1", "10.0.0.2", "10.0.0.3", "10.0.0.4", "10.0.0.5",
+		"10.0.0.6",
+	}}))
+	waitFor(maxWarmups)
+	time.Sleep(10 * time.Millisecond)
+	if got := count(); got != maxWarmups {
+		t.Fatalf("expected %d warmups in flight, got %d", maxWarmups, got)
+	}
+	close(release)
+	waitFor(6)
+
+	// Only new backends are warmed up
+	c.changeRoutes(toBackends(Routes{"a.internal": []string{
+		"10.0.0.1", "10.0.0.7",
+	}}))
+	waitFor(7)
+	time.Sleep(10 * time.Millisecond)
+
+	mu.Lock()
+	defer mu.Unlock()
+	if len(warmed) != 7 || maxSeen > maxWarmups {
+		t.Fatalf("expected 7 warmups, at most %d at once, got %d, %d",
+			maxWarmups, len(warmed), maxSeen)
+	}
+	want := "HEAD a.internal http://10.0.0.7:8080/"
+	if warmed[6] != want {
+		t.Fatalf("expected %q, got %q", want, warmed[6])
+	}
+}
+
+func TestWarmupHealthPort(t *testing.T) {
+	t.Parallel()
+
+	warmed := make(chan string, 1)
+	c := NewClient(clientFunc(
+		func(req *http.Request) (*http.Response, error) {
+			warmed <- req.URL.String()
+			return routesClient{}.Do(req)
+		})).
+		WithHealthCheck(":8080/health", time.Minute).
+		WithPortMap(map[string]string{"a.internal": "9000"}).
+		WithWarmup()
+	c.changeRoutes(toBackends(Routes{"a.internal": []string{"10.0.0.1"}}))
+	want := "http://10.0.0.1:9000/health"
+	select {
+	case got := <-warmed:
+		if got != want {
+			t.Fatalf("expected %s, got %s", want, got)
+		}
+	case <-time.After(time.Second):
+		t.Fatal("timed out waiting for warmup")
+	}
+}
+
+func TestWarmupWithoutKeepAlives(t *testing.T) {
+	t.Parallel()
+
+	var buf bytes.Buffer
+	c := DefaultClient(time.Second).
+		WithLogger(log.New(&buf, "", 0)).
+		WithWarmup()
+	c.changeRoutes(toBackends(Routes{"a.internal": []string{"10.0.0.1"}}))
+	if !strings.Contains(buf.String(), "warmup: skipping 1 backends") {
+		t.Fatalf("expected skipped warmups logged, got %q", buf.String())
+	}
+
+	// Pooled transports are warmed
+	pooled := &http.Client{Transport: cleanhttp.DefaultPooledTransport()}
+	if !keepsAlive(pooled) {
+		t.Fatal("expected pooled transport to keep alive")
+	}
+}